@@ -0,0 +1,202 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/apigban/lenslocked_v1/views"
+	"github.com/gorilla/mux"
+)
+
+// Prefix is the path the API is mounted on
+const Prefix = "/api/v1"
+
+// NewRouter returns a router serving the JSON API under Prefix.
+// It expects the current user to be resolved into the request
+// context by the middleware.User middleware.
+func NewRouter(r *mux.Router, services *models.Services) *mux.Router {
+	users := &Users{}
+	galleries := &Galleries{gs: services.Gallery, is: services.Image}
+
+	api := r.PathPrefix(Prefix).Subrouter()
+	api.NotFoundHandler = http.HandlerFunc(notFound)
+	api.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+
+	api.HandleFunc("/users/me", requireScope(models.ScopeProfileRead, users.Me)).Methods("GET")
+
+	api.HandleFunc("/galleries", requireScope(models.ScopeGalleriesRead, galleries.Index)).Methods("GET")
+	api.HandleFunc("/galleries", requireScope(models.ScopeGalleriesWrite, galleries.Create)).Methods("POST")
+	api.HandleFunc("/galleries/{id:[0-9]+}", requireScope(models.ScopeGalleriesRead, galleries.Show)).Methods("GET")
+	api.HandleFunc("/galleries/{id:[0-9]+}", requireScope(models.ScopeGalleriesWrite, galleries.Update)).Methods("PUT", "PATCH")
+	api.HandleFunc("/galleries/{id:[0-9]+}", requireScope(models.ScopeGalleriesWrite, galleries.Delete)).Methods("DELETE")
+
+	api.HandleFunc("/galleries/{id:[0-9]+}/images", requireScope(models.ScopeGalleriesRead, galleries.Images)).Methods("GET")
+	api.HandleFunc("/galleries/{id:[0-9]+}/images", requireScope(models.ScopeImagesWrite, galleries.Upload)).Methods("POST")
+	api.HandleFunc("/galleries/{id:[0-9]+}/images/order", requireScope(models.ScopeImagesWrite, galleries.Reorder)).Methods("PUT")
+	api.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}", requireScope(models.ScopeImagesWrite, galleries.UpdateImage)).Methods("PUT", "PATCH")
+	api.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}", requireScope(models.ScopeImagesWrite, galleries.DeleteImage)).Methods("DELETE")
+	return api
+}
+
+// errorEnvelope is the body of every error response:
+//
+//	{"error": {"code": "email_taken", "message": "...", "fields": {"email": "..."}}}
+type errorEnvelope struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// Error codes of failures that don't come from a PublicError
+const (
+	codeInternal          = "internal"
+	codeInvalid           = "invalid"
+	codeUnauthorized      = "unauthorized"
+	codeInsufficientScope = "insufficient_scope"
+	codeNotFound          = "not_found"
+	codeMethodNotAllowed  = "method_not_allowed"
+)
+
+// writeJSON responds with v encoded as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError responds with the error envelope for err, using the
+// same status codes and messages as the HTML views
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	views.LogError(r, err)
+	locale := context.Locale(r.Context())
+
+	body := errorBody{
+		Code:    errorCode(err),
+		Message: views.ErrorMessage(locale, err),
+	}
+	errs := []error{err}
+	if multiErr, ok := err.(views.MultiError); ok {
+		errs = multiErr.Errors()
+	}
+	for _, e := range errs {
+		if fieldErr, ok := e.(views.FieldError); ok && fieldErr.Field() != "" {
+			if body.Fields == nil {
+				body.Fields = make(map[string]string)
+			}
+			body.Fields[fieldErr.Field()] = views.ErrorMessage(locale, e)
+		}
+	}
+	writeJSON(w, views.StatusCode(err), errorEnvelope{Error: body})
+}
+
+func errorCode(err error) string {
+	if multiErr, ok := err.(views.MultiError); ok {
+		if errs := multiErr.Errors(); len(errs) == 1 {
+			return errorCode(errs[0])
+		}
+		return codeInvalid
+	}
+	if _, ok := err.(views.PublicError); !ok {
+		return codeInternal
+	}
+	if coded, ok := err.(interface{ Code() string }); ok && coded.Code() != "" {
+		return coded.Code()
+	}
+	return codeInvalid
+}
+
+// writeStatus responds with an error envelope for one of the
+// codes above, for failures that aren't backed by an error
+func writeStatus(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, errorEnvelope{Error: errorBody{
+		Code:    code,
+		Message: http.StatusText(status),
+	}})
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, http.StatusNotFound, codeNotFound)
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, http.StatusMethodNotAllowed, codeMethodNotAllowed)
+}
+
+// requireUser responds with 401 Unauthorized rather than
+// redirecting to the login page like middleware.RequireUser
+func requireUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if context.User(r.Context()) == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeStatus(w, http.StatusUnauthorized, codeUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireScope is requireUser for requests made with an API or
+// OAuth token that must have been granted scope. Users signed in with
+// a cookie have every scope.
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return requireUser(func(w http.ResponseWriter, r *http.Request) {
+		if token := context.Token(r.Context()); token != nil && !token.HasScope(scope) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+			writeStatus(w, http.StatusForbidden, codeInsufficientScope)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// decodeJSON reads the request body into dst
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBody))
+	if err := dec.Decode(dst); err != nil {
+		return badRequest{err}
+	}
+	return nil
+}
+
+const maxJSONBody = 1 << 20
+
+// badRequest is returned when the request body can't be read
+type badRequest struct {
+	err error
+}
+
+func (e badRequest) Error() string {
+	return "api: bad request: " + e.err.Error()
+}
+
+func (e badRequest) Public() string {
+	return "The request body is invalid: " + e.err.Error()
+}
+
+func (e badRequest) Code() string {
+	return "bad_request"
+}
+
+func (e badRequest) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+// idParam returns the numeric {id} route variable
+func idParam(r *http.Request) (uint, error) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return 0, models.ErrNotFound
+	}
+	return uint(id), nil
+}
+
+func idString(id uint) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/jinzhu/gorm"
+)
+
+func TestRequireScope(t *testing.T) {
+	user := &models.User{Model: gorm.Model{ID: 1}}
+	handler := requireScope(models.ScopeGalleriesWrite, func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name  string
+		user  *models.User
+		token models.ScopedToken
+		want  int
+	}{
+		{"signed in with a cookie", user, nil, http.StatusOK},
+		{"api token with scope", user, &models.APIToken{Scopes: models.ScopeGalleriesRead + " " + models.ScopeGalleriesWrite}, http.StatusOK},
+		{"api token without scope", user, &models.APIToken{Scopes: models.ScopeGalleriesRead}, http.StatusForbidden},
+		{"oauth token without scope", user, &models.OAuthToken{Scopes: models.ScopeProfileRead}, http.StatusForbidden},
+		{"anonymous", nil, nil, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", Prefix+"/galleries", nil)
+		ctx := req.Context()
+		if tt.user != nil {
+			ctx = context.WithUser(ctx, tt.user)
+		}
+		if tt.token != nil {
+			ctx = context.WithToken(ctx, tt.token)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req.WithContext(ctx))
+		if rec.Code != tt.want {
+			t.Errorf("%s: expected %d. Received %d", tt.name, tt.want, rec.Code)
+		}
+		if tt.want == http.StatusForbidden && !strings.Contains(rec.Header().Get("WWW-Authenticate"), "insufficient_scope") {
+			t.Errorf("%s: expected an insufficient_scope challenge. Received %q", tt.name, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
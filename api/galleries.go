@@ -0,0 +1,432 @@
+package api
+
+import (
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxMultipartMem is how much of an upload is kept in memory,
+	// the rest is buffered in temporary files
+	maxMultipartMem = 1 << 20 // 1 megabyte
+)
+
+type Galleries struct {
+	gs models.GalleryService
+	is models.ImageService
+}
+
+type galleryJSON struct {
+	ID          uint   `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	// Tags are left out of lists, see models.Gallery
+	Tags       []string    `json:"tags,omitempty"`
+	Visibility string      `json:"visibility"`
+	URL        string      `json:"url"`
+	CoverURL   string      `json:"cover_url,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+	UpdatedAt  time.Time   `json:"updated_at"`
+	Images     []imageJSON `json:"images,omitempty"`
+}
+
+type imageJSON struct {
+	Filename string   `json:"filename"`
+	URL      string   `json:"url"`
+	Position int      `json:"position"`
+	Caption  string   `json:"caption"`
+	AltText  string   `json:"alt_text"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// imageRequest leaves the fields that are missing unchanged
+type imageRequest struct {
+	Caption *string  `json:"caption"`
+	AltText *string  `json:"alt_text"`
+	Tags    []string `json:"tags"`
+}
+
+// orderRequest lists the filenames of every image of the gallery
+// in their new order
+type orderRequest struct {
+	Filenames []string `json:"filenames"`
+}
+
+type galleryRequest struct {
+	// Title, Description and Tags are left unchanged by updates
+	// when missing
+	Title       *string  `json:"title"`
+	Description *string  `json:"description"`
+	Tags        []string `json:"tags"`
+	// Visibility is left unchanged by updates when empty
+	Visibility string `json:"visibility"`
+}
+
+func newGalleryJSON(gallery *models.Gallery) galleryJSON {
+	return galleryJSON{
+		ID:          gallery.ID,
+		Title:       gallery.Title,
+		Description: gallery.Description,
+		Tags:        gallery.Tags,
+		Visibility:  gallery.Visibility,
+		URL:         gallery.Path(),
+		CoverURL:    gallery.CoverPath(),
+		CreatedAt:   gallery.CreatedAt,
+		UpdatedAt:   gallery.UpdatedAt,
+	}
+}
+
+func newImagesJSON(gallery *models.Gallery, images []models.Image) []imageJSON {
+	ret := make([]imageJSON, len(images))
+	for i := range images {
+		ret[i] = newImageJSON(gallery, &images[i])
+	}
+	return ret
+}
+
+func newImageJSON(gallery *models.Gallery, image *models.Image) imageJSON {
+	return imageJSON{
+		Filename: image.Filename,
+		URL:      gallery.ImagePath(image),
+		Position: image.Position,
+		Caption:  image.Caption,
+		AltText:  image.AltText,
+		Tags:     image.Tags,
+	}
+}
+
+// Index lists the galleries of the authenticated user
+//
+// GET /api/v1/galleries
+func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	galleries, err := g.gs.ByUserID(user.ID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ret := make([]galleryJSON, len(galleries))
+	for i := range galleries {
+		ret[i] = newGalleryJSON(&galleries[i])
+	}
+	writeJSON(w, http.StatusOK, ret)
+}
+
+// Create expects {"title": "...", "description": "...", "tags":
+// [...], "visibility": "..."}, galleries are private unless told
+// otherwise
+//
+// POST /api/v1/galleries
+func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
+	var req galleryRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	user := context.User(r.Context())
+	gallery := models.Gallery{
+		Tags:       req.Tags,
+		UserID:     user.ID,
+		Visibility: req.Visibility,
+	}
+	if req.Title != nil {
+		gallery.Title = *req.Title
+	}
+	if req.Description != nil {
+		gallery.Description = *req.Description
+	}
+	if err := g.gs.Create(&gallery); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", Prefix+"/galleries/"+idString(gallery.ID))
+	writeJSON(w, http.StatusCreated, newGalleryJSON(&gallery))
+}
+
+// Show returns the gallery along with its images
+//
+// GET /api/v1/galleries/{id}
+func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.authorized(r, models.ActionView)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	images, err := g.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ret := newGalleryJSON(gallery)
+	ret.Images = newImagesJSON(gallery, images)
+	writeJSON(w, http.StatusOK, ret)
+}
+
+// Update expects {"title": "...", "description": "...", "tags":
+// [...], "visibility": "..."}
+//
+// PUT /api/v1/galleries/{id}
+func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.authorized(r, models.ActionEdit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var req galleryRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if req.Visibility != "" && req.Visibility != gallery.Visibility {
+		user := context.User(r.Context())
+		if err := g.gs.Authorize(user, gallery, models.ActionManage); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		gallery.Visibility = req.Visibility
+	}
+	if req.Title != nil {
+		gallery.Title = *req.Title
+	}
+	if req.Description != nil {
+		gallery.Description = *req.Description
+	}
+	if req.Tags != nil {
+		gallery.Tags = req.Tags
+	}
+	if err := g.gs.Update(gallery); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newGalleryJSON(gallery))
+}
+
+// Delete removes the gallery and its images
+//
+// DELETE /api/v1/galleries/{id}
+func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.authorized(r, models.ActionManage)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// Images go first: if that fails the gallery is still there
+	// to try again
+	if err := g.is.DeleteAll(gallery.ID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := g.gs.Delete(gallery.ID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Images lists the images of the gallery
+//
+// GET /api/v1/galleries/{id}/images
+func (g *Galleries) Images(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.authorized(r, models.ActionView)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	images, err := g.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newImagesJSON(gallery, images))
+}
+
+// Upload expects a multipart/form-data body with one or more
+// files in the "images" field
+//
+// POST /api/v1/galleries/{id}/images
+func (g *Galleries) Upload(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.authorized(r, models.ActionUpload)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
+		writeError(w, r, badRequest{err})
+		return
+	}
+	if r.MultipartForm == nil || len(r.MultipartForm.File["images"]) == 0 {
+		writeError(w, r, models.ErrImageRequired)
+		return
+	}
+	existing, err := g.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	user := context.User(r.Context())
+	var uploaded []models.Image
+	for _, f := range r.MultipartForm.File["images"] {
+		filename := filepath.Base(f.Filename)
+		if !models.IsImageFile(filename) {
+			writeError(w, r, models.ErrImageInvalid)
+			return
+		}
+		if hasImage(existing, filename) {
+			// Replacing an image is editing it, contributors
+			// may only add new ones
+			if err := g.gs.Authorize(user, gallery, models.ActionEdit); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+		file, err := f.Open()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		err = g.is.Create(gallery.ID, file, filename)
+		file.Close()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		uploaded = append(uploaded, models.Image{GalleryID: gallery.ID, Filename: filename})
+	}
+	writeJSON(w, http.StatusCreated, newImagesJSON(gallery, uploaded))
+}
+
+// DeleteImage removes a single image from the gallery
+//
+// DELETE /api/v1/galleries/{id}/images/{filename}
+func (g *Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.authorized(r, models.ActionEdit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	image := models.Image{
+		GalleryID: gallery.ID,
+		Filename:  mux.Vars(r)["filename"],
+	}
+	if err := g.is.Delete(&image); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if gallery.CoverImage == image.Filename {
+		gallery.CoverImage = ""
+		if err := g.gs.Update(gallery); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UpdateImage expects {"caption": "...", "alt_text": "...",
+// "tags": [...]}
+//
+// PUT /api/v1/galleries/{id}/images/{filename}
+func (g *Galleries) UpdateImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.authorized(r, models.ActionEdit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var req imageRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	image, err := g.image(gallery, mux.Vars(r)["filename"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if req.Caption != nil {
+		image.Caption = *req.Caption
+	}
+	if req.AltText != nil {
+		image.AltText = *req.AltText
+	}
+	image.Tags = req.Tags
+	if err := g.is.Update(image); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newImageJSON(gallery, image))
+}
+
+// image looks up the image of the gallery stored under filename
+func (g *Galleries) image(gallery *models.Gallery, filename string) (*models.Image, error) {
+	images, err := g.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range images {
+		if images[i].Filename == filename {
+			return &images[i], nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+// Reorder expects {"filenames": [...]} listing every image of the
+// gallery, and returns the images in their new order
+//
+// PUT /api/v1/galleries/{id}/images/order
+func (g *Galleries) Reorder(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.authorized(r, models.ActionEdit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var req orderRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := g.is.Reorder(gallery.ID, req.Filenames); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	images, err := g.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newImagesJSON(gallery, images))
+}
+
+// hasImage reports whether one of images is named filename
+func hasImage(images []models.Image, filename string) bool {
+	for _, image := range images {
+		if image.Filename == filename {
+			return true
+		}
+	}
+	return false
+}
+
+// authorized looks up the gallery from the {id} route variable,
+// and checks that the user may take action on it. Unlisted
+// galleries of other users are never found by ID. See
+// GalleryService.Authorize.
+func (g *Galleries) authorized(r *http.Request, action models.Action) (*models.Gallery, error) {
+	id, err := idParam(r)
+	if err != nil {
+		return nil, err
+	}
+	gallery, err := g.gs.ByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.gs.Authorize(context.User(r.Context()), gallery, action); err != nil {
+		return nil, err
+	}
+	return gallery, nil
+}
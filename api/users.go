@@ -0,0 +1,39 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/models"
+)
+
+type Users struct{}
+
+// userJSON is the public representation of a models.User,
+// hashes are never exposed
+type userJSON struct {
+	ID        uint      `json:"id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Locale    string    `json:"locale,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newUserJSON(user *models.User) userJSON {
+	return userJSON{
+		ID:        user.ID,
+		Name:      user.Name,
+		Email:     user.Email,
+		Locale:    user.Locale,
+		CreatedAt: user.CreatedAt,
+	}
+}
+
+// Me returns the authenticated user
+//
+// GET /api/v1/users/me
+func (u *Users) Me(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	writeJSON(w, http.StatusOK, newUserJSON(user))
+}
@@ -0,0 +1,117 @@
+package assets
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Embedded holds the static assets compiled into the binary
+//
+//go:embed css js
+var Embedded embed.FS
+
+const (
+	// hashLen is the number of hex characters of the content
+	// hash inserted in asset filenames
+	hashLen = 12
+
+	cacheForever = "public, max-age=31536000, immutable"
+	cacheNever   = "no-cache"
+)
+
+// New builds a Server for the assets in fsys. When immutable is
+// true every asset gets a content-hashed filename, eg.
+// css/lenslocked.css -> css/lenslocked.3f2a9c1b7d4e.css, that
+// can be cached by browsers forever. Development should use
+// immutable false so edits show up on reload.
+func New(fsys fs.FS, immutable bool) (*Server, error) {
+	s := &Server{
+		fsys:     fsys,
+		hashed:   make(map[string]string),
+		original: make(map[string]string),
+	}
+	if !immutable {
+		return s, nil
+	}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(b)
+		hashedName := hashName(name, hex.EncodeToString(sum[:])[:hashLen])
+		s.hashed[name] = hashedName
+		s.original[hashedName] = name
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Server serves static assets under the /assets/ prefix
+type Server struct {
+	fsys fs.FS
+
+	hashed   map[string]string // original name -> hashed name
+	original map[string]string // hashed name -> original name
+}
+
+// Path returns the URL an asset is served from, eg.
+// "/assets/css/lenslocked.3f2a9c1b7d4e.css" for "css/lenslocked.css"
+func (s *Server) Path(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	if h, ok := s.hashed[name]; ok {
+		name = h
+	}
+	return "/assets/" + name
+}
+
+// ServeHTTP expects the /assets/ prefix to already be stripped.
+// Hashed filenames are served with long-cache headers, anything
+// else must be revalidated by the browser.
+//
+// GET /assets/{name}
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	cache := cacheNever
+	if orig, ok := s.original[name]; ok {
+		name = orig
+		cache = cacheForever
+	}
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		// No directory listings
+		http.NotFound(w, r)
+		return
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", cache)
+	http.ServeContent(w, r, name, fi.ModTime(), content)
+}
+
+// hashName inserts hash before the extension of name
+func hashName(name, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
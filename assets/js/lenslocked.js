@@ -0,0 +1,58 @@
+// Editors reorder the images of a gallery by dragging them, the
+// new order is saved as soon as an image is dropped.
+(function () {
+  var form = document.getElementById('image-order');
+  var grid = document.getElementById('gallery-images');
+  if (!form || !grid) {
+    return;
+  }
+  var order = function () {
+    return Array.prototype.map.call(grid.querySelectorAll('[data-filename]'), function (item) {
+      return item.getAttribute('data-filename');
+    });
+  };
+  var before = order().join('/');
+  var dragged = null;
+
+  grid.addEventListener('dragstart', function (e) {
+    dragged = e.target.closest('[data-filename]');
+    if (dragged) {
+      e.dataTransfer.effectAllowed = 'move';
+    }
+  });
+  grid.addEventListener('dragover', function (e) {
+    var over = e.target.closest('[data-filename]');
+    if (!dragged || !over) {
+      return;
+    }
+    e.preventDefault();
+    if (over === dragged) {
+      return;
+    }
+    var rect = over.getBoundingClientRect();
+    var after = e.clientX > rect.left + rect.width / 2;
+    grid.insertBefore(dragged, after ? over.nextSibling : over);
+  });
+  grid.addEventListener('drop', function (e) {
+    e.preventDefault();
+  });
+  grid.addEventListener('dragend', function () {
+    if (!dragged) {
+      return;
+    }
+    dragged = null;
+    var filenames = order();
+    if (filenames.join('/') === before) {
+      return;
+    }
+    // Every image is listed, the server rejects partial orders
+    filenames.forEach(function (filename) {
+      var input = document.createElement('input');
+      input.type = 'hidden';
+      input.name = 'filenames';
+      input.value = filename;
+      form.appendChild(input);
+    });
+    form.submit();
+  });
+})();
@@ -7,7 +7,10 @@ import (
 )
 
 const (
-	userKey privateKey = "user"
+	userKey      privateKey = "user"
+	requestIDKey privateKey = "request_id"
+	localeKey    privateKey = "locale"
+	tokenKey     privateKey = "token"
 )
 
 type privateKey string
@@ -28,3 +31,46 @@ func User(ctx context.Context) *models.User {
 	//	if user is not present in context, return no user
 	return nil
 }
+
+// WithRequestID sets the ID identifying the current request
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the ID of the current request or an
+// empty string if none was set
+func RequestID(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// WithLocale sets the locale the response should be written in
+func WithLocale(ctx context.Context, locale string) context.Context {
+	return context.WithValue(ctx, localeKey, locale)
+}
+
+// Locale returns the locale of the current request or an
+// empty string if none was set
+func Locale(ctx context.Context) string {
+	if locale, ok := ctx.Value(localeKey).(string); ok {
+		return locale
+	}
+	return ""
+}
+
+// WithToken sets the scoped token, eg. an API token, the current
+// request was authenticated with
+func WithToken(ctx context.Context, token models.ScopedToken) context.Context {
+	return context.WithValue(ctx, tokenKey, token)
+}
+
+// Token returns the scoped token the current request was
+// authenticated with, or nil if it came with a cookie
+func Token(ctx context.Context) models.ScopedToken {
+	if token, ok := ctx.Value(tokenKey).(models.ScopedToken); ok {
+		return token
+	}
+	return nil
+}
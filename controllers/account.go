@@ -0,0 +1,224 @@
+package controllers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/email"
+	"github.com/apigban/lenslocked_v1/i18n"
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/apigban/lenslocked_v1/rand"
+	"github.com/apigban/lenslocked_v1/views"
+)
+
+// NewAccount is used to create the controller letting users
+// delete their account. Accounts are purged once grace has
+// passed, until then users can sign in and restore them. Users
+// without a password confirm with a link emailed through ls,
+// starting with baseURL.
+func NewAccount(us models.UserService, ls models.LoginLinkService, mailer email.Mailer, baseURL string, grace time.Duration) *Account {
+	return &Account{
+		EditView:    views.NewView("bootstrap", "settings/account"),
+		ConfirmView: views.NewView("bootstrap", "settings/account_confirm"),
+		us:          us,
+		ls:          ls,
+		mailer:      mailer,
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		grace:       grace,
+	}
+}
+
+type Account struct {
+	EditView    *views.View
+	ConfirmView *views.View
+	us          models.UserService
+	ls          models.LoginLinkService
+	mailer      email.Mailer
+	baseURL     string
+	grace       time.Duration
+}
+
+// DeleteAccountForm confirms who is deleting the account, users
+// without a password leave it empty
+type DeleteAccountForm struct {
+	Password string `schema:"password"`
+}
+
+// ConfirmDeleteForm carries the token of the link emailed to
+// users without a password
+type ConfirmDeleteForm struct {
+	Token string `schema:"token"`
+}
+
+// Edit shows the account settings of the signed in user
+//
+// GET /settings/account
+func (a *Account) Edit(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	a.EditView.Render(w, r, vd)
+}
+
+// Delete schedules the deletion of the account of the signed in
+// user and signs them out everywhere. Users without a password
+// are emailed a link to confirm instead, see ConfirmDelete.
+//
+// POST /settings/account/delete
+func (a *Account) Delete(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form DeleteAccountForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.EditView.Render(w, r, vd)
+		return
+	}
+	user := context.User(r.Context())
+	if user.PurgeAt != nil {
+		http.Redirect(w, r, "/settings/account", http.StatusFound)
+		return
+	}
+	if !user.HasPassword() {
+		a.emailConfirmation(w, r, user)
+		return
+	}
+	if _, err := a.us.Authenticate(user.Email, form.Password); err != nil {
+		vd.SetAlert(err)
+		a.EditView.Render(w, r, vd)
+		return
+	}
+	a.scheduleDeletion(w, r, user)
+}
+
+// ConfirmDelete asks users to confirm the deletion of their
+// account with the link they clicked, which isn't used right
+// away for the same reason as login links, see LoginLinks.Confirm
+//
+// GET /settings/account/delete
+func (a *Account) ConfirmDelete(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	vd.Form = url.Values{"token": {r.URL.Query().Get("token")}}
+	a.ConfirmView.Render(w, r, vd)
+}
+
+// DeleteConfirmed uses up the link emailed by Delete and schedules
+// the deletion of the account of the signed in user, as long as
+// the link was sent to them
+//
+// POST /settings/account/delete/confirm
+func (a *Account) DeleteConfirmed(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ConfirmDeleteForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.EditView.Render(w, r, vd)
+		return
+	}
+	user := context.User(r.Context())
+	if user.PurgeAt != nil {
+		http.Redirect(w, r, "/settings/account", http.StatusFound)
+		return
+	}
+	link, err := a.ls.Redeem(form.Token, models.LoginLinkDeleteAccount)
+	if err == nil && !strings.EqualFold(link.Email, user.Email) {
+		err = models.ErrNotFound
+	}
+	if err == models.ErrNotFound {
+		vd.AlertError("account.link_invalid")
+		a.EditView.RenderStatus(w, r, http.StatusUnauthorized, vd)
+		return
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		a.EditView.Render(w, r, vd)
+		return
+	}
+	a.scheduleDeletion(w, r, user)
+}
+
+// emailConfirmation emails user a link to confirm the deletion
+// of their account
+func (a *Account) emailConfirmation(w http.ResponseWriter, r *http.Request, user *models.User) {
+	var vd views.Data
+	link := models.LoginLink{Email: user.Email, Purpose: models.LoginLinkDeleteAccount}
+	if err := a.ls.Create(&link); err != nil {
+		vd.SetAlert(err)
+		a.EditView.Render(w, r, vd)
+		return
+	}
+	locale := context.Locale(r.Context())
+	msg := email.Message{
+		To:      link.Email,
+		Subject: i18n.T(locale, "account.confirm_subject"),
+		Text: i18n.T(locale, "account.confirm_body",
+			a.baseURL+"/settings/account/delete?"+url.Values{"token": {link.Token}}.Encode(),
+			int(models.LoginLinkTTL.Minutes())),
+	}
+	if err := a.mailer.Send(r.Context(), msg); err != nil {
+		vd.SetAlert(err)
+		a.EditView.Render(w, r, vd)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "account.confirm_sent",
+	}
+	views.RedirectAlert(w, r, "/settings/account", http.StatusFound, alert)
+}
+
+// scheduleDeletion sets when the account of user is purged and
+// signs them out everywhere
+func (a *Account) scheduleDeletion(w http.ResponseWriter, r *http.Request, user *models.User) {
+	var vd views.Data
+	// A new remember token signs out every session
+	token, err := rand.RememberToken()
+	if err != nil {
+		vd.SetAlert(err)
+		a.EditView.Render(w, r, vd)
+		return
+	}
+	purgeAt := time.Now().Add(a.grace)
+	user.PurgeAt = &purgeAt
+	user.Remember = token
+	if err := a.us.Update(user); err != nil {
+		vd.SetAlert(err)
+		a.EditView.Render(w, r, vd)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "remember_token",
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	locale := context.Locale(r.Context())
+	alert := views.Alert{
+		Level:   views.AlertLvlInfo,
+		Message: i18n.T(locale, "account.deletion_scheduled", purgeAt.Format("2006-01-02")),
+	}
+	views.RedirectAlert(w, r, "/", http.StatusFound, alert)
+}
+
+// Restore cancels the deletion of the account of the signed in
+// user
+//
+// POST /settings/account/restore
+func (a *Account) Restore(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if user.PurgeAt != nil {
+		user.PurgeAt = nil
+		if err := a.us.Update(user); err != nil {
+			var vd views.Data
+			vd.SetAlert(err)
+			a.EditView.Render(w, r, vd)
+			return
+		}
+	}
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "account.restored",
+	}
+	views.RedirectAlert(w, r, "/settings/account", http.StatusFound, alert)
+}
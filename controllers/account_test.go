@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+func (fu *fakeUsers) Update(user *models.User) error {
+	fu.user = user
+	return nil
+}
+
+func TestAccountDeletePasswordless(t *testing.T) {
+	user := &models.User{Model: gorm.Model{ID: 7}, Email: "pam@dundermifflin.com"}
+	other := &models.User{Model: gorm.Model{ID: 8}, Email: "dwight@dundermifflin.com"}
+	var sent outbox
+	links := &fakeLoginLinks{links: map[string]*models.LoginLink{}}
+	accountC := NewAccount(&fakeUsers{user: user}, links, &sent, "https://lenslocked.com", time.Hour)
+	r := mux.NewRouter()
+	r.HandleFunc("/settings/account/delete", accountC.Delete).Methods("POST")
+	r.HandleFunc("/settings/account/delete/confirm", accountC.DeleteConfirmed).Methods("POST")
+
+	post := func(user *models.User, path string, form url.Values) int {
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithUser(req.Context(), user))
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := post(user, "/settings/account/delete", nil); code != http.StatusFound {
+		t.Fatalf("Expected a redirect once the link is emailed. Received %d", code)
+	}
+	if user.PurgeAt != nil {
+		t.Fatal("Expected the deletion to wait for the emailed link")
+	}
+	if len(sent) != 1 || sent[0].To != user.Email {
+		t.Fatalf("Expected a confirmation link to be emailed to %s. Sent %+v", user.Email, sent)
+	}
+	link, err := url.Parse(linkRegex.FindString(sent[0].Text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := url.Values{"token": {link.Query().Get("token")}}
+
+	// Sign in links don't confirm deletions
+	signIn := models.LoginLink{Email: user.Email}
+	if err := links.Create(&signIn); err != nil {
+		t.Fatal(err)
+	}
+	if code := post(user, "/settings/account/delete/confirm", url.Values{"token": {signIn.Token}}); code != http.StatusUnauthorized {
+		t.Errorf("Expected a sign in link to be rejected. Received %d", code)
+	}
+	if code := post(other, "/settings/account/delete/confirm", token); code != http.StatusUnauthorized {
+		t.Errorf("Expected a link sent to another user to be rejected. Received %d", code)
+	}
+	if user.PurgeAt != nil {
+		t.Fatal("Expected the account to be kept")
+	}
+
+	// The attempt of the other user used up the link
+	links.links[token.Get("token")] = &models.LoginLink{Email: user.Email, Purpose: models.LoginLinkDeleteAccount}
+	if code := post(user, "/settings/account/delete/confirm", token); code != http.StatusFound {
+		t.Errorf("Expected the deletion to be confirmed. Received %d", code)
+	}
+	if user.PurgeAt == nil {
+		t.Error("Expected the deletion to be scheduled")
+	}
+}
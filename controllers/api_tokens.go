@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/apigban/lenslocked_v1/views"
+	"github.com/gorilla/mux"
+)
+
+// tokenExpiries are the lifetimes offered for new API tokens, in
+// days. 0 means the token never expires.
+var tokenExpiries = []int{30, 90, 365, 0}
+
+// NewAPITokens is used to create a new APITokens controller.
+// This function will panic if the templates are not
+// parsed correctly, and should only be used during
+// initial setup.
+func NewAPITokens(ts models.APITokenService) *APITokens {
+	return &APITokens{
+		IndexView: views.NewView("bootstrap", "settings/tokens"),
+		ts:        ts,
+	}
+}
+
+type APITokens struct {
+	IndexView *views.View
+	ts        models.APITokenService
+}
+
+type APITokenForm struct {
+	Name      string   `schema:"name"`
+	Scopes    []string `schema:"scopes"`
+	ExpiresIn int      `schema:"expires_in"`
+}
+
+// tokensPage is the Yield of the settings/tokens view
+type tokensPage struct {
+	Tokens []models.APIToken
+	// Created is the token that was just created, the only
+	// time its value can be displayed
+	Created  *models.APIToken
+	Scopes   []string
+	Expiries []int
+	// Selected are the scopes checked in the form
+	Selected map[string]bool
+}
+
+// Index lists the API tokens of the signed in user
+//
+// GET /settings/tokens
+func (t *APITokens) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	t.render(w, r, vd, nil)
+}
+
+// Create generates a new API token and displays it once
+//
+// POST /settings/tokens
+func (t *APITokens) Create(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form APITokenForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		t.render(w, r, vd, nil)
+		return
+	}
+	vd.KeepForm(r)
+	user := context.User(r.Context())
+	token := models.APIToken{
+		UserID: user.ID,
+		Name:   form.Name,
+		Scopes: strings.Join(form.Scopes, " "),
+	}
+	if form.ExpiresIn > 0 {
+		expiresAt := time.Now().AddDate(0, 0, form.ExpiresIn)
+		token.ExpiresAt = &expiresAt
+	}
+	if err := t.ts.Create(&token); err != nil {
+		vd.SetAlert(err)
+		t.render(w, r, vd, nil)
+		return
+	}
+	vd.Form = nil
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "tokens.created",
+	}
+	t.render(w, r, vd, &token)
+}
+
+// Delete revokes one of the API tokens of the signed in user
+//
+// POST /settings/tokens/{id}/delete
+func (t *APITokens) Delete(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err == nil {
+		err = t.ts.Delete(uint(id), user.ID)
+	}
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		t.render(w, r, vd, nil)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "tokens.revoked",
+	}
+	views.RedirectAlert(w, r, "/settings/tokens", http.StatusFound, alert)
+}
+
+// render displays the tokens of the signed in user along with
+// created, if it isn't nil
+func (t *APITokens) render(w http.ResponseWriter, r *http.Request, vd views.Data, created *models.APIToken) {
+	user := context.User(r.Context())
+	tokens, err := t.ts.ByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	page := tokensPage{
+		Tokens:   tokens,
+		Created:  created,
+		Scopes:   models.Scopes,
+		Expiries: tokenExpiries,
+		Selected: make(map[string]bool),
+	}
+	for _, scope := range vd.Form["scopes"] {
+		page.Selected[scope] = true
+	}
+	vd.Yield = page
+	t.IndexView.Render(w, r, vd)
+}
@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/views"
+)
+
+// NewErrors is used to create the controller rendering
+// the 404, 405 and 500 pages.
+// This function will panic if the templates are not
+// parsed correctly.
+func NewErrors() *Errors {
+	return &Errors{
+		NotFoundView:         views.NewView("bootstrap", "errors/404"),
+		MethodNotAllowedView: views.NewView("bootstrap", "errors/405"),
+		InternalErrorView:    views.NewView("bootstrap", "errors/500"),
+	}
+}
+
+type Errors struct {
+	NotFoundView         *views.View
+	MethodNotAllowedView *views.View
+	InternalErrorView    *views.View
+}
+
+// NotFound is used as the router's NotFoundHandler
+func (e *Errors) NotFound(w http.ResponseWriter, r *http.Request) {
+	e.NotFoundView.RenderStatus(w, r, http.StatusNotFound, nil)
+}
+
+// MethodNotAllowed is used as the router's MethodNotAllowedHandler
+func (e *Errors) MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	e.MethodNotAllowedView.RenderStatus(w, r, http.StatusMethodNotAllowed, nil)
+}
+
+// InternalError renders the 500 page along with the request ID
+// so users can reference it when contacting support
+func (e *Errors) InternalError(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		RequestID string
+	}{
+		RequestID: context.RequestID(r.Context()),
+	}
+	e.InternalErrorView.RenderStatus(w, r, http.StatusInternalServerError, data)
+}
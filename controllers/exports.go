@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/exports"
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/apigban/lenslocked_v1/views"
+	"github.com/gorilla/mux"
+)
+
+// NewExports is used to create the controller letting users
+// download their data. Archives are built by worker.
+func NewExports(es models.ExportService, worker *exports.Worker) *Exports {
+	return &Exports{
+		IndexView: views.NewView("bootstrap", "settings/export"),
+		es:        es,
+		worker:    worker,
+	}
+}
+
+type Exports struct {
+	IndexView *views.View
+	es        models.ExportService
+	worker    *exports.Worker
+}
+
+// Index lists the exports of the signed in user
+//
+// GET /settings/export
+func (e *Exports) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	e.render(w, r, vd)
+}
+
+// Create starts building an archive of the data of the signed in
+// user, they get an email once it is ready
+//
+// POST /settings/export
+func (e *Exports) Create(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := context.User(r.Context())
+	existing, err := e.es.ByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		e.render(w, r, vd)
+		return
+	}
+	for _, export := range existing {
+		if export.Status == models.ExportPending {
+			vd.AlertError("export.in_progress")
+			e.render(w, r, vd)
+			return
+		}
+	}
+	export := models.Export{UserID: user.ID}
+	if err := e.es.Create(&export); err != nil {
+		vd.SetAlert(err)
+		e.render(w, r, vd)
+		return
+	}
+	e.worker.Enqueue(&export)
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "export.requested",
+	}
+	views.RedirectAlert(w, r, "/settings/export", http.StatusFound, alert)
+}
+
+// Download sends the archive of an export of the signed in user,
+// as long as it didn't expire
+//
+// GET /settings/export/{id}
+func (e *Exports) Download(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := context.User(r.Context())
+	export, err := e.export(r, user)
+	if err != nil {
+		vd.SetAlert(err)
+		e.render(w, r, vd)
+		return
+	}
+	if !export.Downloadable() {
+		vd.AlertError("export.expired")
+		e.render(w, r, vd)
+		return
+	}
+	f, err := os.Open(export.Path())
+	if err != nil {
+		vd.SetAlert(err)
+		e.render(w, r, vd)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="lenslocked-`+export.CreatedAt.Format("2006-01-02")+`.zip"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	http.ServeContent(w, r, "", export.UpdatedAt, f)
+}
+
+// export returns the export with the ID in the path, as long as
+// it belongs to user
+func (e *Exports) export(r *http.Request, user *models.User) (*models.Export, error) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return nil, models.ErrNotFound
+	}
+	export, err := e.es.ByID(uint(id))
+	if err != nil {
+		return nil, err
+	}
+	if export.UserID != user.ID {
+		return nil, models.ErrNotFound
+	}
+	return export, nil
+}
+
+// render displays the exports of the signed in user
+func (e *Exports) render(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	user := context.User(r.Context())
+	exports, err := e.es.ByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = exports
+	e.IndexView.Render(w, r, vd)
+}
@@ -1,31 +1,141 @@
 package controllers
 
 import (
+	"archive/zip"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
 
 	"github.com/apigban/lenslocked_v1/context"
 	"github.com/apigban/lenslocked_v1/models"
 	"github.com/apigban/lenslocked_v1/views"
+	"github.com/gorilla/mux"
 )
 
 //
 // TODO - SET method GET /
-func NewGalleries(gs models.GalleryService) *Galleries {
+func NewGalleries(gs models.GalleryService, is models.ImageService, us models.UserService) *Galleries {
 	return &Galleries{
-		New: views.NewView("bootstrap", "galleries/new"),
-		gs:  gs,
+		New:         views.NewView("bootstrap", "galleries/new"),
+		IndexView:   views.NewView("bootstrap", "galleries/index"),
+		ShowView:    views.NewView("bootstrap", "galleries/show"),
+		ProfileView: views.NewView("bootstrap", "users/profile"),
+		gs:          gs,
+		is:          is,
+		us:          us,
 	}
 }
 
 type Galleries struct {
-	New *views.View
-	gs  models.GalleryService
+	New         *views.View
+	IndexView   *views.View
+	ShowView    *views.View
+	ProfileView *views.View
+	gs          models.GalleryService
+	is          models.ImageService
+	us          models.UserService
 }
 
 type GalleryForm struct {
-	Title string `schema:"title"`
+	Title       string `schema:"title"`
+	Description string `schema:"description"`
+	// Tags are separated by commas, see models.ParseTags
+	Tags       string `schema:"tags"`
+	Visibility string `schema:"visibility"`
+}
+
+type ImageForm struct {
+	Caption string `schema:"caption"`
+	AltText string `schema:"alt_text"`
+	Tags    string `schema:"tags"`
+}
+
+// OrderForm lists the filenames of every image of a gallery in
+// their new order
+type OrderForm struct {
+	Filenames []string `schema:"filenames"`
+}
+
+// CoverForm picks the cover image of a gallery, an empty
+// filename removes it
+type CoverForm struct {
+	Filename string `schema:"filename"`
+}
+
+// maxUploadMem is how much of an upload is kept in memory, the
+// rest is buffered in temporary files
+const maxUploadMem = 1 << 20 // 1 megabyte
+
+// galleryPage is the Yield of the page of a gallery
+type galleryPage struct {
+	Gallery     *models.Gallery
+	Images      []galleryImage
+	CanDownload bool
+	// CanUpload, CanEdit and CanManage offer the forms to the owner
+	// and the members with the matching role
+	CanUpload bool
+	CanEdit   bool
+	CanManage bool
+}
+
+// galleriesPage is the Yield of the list of galleries
+type galleriesPage struct {
+	Galleries []models.Gallery
+	// Shared are the galleries of others the user is a member of
+	Shared []models.Gallery
+}
+
+type galleryImage struct {
+	Filename string
+	Path     string
+	Caption  string
+	AltText  string
+	Tags     []string
+	// TagList is Tags as typed in the form editing them
+	TagList string
+	IsCover bool
+	// EditPath is the prefix of the paths the forms editing the
+	// image are posted to
+	EditPath string
+}
+
+// profilePage is the Yield of the profile page of a user
+type profilePage struct {
+	Name      string
+	Galleries []models.Gallery
+}
+
+// Index lists the galleries of the signed in user, followed by
+// the ones they are a member of
+//
+// GET /galleries
+func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := context.User(r.Context())
+	galleries, err := g.gs.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+		vd.SetAlert(err)
+		g.IndexView.Render(w, r, vd)
+		return
+	}
+	shared, err := g.gs.ByMemberUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+		vd.SetAlert(err)
+		g.IndexView.Render(w, r, vd)
+		return
+	}
+	vd.Yield = galleriesPage{Galleries: galleries, Shared: shared}
+	g.IndexView.Render(w, r, vd)
 }
 
 // POST /galleries
@@ -35,23 +145,525 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	if err := parseForm(r, &form); err != nil {
 		log.Println(err)
 		vd.SetAlert(err)
-		g.New.Render(w, vd)
+		g.New.Render(w, r, vd)
 		return
 	}
 
+	vd.KeepForm(r)
 	user := context.User(r.Context())
 	if user == nil {
 		http.Redirect(w, r, "/login", http.StatusFound)
+		return
 	}
-	fmt.Println("Create got the user: ", user)
 	gallery := models.Gallery{
-		Title:  form.Title,
-		UserID: user.ID,
+		Title:       form.Title,
+		Description: form.Description,
+		Tags:        models.ParseTags(form.Tags),
+		UserID:      user.ID,
+		Visibility:  form.Visibility,
 	}
 	if err := g.gs.Create(&gallery); err != nil {
 		vd.SetAlert(err)
-		g.New.Render(w, vd)
+		g.New.Render(w, r, vd)
+		return
+	}
+	http.Redirect(w, r, gallery.Path(), http.StatusFound)
+}
+
+// Show displays the gallery with its images, to anyone its
+// visibility allows. Its owner can change it from there.
+//
+// GET /galleries/{id}
+// GET /g/{slug}
+func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	gallery, err := g.authorized(r, models.ActionView)
+	if err != nil {
+		vd.SetAlert(err)
+		g.ShowView.Render(w, r, vd)
+		return
+	}
+	g.renderShow(w, r, vd, gallery)
+}
+
+// Update changes the title, description, tags and visibility of
+// the gallery
+//
+// POST /galleries/{id}/update
+func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	gallery, err := g.authorized(r, models.ActionEdit)
+	if err != nil {
+		vd.SetAlert(err)
+		g.ShowView.Render(w, r, vd)
+		return
+	}
+	var form GalleryForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderShow(w, r, vd, gallery)
+		return
+	}
+	vd.KeepForm(r)
+	if form.Visibility == "" {
+		// Only offered to users who may change it
+		form.Visibility = gallery.Visibility
+	}
+	if form.Visibility != gallery.Visibility {
+		user := context.User(r.Context())
+		if err := g.gs.Authorize(user, gallery, models.ActionManage); err != nil {
+			vd.SetAlert(err)
+			g.renderShow(w, r, vd, gallery)
+			return
+		}
+	}
+	gallery.Title = form.Title
+	gallery.Description = form.Description
+	gallery.Tags = models.ParseTags(form.Tags)
+	gallery.Visibility = form.Visibility
+	if err := g.gs.Update(gallery); err != nil {
+		vd.SetAlert(err)
+		g.renderShow(w, r, vd, gallery)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "galleries.updated",
+	}
+	views.RedirectAlert(w, r, gallery.Path(), http.StatusFound, alert)
+}
+
+// Upload adds the images of the "images" field to the gallery.
+// Contributors may add images but not replace the ones already
+// there, which takes the right to edit the gallery.
+//
+// POST /galleries/{id}/images
+func (g *Galleries) Upload(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	gallery, err := g.authorized(r, models.ActionUpload)
+	if err != nil {
+		vd.SetAlert(err)
+		g.ShowView.Render(w, r, vd)
+		return
+	}
+	if err := r.ParseMultipartForm(maxUploadMem); err != nil {
+		vd.SetAlert(models.ErrImageRequired)
+		g.renderShow(w, r, vd, gallery)
+		return
+	}
+	files := r.MultipartForm.File["images"]
+	if len(files) == 0 {
+		vd.SetAlert(models.ErrImageRequired)
+		g.renderShow(w, r, vd, gallery)
+		return
+	}
+	existing, err := g.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		g.renderShow(w, r, vd, gallery)
+		return
+	}
+	canReplace := g.gs.Authorize(context.User(r.Context()), gallery, models.ActionEdit) == nil
+	for _, f := range files {
+		filename := filepath.Base(f.Filename)
+		if !models.IsImageFile(filename) {
+			vd.SetAlert(models.ErrImageInvalid)
+			g.renderShow(w, r, vd, gallery)
+			return
+		}
+		if !canReplace && hasImage(existing, filename) {
+			vd.SetAlert(models.ErrForbidden)
+			g.renderShow(w, r, vd, gallery)
+			return
+		}
+		file, err := f.Open()
+		if err == nil {
+			err = g.is.Create(gallery.ID, file, filename)
+			file.Close()
+		}
+		if err != nil {
+			vd.SetAlert(err)
+			g.renderShow(w, r, vd, gallery)
+			return
+		}
+	}
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "galleries.uploaded",
+	}
+	views.RedirectAlert(w, r, gallery.Path(), http.StatusFound, alert)
+}
+
+// DeleteImage removes a single image from the gallery
+//
+// POST /galleries/{id}/images/{filename}/delete
+func (g *Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	gallery, err := g.authorized(r, models.ActionEdit)
+	if err != nil {
+		vd.SetAlert(err)
+		g.ShowView.Render(w, r, vd)
+		return
+	}
+	image := models.Image{
+		GalleryID: gallery.ID,
+		Filename:  path.Base(mux.Vars(r)["filename"]),
+	}
+	if err := g.is.Delete(&image); err != nil {
+		vd.SetAlert(err)
+		g.renderShow(w, r, vd, gallery)
+		return
+	}
+	if gallery.CoverImage == image.Filename {
+		gallery.CoverImage = ""
+		if err := g.gs.Update(gallery); err != nil {
+			vd.SetAlert(err)
+			g.renderShow(w, r, vd, gallery)
+			return
+		}
+	}
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "galleries.image_deleted",
+	}
+	views.RedirectAlert(w, r, gallery.Path(), http.StatusFound, alert)
+}
+
+// UpdateImage changes the caption, alt text and tags of an image
+//
+// POST /galleries/{id}/images/{filename}/update
+func (g *Galleries) UpdateImage(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	gallery, err := g.authorized(r, models.ActionEdit)
+	if err != nil {
+		vd.SetAlert(err)
+		g.ShowView.Render(w, r, vd)
+		return
+	}
+	var form ImageForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderShow(w, r, vd, gallery)
+		return
+	}
+	image := models.Image{
+		GalleryID: gallery.ID,
+		Filename:  path.Base(mux.Vars(r)["filename"]),
+		Caption:   form.Caption,
+		AltText:   form.AltText,
+		Tags:      models.ParseTags(form.Tags),
+	}
+	if err := g.is.Update(&image); err != nil {
+		vd.SetAlert(err)
+		g.renderShow(w, r, vd, gallery)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "galleries.image_updated",
+	}
+	views.RedirectAlert(w, r, gallery.Path(), http.StatusFound, alert)
+}
+
+// Reorder moves the images of the gallery to the order they are
+// listed in, which has to include every one of them
+//
+// POST /galleries/{id}/images/order
+func (g *Galleries) Reorder(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	gallery, err := g.authorized(r, models.ActionEdit)
+	if err != nil {
+		vd.SetAlert(err)
+		g.ShowView.Render(w, r, vd)
+		return
+	}
+	var form OrderForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderShow(w, r, vd, gallery)
+		return
+	}
+	if err := g.is.Reorder(gallery.ID, form.Filenames); err != nil {
+		vd.SetAlert(err)
+		g.renderShow(w, r, vd, gallery)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "galleries.reordered",
+	}
+	views.RedirectAlert(w, r, gallery.Path(), http.StatusFound, alert)
+}
+
+// SetCover picks the image shown for the gallery in lists
+//
+// POST /galleries/{id}/cover
+func (g *Galleries) SetCover(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	gallery, err := g.authorized(r, models.ActionEdit)
+	if err != nil {
+		vd.SetAlert(err)
+		g.ShowView.Render(w, r, vd)
+		return
+	}
+	var form CoverForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderShow(w, r, vd, gallery)
+		return
+	}
+	if form.Filename != "" {
+		images, err := g.is.ByGalleryID(gallery.ID)
+		if err == nil && !hasImage(images, form.Filename) {
+			err = models.ErrNotFound
+		}
+		if err != nil {
+			vd.SetAlert(err)
+			g.renderShow(w, r, vd, gallery)
+			return
+		}
+	}
+	gallery.CoverImage = form.Filename
+	if err := g.gs.Update(gallery); err != nil {
+		vd.SetAlert(err)
+		g.renderShow(w, r, vd, gallery)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "galleries.cover_updated",
+	}
+	views.RedirectAlert(w, r, gallery.Path(), http.StatusFound, alert)
+}
+
+// Image serves a single image of the gallery, to anyone its
+// visibility allows
+//
+// GET /images/galleries/{id}/{filename}
+// GET /g/{slug}/images/{filename}
+func (g *Galleries) Image(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.authorized(r, models.ActionView)
+	if err != nil {
+		views.LogError(r, err)
+		http.Error(w, http.StatusText(views.StatusCode(err)), views.StatusCode(err))
+		return
+	}
+	g.serveImage(w, r, gallery)
+}
+
+// serveImage serves the image of gallery named by the {filename}
+// route variable, once the user was authorized to view it
+func (g *Galleries) serveImage(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
+	image := models.Image{
+		GalleryID: gallery.ID,
+		Filename:  path.Base(mux.Vars(r)["filename"]),
+	}
+	f, err := os.Open(image.RelativePath())
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	if gallery.Visibility != models.VisibilityPublic {
+		// Shared caches must not hand the image to anyone else
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+	http.ServeContent(w, r, image.Filename, info.ModTime(), f)
+}
+
+// Profile lists the public galleries of a user
+//
+// GET /users/{id}
+func (g *Galleries) Profile(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		vd.SetAlert(models.ErrNotFound)
+		g.ProfileView.Render(w, r, vd)
+		return
+	}
+	user, err := g.us.ByID(uint(id))
+	if err == nil && user.PurgeAt != nil {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		g.ProfileView.Render(w, r, vd)
+		return
+	}
+	galleries, err := g.gs.PublicByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		g.ProfileView.Render(w, r, vd)
+		return
+	}
+	vd.Yield = profilePage{Name: user.Name, Galleries: galleries}
+	g.ProfileView.Render(w, r, vd)
+}
+
+// renderShow renders the page of gallery along with vd, which
+// may carry an alert or form errors
+func (g *Galleries) renderShow(w http.ResponseWriter, r *http.Request, vd views.Data, gallery *models.Gallery) {
+	images, err := g.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		g.ShowView.Render(w, r, vd)
+		return
+	}
+	user := context.User(r.Context())
+	page := galleryPage{
+		Gallery:     gallery,
+		Images:      make([]galleryImage, len(images)),
+		CanDownload: g.gs.Authorize(user, gallery, models.ActionDownload) == nil,
+		CanUpload:   g.gs.Authorize(user, gallery, models.ActionUpload) == nil,
+		CanEdit:     g.gs.Authorize(user, gallery, models.ActionEdit) == nil,
+		CanManage:   g.gs.Authorize(user, gallery, models.ActionManage) == nil,
+	}
+	for i := range images {
+		page.Images[i] = galleryImage{
+			Filename: images[i].Filename,
+			Path:     gallery.ImagePath(&images[i]),
+			Caption:  images[i].Caption,
+			AltText:  images[i].AltText,
+			Tags:     images[i].Tags,
+			TagList:  strings.Join(images[i].Tags, ", "),
+			IsCover:  images[i].Filename == gallery.CoverImage,
+			EditPath: fmt.Sprintf("/galleries/%d/images/%s", gallery.ID, url.PathEscape(images[i].Filename)),
+		}
+	}
+	if vd.Form == nil {
+		vd.Form = url.Values{
+			"title":       {gallery.Title},
+			"description": {gallery.Description},
+			"tags":        {strings.Join(gallery.Tags, ", ")},
+			"visibility":  {gallery.Visibility},
+		}
+	}
+	vd.Yield = page
+	g.ShowView.Render(w, r, vd)
+}
+
+// Download streams a zip archive of the original images of the
+// gallery. The archive is written as it is built, once it started
+// a failure can only be reported by cutting it short.
+//
+// GET /galleries/{id}/download
+// GET /g/{slug}/download
+func (g *Galleries) Download(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.authorized(r, models.ActionDownload)
+	if err != nil {
+		views.LogError(r, err)
+		http.Error(w, http.StatusText(views.StatusCode(err)), views.StatusCode(err))
+		return
+	}
+	g.download(w, r, gallery)
+}
+
+// download streams the archive of gallery, once the user was
+// authorized to download it
+func (g *Galleries) download(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
+	images, err := g.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		views.LogError(r, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprint(w, gallery)
+
+	dir := archiveName(gallery)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": dir + ".zip"}))
+	w.Header().Set("Cache-Control", "private, no-store")
+	zw := zip.NewWriter(w)
+	seen := make(map[string]bool)
+	for _, image := range images {
+		name := path.Join(dir, uniqueName(seen, image.Filename))
+		if err := image.WriteZip(zw, name); err != nil {
+			// Without the central directory at the end, clients
+			// see the archive as broken rather than incomplete
+			views.LogError(r, err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		views.LogError(r, err)
+	}
+}
+
+// authorized looks up the gallery from the {slug} or {id} route
+// variable, and checks that the signed in user, if any, may take
+// action on it. See GalleryService.Authorize.
+func (g *Galleries) authorized(r *http.Request, action models.Action) (*models.Gallery, error) {
+	vars := mux.Vars(r)
+	var gallery *models.Gallery
+	var err error
+	if slug, ok := vars["slug"]; ok {
+		gallery, err = g.gs.BySlug(slug)
+	} else {
+		var id uint64
+		id, err = strconv.ParseUint(vars["id"], 10, 64)
+		if err != nil {
+			return nil, models.ErrNotFound
+		}
+		gallery, err = g.gs.ByID(uint(id))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := g.gs.Authorize(context.User(r.Context()), gallery, action); err != nil {
+		return nil, err
+	}
+	return gallery, nil
+}
+
+// hasImage reports whether one of images is named filename
+func hasImage(images []models.Image, filename string) bool {
+	for _, image := range images {
+		if image.Filename == filename {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveName turns the title of gallery into a name safe to use
+// for the archive and the folder in it, eg. "Costa Rica 2022!"
+// becomes "costa-rica-2022"
+func archiveName(gallery *models.Gallery) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(gallery.Title) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		dash = true
+	}
+	if b.Len() == 0 {
+		return fmt.Sprintf("gallery-%d", gallery.ID)
+	}
+	return b.String()
+}
+
+// uniqueName returns name, or "name (2).ext" and so on if an
+// earlier file already used it. Names are compared regardless of
+// case, archives are often extracted where "a.jpg" and "A.JPG"
+// are the same file.
+func uniqueName(seen map[string]bool, name string) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	ret := name
+	for i := 2; seen[strings.ToLower(ret)]; i++ {
+		ret = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	seen[strings.ToLower(ret)] = true
+	return ret
 }
@@ -0,0 +1,351 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// fakeGalleries keeps galleries in memory. Authorize is the real
+// one, it only uses the database through members.
+type fakeGalleries struct {
+	models.GalleryService
+	galleries []models.Gallery
+	members   *fakeMembers
+}
+
+func newFakeGalleries(galleries ...models.Gallery) *fakeGalleries {
+	members := &fakeMembers{}
+	return &fakeGalleries{
+		GalleryService: models.NewGalleryService(nil, members),
+		galleries:      galleries,
+		members:        members,
+	}
+}
+
+// fakeMembers keeps gallery members in memory
+type fakeMembers struct {
+	models.GalleryMemberService
+	members []models.GalleryMember
+}
+
+func (fm *fakeMembers) Role(galleryID, userID uint) (string, error) {
+	for _, m := range fm.members {
+		if m.GalleryID == galleryID && m.UserID == userID && userID != 0 {
+			return m.Role, nil
+		}
+	}
+	return "", nil
+}
+
+func (fg *fakeGalleries) ByID(id uint) (*models.Gallery, error) {
+	for i := range fg.galleries {
+		if fg.galleries[i].ID == id {
+			return &fg.galleries[i], nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+// fakeImageDB keeps the rows of images in memory
+type fakeImageDB struct {
+	models.ImageDB
+	images []models.Image
+}
+
+func (fi *fakeImageDB) ByGalleryID(galleryID uint) ([]models.Image, error) {
+	var ret []models.Image
+	for _, image := range fi.images {
+		if image.GalleryID == galleryID {
+			ret = append(ret, image)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Position < ret[j].Position })
+	return ret, nil
+}
+
+func (fi *fakeImageDB) Create(image *models.Image) error {
+	position := 0
+	for _, existing := range fi.images {
+		if existing.GalleryID != image.GalleryID {
+			continue
+		}
+		if existing.Filename == image.Filename {
+			*image = existing
+			return nil
+		}
+		if existing.Position > position {
+			position = existing.Position
+		}
+	}
+	image.ID = uint(len(fi.images) + 1)
+	image.Position = position + 1
+	fi.images = append(fi.images, *image)
+	return nil
+}
+
+func (fi *fakeImageDB) Update(image *models.Image) error {
+	caption, altText := image.Caption, image.AltText
+	fi.Create(image)
+	for i := range fi.images {
+		if fi.images[i].ID == image.ID {
+			fi.images[i].Caption, fi.images[i].AltText = caption, altText
+		}
+	}
+	image.Caption, image.AltText = caption, altText
+	return nil
+}
+
+func (fi *fakeImageDB) Reorder(galleryID uint, filenames []string) error {
+	for i, filename := range filenames {
+		image := models.Image{GalleryID: galleryID, Filename: filename}
+		fi.Create(&image)
+		for j := range fi.images {
+			if fi.images[j].ID == image.ID {
+				fi.images[j].Position = i + 1
+			}
+		}
+	}
+	return nil
+}
+
+func (fi *fakeImageDB) Delete(image *models.Image) error {
+	for i, existing := range fi.images {
+		if existing.GalleryID == image.GalleryID && existing.Filename == image.Filename {
+			fi.images = append(fi.images[:i], fi.images[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// get requests path as the user with userID, or signed out when
+// it is 0
+func get(h http.Handler, path string, userID uint) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	if userID != 0 {
+		req = req.WithContext(context.WithUser(req.Context(), &models.User{Model: gorm.Model{ID: userID}}))
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// inTempDir runs the test from an empty directory, images are
+// stored relative to the working directory
+func inTempDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestGalleryDownload(t *testing.T) {
+	inTempDir(t)
+	is := models.NewImageService(&fakeImageDB{})
+	for _, name := range []string{"Beach.jpg", "beach.JPG", "sunset.png"} {
+		if err := is.Create(3, strings.NewReader(name), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	galleriesC := NewGalleries(newFakeGalleries(
+		models.Gallery{Model: gorm.Model{ID: 3}, UserID: 7, Title: "Costa Rica 2022!", Visibility: models.VisibilityPrivate},
+	), is, nil)
+	r := mux.NewRouter()
+	r.HandleFunc("/galleries/{id:[0-9]+}/download", galleriesC.Download)
+
+	download := func(userID uint) *httptest.ResponseRecorder {
+		return get(r, "/galleries/3/download", userID)
+	}
+
+	if rec := download(8); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected private galleries of other users to be not found. Received %d", rec.Code)
+	}
+
+	rec := download(7)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200. Received %d", rec.Code)
+	}
+	if cd := rec.Header().Get("Content-Disposition"); cd != `attachment; filename=costa-rica-2022.zip` {
+		t.Errorf("Unexpected Content-Disposition %q", cd)
+	}
+	body := rec.Body.Bytes()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"costa-rica-2022/Beach.jpg":     "Beach.jpg",
+		"costa-rica-2022/beach (2).JPG": "beach.JPG",
+		"costa-rica-2022/sunset.png":    "sunset.png",
+	}
+	if len(zr.File) != len(want) {
+		t.Errorf("Expected %d files. Received %d", len(want), len(zr.File))
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		if content, ok := want[f.Name]; !ok || string(b) != content {
+			t.Errorf("Unexpected file %s with %q", f.Name, b)
+		}
+	}
+}
+
+func TestGalleryImage(t *testing.T) {
+	inTempDir(t)
+	is := models.NewImageService(&fakeImageDB{})
+	for _, id := range []uint{1, 2} {
+		if err := is.Create(id, strings.NewReader("jpeg"), "a.jpg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	galleriesC := NewGalleries(newFakeGalleries(
+		models.Gallery{Model: gorm.Model{ID: 1}, UserID: 7, Title: "Private", Visibility: models.VisibilityPrivate},
+		models.Gallery{Model: gorm.Model{ID: 2}, UserID: 7, Title: "Public", Visibility: models.VisibilityPublic},
+	), is, nil)
+	r := mux.NewRouter()
+	r.HandleFunc("/images/galleries/{id:[0-9]+}/{filename}", galleriesC.Image)
+
+	tests := []struct {
+		path   string
+		userID uint
+		want   int
+	}{
+		{"/images/galleries/1/a.jpg", 7, http.StatusOK},
+		{"/images/galleries/1/a.jpg", 8, http.StatusNotFound},
+		{"/images/galleries/1/a.jpg", 0, http.StatusNotFound},
+		{"/images/galleries/2/a.jpg", 0, http.StatusOK},
+		{"/images/galleries/2/b.jpg", 0, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rec := get(r, tt.path, tt.userID); rec.Code != tt.want {
+			t.Errorf("GET %s as %d: expected %d. Received %d", tt.path, tt.userID, tt.want, rec.Code)
+		}
+	}
+}
+
+func TestGalleryUpload(t *testing.T) {
+	inTempDir(t)
+	is := models.NewImageService(&fakeImageDB{})
+	if err := is.Create(3, strings.NewReader("lead"), "a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	gs := newFakeGalleries(
+		models.Gallery{Model: gorm.Model{ID: 3}, UserID: 7, Title: "Wedding", Visibility: models.VisibilityPrivate},
+	)
+	gs.members.members = []models.GalleryMember{
+		{GalleryID: 3, UserID: 8, Role: models.RoleContributor},
+		{GalleryID: 3, UserID: 9, Role: models.RoleViewer},
+	}
+	galleriesC := NewGalleries(gs, is, nil)
+	r := mux.NewRouter()
+	r.HandleFunc("/galleries/{id:[0-9]+}/images", galleriesC.Upload)
+
+	upload := func(userID uint, filename string) int {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile("images", filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(fw, "second")
+		mw.Close()
+		req := httptest.NewRequest("POST", "/galleries/3/images", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req = req.WithContext(context.WithUser(req.Context(), &models.User{Model: gorm.Model{ID: userID}}))
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := upload(9, "b.jpg"); code != http.StatusForbidden {
+		t.Errorf("Expected viewers not to upload. Received %d", code)
+	}
+	if code := upload(8, "a.jpg"); code != http.StatusForbidden {
+		t.Errorf("Expected contributors not to replace images. Received %d", code)
+	}
+	if code := upload(8, "b.jpg"); code != http.StatusFound {
+		t.Errorf("Expected contributors to upload. Received %d", code)
+	}
+	images, err := is.ByGalleryID(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 {
+		t.Errorf("Expected 2 images. Received %d", len(images))
+	}
+	if b, _ := os.ReadFile(images[0].RelativePath()); string(b) != "lead" {
+		t.Errorf("Expected a.jpg to be kept. Received %q", b)
+	}
+}
+
+func TestGalleryReorder(t *testing.T) {
+	inTempDir(t)
+	is := models.NewImageService(&fakeImageDB{})
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+		if err := is.Create(3, strings.NewReader(name), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gs := newFakeGalleries(
+		models.Gallery{Model: gorm.Model{ID: 3}, UserID: 7, Title: "Wedding", Visibility: models.VisibilityPublic},
+	)
+	gs.members.members = []models.GalleryMember{
+		{GalleryID: 3, UserID: 8, Role: models.RoleEditor},
+	}
+	galleriesC := NewGalleries(gs, is, nil)
+	r := mux.NewRouter()
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/order", galleriesC.Reorder)
+
+	reorder := func(userID uint, filenames ...string) int {
+		form := url.Values{"filenames": filenames}
+		req := httptest.NewRequest("POST", "/galleries/3/images/order", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithUser(req.Context(), &models.User{Model: gorm.Model{ID: userID}}))
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := reorder(9, "c.jpg", "b.jpg", "a.jpg"); code != http.StatusForbidden {
+		t.Errorf("Expected visitors not to reorder. Received %d", code)
+	}
+	if code := reorder(8, "c.jpg", "a.jpg"); code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected partial orders to be rejected. Received %d", code)
+	}
+	if code := reorder(8, "c.jpg", "b.jpg", "a.jpg"); code != http.StatusFound {
+		t.Fatalf("Expected editors to reorder. Received %d", code)
+	}
+	images, err := is.ByGalleryID(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, image := range images {
+		names = append(names, image.Filename)
+	}
+	if got := strings.Join(names, ","); got != "c.jpg,b.jpg,a.jpg" {
+		t.Errorf("Expected the new order. Received %s", got)
+	}
+}
@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/apigban/lenslocked_v1/views"
+)
+
+const (
+	statusOK   = "ok"
+	statusFail = "fail"
+
+	// readyTimeout bounds how long all readiness checks may take
+	readyTimeout = 2 * time.Second
+)
+
+// NewHealth is used to create a new Health controller
+func NewHealth(services *models.Services) *Health {
+	return &Health{
+		checks: []healthCheck{
+			{"database", services.Ping},
+			{"storage", func(context.Context) error { return services.Image.Writable() }},
+			{"templates", func(context.Context) error { return views.Check() }},
+		},
+	}
+}
+
+type Health struct {
+	checks []healthCheck
+}
+
+type healthCheck struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+type checkResult struct {
+	Status     string  `json:"status"`
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+// Live reports that the process is up and able to serve HTTP.
+// It does not check any dependencies.
+//
+// GET /healthz
+func (h *Health) Live(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthResponse{Status: statusOK})
+}
+
+// Ready runs every dependency check and responds with
+// 503 Service Unavailable if any of them fails
+//
+// GET /readyz
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	resp := healthResponse{
+		Status: statusOK,
+		Checks: make(map[string]checkResult, len(h.checks)),
+	}
+	for _, c := range h.checks {
+		start := time.Now()
+		err := c.fn(ctx)
+		res := checkResult{
+			Status:     statusOK,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if err != nil {
+			res.Status = statusFail
+			res.Error = err.Error()
+			resp.Status = statusFail
+		}
+		resp.Checks[c.name] = res
+	}
+
+	code := http.StatusOK
+	if resp.Status != statusOK {
+		code = http.StatusServiceUnavailable
+	}
+	writeHealth(w, code, resp)
+}
+
+func writeHealth(w http.ResponseWriter, code int, resp healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
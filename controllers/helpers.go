@@ -1,21 +1,71 @@
 package controllers
 
 import (
+	"net"
 	"net/http"
+	"net/url"
 
+	"github.com/apigban/lenslocked_v1/i18n"
 	"github.com/gorilla/schema"
 )
 
 func parseForm(r *http.Request, dst interface{}) error {
 	if err := r.ParseForm(); err != nil {
-		return err
+		return formError{err}
 	}
 
 	dec := schema.NewDecoder()
 
 	if err := dec.Decode(dst, r.PostForm); err != nil {
-		return err
+		return formError{err}
 	}
 
 	return nil
 }
+
+// formError is returned when a submitted form can't be parsed,
+// it is reported with a 400 Bad Request
+type formError struct {
+	err error
+}
+
+func (e formError) Error() string {
+	return "controllers: invalid form: " + e.err.Error()
+}
+
+func (e formError) Public() string {
+	return i18n.T(i18n.DefaultLocale, "error."+e.Code())
+}
+
+func (e formError) Code() string {
+	return "invalid_form"
+}
+
+func (e formError) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+// localRedirect returns the path of target if it points to this
+// site, eg. a Referer header, and "/" otherwise so that we never
+// redirect users to another host
+func localRedirect(target string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.Path == "" || u.Path[0] != '/' || (len(u.Path) > 1 && u.Path[1] == '/') {
+		return "/"
+	}
+	ret := u.Path
+	if u.RawQuery != "" {
+		ret += "?" + u.RawQuery
+	}
+	return ret
+}
+
+// remoteIP returns the IP address the request came from. Headers
+// like X-Forwarded-For are ignored, anyone can send them.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/email"
+	"github.com/apigban/lenslocked_v1/i18n"
+	"github.com/apigban/lenslocked_v1/metrics"
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/apigban/lenslocked_v1/views"
+)
+
+// NewLoginLinks is used to create the controller emailing login
+// links to users. baseURL is what the links in the emails start
+// with, eg. "https://lenslocked.com".
+func NewLoginLinks(ls models.LoginLinkService, users *Users, mailer email.Mailer, baseURL string) *LoginLinks {
+	return &LoginLinks{
+		ConfirmView: views.NewView("bootstrap", "users/login_link"),
+		ls:          ls,
+		users:       users,
+		mailer:      mailer,
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+type LoginLinks struct {
+	ConfirmView *views.View
+	ls          models.LoginLinkService
+	users       *Users
+	mailer      email.Mailer
+	baseURL     string
+}
+
+type LoginLinkForm struct {
+	Email string `schema:"email"`
+	// Next is the page to return to after signing in
+	Next string `schema:"next"`
+}
+
+type LoginLinkConfirmForm struct {
+	Token string `schema:"token"`
+	Next  string `schema:"next"`
+}
+
+// Create emails a login link to the submitted address. The same
+// alert is shown whether or not a user has it, so that the form
+// can't be used to find out who signed up.
+//
+// POST /login/link
+func (l *LoginLinks) Create(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form LoginLinkForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		l.users.LoginView.Render(w, r, l.users.loginData(vd))
+		return
+	}
+	vd.KeepForm(r)
+	link := models.LoginLink{Email: form.Email}
+	if err := l.ls.Create(&link); err != nil {
+		vd.SetAlert(err)
+		l.users.LoginView.Render(w, r, l.users.loginData(vd))
+		return
+	}
+
+	params := url.Values{"token": {link.Token}}
+	if form.Next != "" {
+		params.Set("next", localRedirect(form.Next))
+	}
+	locale := context.Locale(r.Context())
+	msg := email.Message{
+		To:      link.Email,
+		Subject: i18n.T(locale, "login_link.subject"),
+		Text: i18n.T(locale, "login_link.body",
+			l.baseURL+"/login/link?"+params.Encode(),
+			int(models.LoginLinkTTL.Minutes())),
+	}
+	if err := l.mailer.Send(r.Context(), msg); err != nil {
+		vd.SetAlert(err)
+		l.users.LoginView.Render(w, r, l.users.loginData(vd))
+		return
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "login_link.sent",
+	}
+	l.users.LoginView.Render(w, r, l.users.loginData(vd))
+}
+
+// Confirm asks users to sign in with the link they clicked. Links
+// only work once, so they aren't used right away: mail scanners
+// following every link in an email would use them up.
+//
+// GET /login/link
+func (l *LoginLinks) Confirm(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	q := r.URL.Query()
+	vd.Form = url.Values{"token": {q.Get("token")}}
+	if next := q.Get("next"); next != "" {
+		vd.Form.Set("next", localRedirect(next))
+	}
+	l.ConfirmView.Render(w, r, vd)
+}
+
+// SignIn uses up the login link and signs in the user it was
+// sent to, signing them up first if they are new
+//
+// POST /login/link/confirm
+func (l *LoginLinks) SignIn(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form LoginLinkConfirmForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		l.users.LoginView.Render(w, r, l.users.loginData(vd))
+		return
+	}
+	link, err := l.ls.Redeem(form.Token, models.LoginLinkSignIn)
+	if err != nil {
+		metrics.Logins.Inc(metrics.LoginFailure)
+		if err == models.ErrNotFound {
+			vd.AlertError("login_link.invalid")
+			l.users.LoginView.RenderStatus(w, r, http.StatusUnauthorized, l.users.loginData(vd))
+			return
+		}
+		vd.SetAlert(err)
+		l.users.LoginView.Render(w, r, l.users.loginData(vd))
+		return
+	}
+
+	user, err := l.users.us.ByEmail(link.Email)
+	if err == models.ErrNotFound {
+		user, err = l.users.signUpPasswordless("", link.Email)
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		l.users.LoginView.Render(w, r, l.users.loginData(vd))
+		return
+	}
+
+	metrics.Logins.Inc(metrics.LoginSuccess)
+	if err := l.users.signIn(w, r, user, models.LoginMethodLink); err != nil {
+		vd.SetAlert(err)
+		l.users.LoginView.Render(w, r, l.users.loginData(vd))
+		return
+	}
+	next := "/"
+	if form.Next != "" {
+		next = localRedirect(form.Next)
+	}
+	http.Redirect(w, r, next, http.StatusFound)
+}
@@ -0,0 +1,119 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/apigban/lenslocked_v1/email"
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// fakeLoginLinks keeps links in memory by their raw token
+type fakeLoginLinks struct {
+	links map[string]*models.LoginLink
+}
+
+func (fl *fakeLoginLinks) Create(link *models.LoginLink) error {
+	if link.Purpose == "" {
+		link.Purpose = models.LoginLinkSignIn
+	}
+	link.Token = link.Purpose + "-token-for-" + link.Email
+	fl.links[link.Token] = link
+	return nil
+}
+
+func (fl *fakeLoginLinks) Redeem(token, purpose string) (*models.LoginLink, error) {
+	link, ok := fl.links[token]
+	if !ok || link.Purpose != purpose {
+		return nil, models.ErrNotFound
+	}
+	delete(fl.links, token)
+	return link, nil
+}
+
+// outbox keeps the messages sent instead of sending them
+type outbox []email.Message
+
+func (o *outbox) Send(ctx context.Context, msg email.Message) error {
+	*o = append(*o, msg)
+	return nil
+}
+
+var linkRegex = regexp.MustCompile(`http\S+`)
+
+func TestLoginLink(t *testing.T) {
+	user := &models.User{
+		Model:    gorm.Model{ID: 7},
+		Email:    "pam@dundermifflin.com",
+		Remember: "remember",
+	}
+	var sent outbox
+	logins := &fakeLogins{}
+	r := mux.NewRouter()
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	linksC := NewLoginLinks(&fakeLoginLinks{links: map[string]*models.LoginLink{}},
+		NewUsers(&fakeUsers{user: user}, logins), &sent, srv.URL)
+	r.HandleFunc("/login/link", linksC.Create).Methods("POST")
+	r.HandleFunc("/login/link", linksC.Confirm).Methods("GET")
+	r.HandleFunc("/login/link/confirm", linksC.SignIn).Methods("POST")
+
+	resp, err := http.PostForm(srv.URL+"/login/link", url.Values{
+		"email": {user.Email},
+		"next":  {"/galleries"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(sent) != 1 || sent[0].To != user.Email {
+		t.Fatalf("Expected a login link to be emailed to %s. Sent %+v", user.Email, sent)
+	}
+	link, err := url.Parse(linkRegex.FindString(sent[0].Text))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Following the link doesn't use it up
+	resp, err = http.Get(link.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	signIn := func() *http.Response {
+		resp, err := client.PostForm(srv.URL+"/login/link/confirm", link.Query())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	resp = signIn()
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/galleries" {
+		t.Errorf("Expected a redirect to /galleries. Received %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	var signedIn bool
+	for _, c := range resp.Cookies() {
+		signedIn = signedIn || c.Name == "remember_token" && c.Value == user.Remember
+	}
+	if !signedIn {
+		t.Error("Expected the user to be signed in")
+	}
+	if len(logins.logins) != 1 || logins.logins[0].Method != models.LoginMethodLink {
+		t.Errorf("Expected the login to be recorded. Received %+v", logins.logins)
+	}
+
+	if resp := signIn(); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected the link to only work once. Received %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,280 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/email"
+	"github.com/apigban/lenslocked_v1/i18n"
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/apigban/lenslocked_v1/views"
+	"github.com/gorilla/mux"
+)
+
+// NewMembers is used to create the controller letting owners
+// invite other users to their galleries. Invites are emailed with
+// a link starting with baseURL, eg. "https://lenslocked.com".
+func NewMembers(ms models.GalleryMemberService, galleries *Galleries, mailer email.Mailer, baseURL string) *Members {
+	return &Members{
+		IndexView:   views.NewView("bootstrap", "galleries/members"),
+		InvitesView: views.NewView("bootstrap", "users/invites"),
+		ms:          ms,
+		galleries:   galleries,
+		mailer:      mailer,
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+type Members struct {
+	IndexView   *views.View
+	InvitesView *views.View
+	ms          models.GalleryMemberService
+	galleries   *Galleries
+	mailer      email.Mailer
+	baseURL     string
+}
+
+type MemberForm struct {
+	Email string `schema:"email"`
+	Role  string `schema:"role"`
+}
+
+// InviteForm carries the token emailed with an invite
+type InviteForm struct {
+	Token string `schema:"token"`
+}
+
+// membersPage is the Yield of the galleries/members view
+type membersPage struct {
+	Gallery *models.Gallery
+	Members []models.GalleryMember
+	Roles   []string
+}
+
+// invite is a pending invite along with the gallery it is for
+type invite struct {
+	Member  models.GalleryMember
+	Gallery *models.Gallery
+}
+
+// Index lists the members of the gallery and the pending invites
+//
+// GET /galleries/{id}/members
+func (m *Members) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	gallery, err := m.galleries.authorized(r, models.ActionManage)
+	if err != nil {
+		vd.SetAlert(err)
+		m.IndexView.Render(w, r, vd)
+		return
+	}
+	m.render(w, r, vd, gallery)
+}
+
+// Invite adds a pending member to the gallery and emails them a
+// link to their invites, with the token they accept it with once
+// signed in with the invited address
+//
+// POST /galleries/{id}/members
+func (m *Members) Invite(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	gallery, err := m.galleries.authorized(r, models.ActionManage)
+	if err != nil {
+		vd.SetAlert(err)
+		m.IndexView.Render(w, r, vd)
+		return
+	}
+	var form MemberForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		m.render(w, r, vd, gallery)
+		return
+	}
+	vd.KeepForm(r)
+	member := models.GalleryMember{
+		GalleryID: gallery.ID,
+		Email:     form.Email,
+		Role:      form.Role,
+	}
+	if err := m.ms.Create(&member); err != nil {
+		vd.SetAlert(err)
+		m.render(w, r, vd, gallery)
+		return
+	}
+
+	user := context.User(r.Context())
+	locale := context.Locale(r.Context())
+	msg := email.Message{
+		To:      member.Email,
+		Subject: i18n.T(locale, "members.invite_subject", gallery.Title),
+		Text: i18n.T(locale, "members.invite_body",
+			user.Name,
+			gallery.Title,
+			i18n.T(locale, "members.role."+member.Role),
+			m.baseURL+"/invites?token="+url.QueryEscape(member.Token)),
+	}
+	if err := m.mailer.Send(r.Context(), msg); err != nil {
+		// The invite is listed anyway, the user may still find it
+		views.LogError(r, err)
+	}
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "members.invited",
+	}
+	views.RedirectAlert(w, r, fmt.Sprintf("/galleries/%d/members", gallery.ID), http.StatusFound, alert)
+}
+
+// Remove takes a member out of the gallery, or withdraws a
+// pending invite
+//
+// POST /galleries/{id}/members/{member}/delete
+func (m *Members) Remove(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	gallery, err := m.galleries.authorized(r, models.ActionManage)
+	if err != nil {
+		vd.SetAlert(err)
+		m.IndexView.Render(w, r, vd)
+		return
+	}
+	id, err := strconv.ParseUint(mux.Vars(r)["member"], 10, 64)
+	if err == nil {
+		err = m.ms.Delete(uint(id), gallery.ID)
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		m.render(w, r, vd, gallery)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "members.removed",
+	}
+	views.RedirectAlert(w, r, fmt.Sprintf("/galleries/%d/members", gallery.ID), http.StatusFound, alert)
+}
+
+// Invites lists the pending invites sent to the email address of
+// the signed in user. The "token" query parameter is the one of
+// the link emailed with an invite, it is sent along when accepting.
+//
+// GET /invites
+func (m *Members) Invites(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	vd.Form = url.Values{"token": {r.URL.Query().Get("token")}}
+	m.renderInvites(w, r, vd)
+}
+
+// Accept makes the signed in user a member of the gallery they
+// were invited to, given the token emailed with the invite
+//
+// POST /invites/{id}/accept
+func (m *Members) Accept(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form InviteForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		m.renderInvites(w, r, vd)
+		return
+	}
+	vd.KeepForm(r)
+	user := context.User(r.Context())
+	member, err := m.invite(r)
+	if err == nil {
+		err = m.ms.Accept(member, user, form.Token)
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		m.renderInvites(w, r, vd)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "invites.accepted",
+	}
+	views.RedirectAlert(w, r, fmt.Sprintf("/galleries/%d", member.GalleryID), http.StatusFound, alert)
+}
+
+// Decline deletes an invite sent to the signed in user
+//
+// POST /invites/{id}/decline
+func (m *Members) Decline(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	member, err := m.invite(r)
+	if err == nil {
+		err = m.ms.Delete(member.ID, member.GalleryID)
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		m.renderInvites(w, r, vd)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "invites.declined",
+	}
+	views.RedirectAlert(w, r, "/invites", http.StatusFound, alert)
+}
+
+// invite looks up the pending invite from the {id} route
+// variable. Invites sent to anyone but the signed in user are
+// reported as missing.
+func (m *Members) invite(r *http.Request) (*models.GalleryMember, error) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return nil, models.ErrNotFound
+	}
+	member, err := m.ms.ByID(uint(id))
+	if err != nil {
+		return nil, err
+	}
+	user := context.User(r.Context())
+	if !member.Pending() || !strings.EqualFold(member.Email, user.Email) {
+		return nil, models.ErrNotFound
+	}
+	return member, nil
+}
+
+// render displays the members of gallery along with vd
+func (m *Members) render(w http.ResponseWriter, r *http.Request, vd views.Data, gallery *models.Gallery) {
+	members, err := m.ms.ByGalleryID(gallery.ID)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = membersPage{
+		Gallery: gallery,
+		Members: members,
+		Roles:   models.Roles,
+	}
+	m.IndexView.Render(w, r, vd)
+}
+
+// renderInvites displays the pending invites of the signed in
+// user along with vd. Invites to galleries that were deleted
+// since are left out.
+func (m *Members) renderInvites(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	user := context.User(r.Context())
+	members, err := m.ms.PendingByEmail(user.Email)
+	if err != nil {
+		vd.SetAlert(err)
+		m.InvitesView.Render(w, r, vd)
+		return
+	}
+	var invites []invite
+	for _, member := range members {
+		gallery, err := m.galleries.gs.ByID(member.GalleryID)
+		if err == models.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			vd.SetAlert(err)
+			m.InvitesView.Render(w, r, vd)
+			return
+		}
+		invites = append(invites, invite{Member: member, Gallery: gallery})
+	}
+	vd.Yield = invites
+	m.InvitesView.Render(w, r, vd)
+}
@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+func (fm *fakeMembers) Create(member *models.GalleryMember) error {
+	for _, m := range fm.members {
+		if m.GalleryID == member.GalleryID && m.Email == member.Email {
+			return models.ErrMemberTaken
+		}
+	}
+	member.ID = uint(len(fm.members) + 1)
+	member.Token = fmt.Sprintf("token%d", member.ID)
+	fm.members = append(fm.members, *member)
+	return nil
+}
+
+func (fm *fakeMembers) ByID(id uint) (*models.GalleryMember, error) {
+	for i := range fm.members {
+		if fm.members[i].ID == id {
+			return &fm.members[i], nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+func (fm *fakeMembers) PendingByEmail(email string) ([]models.GalleryMember, error) {
+	var ret []models.GalleryMember
+	for _, m := range fm.members {
+		if m.Pending() && m.Email == email {
+			ret = append(ret, m)
+		}
+	}
+	return ret, nil
+}
+
+func (fm *fakeMembers) Accept(member *models.GalleryMember, user *models.User, token string) error {
+	if token != member.Token {
+		return models.ErrInviteTokenInvalid
+	}
+	member.UserID = user.ID
+	return nil
+}
+
+func TestMemberInvite(t *testing.T) {
+	gs := newFakeGalleries(
+		models.Gallery{Model: gorm.Model{ID: 3}, UserID: 7, Title: "Wedding", Visibility: models.VisibilityPrivate},
+	)
+	var sent outbox
+	membersC := NewMembers(gs.members, NewGalleries(gs, nil, nil), &sent, "https://lenslocked.com")
+	r := mux.NewRouter()
+	r.HandleFunc("/galleries/{id:[0-9]+}/members", membersC.Invite).Methods("POST")
+	r.HandleFunc("/invites/{id:[0-9]+}/accept", membersC.Accept).Methods("POST")
+
+	post := func(user *models.User, path string, form url.Values) int {
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithUser(req.Context(), user))
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	owner := &models.User{Model: gorm.Model{ID: 7}, Name: "Lead", Email: "lead@example.com"}
+	second := &models.User{Model: gorm.Model{ID: 8}, Email: "second@example.com"}
+	other := &models.User{Model: gorm.Model{ID: 9}, Email: "other@example.com"}
+	form := url.Values{"email": {second.Email}, "role": {models.RoleContributor}}
+
+	if code := post(second, "/galleries/3/members", form); code != http.StatusNotFound {
+		t.Errorf("Expected only the owner to invite. Received %d", code)
+	}
+	if code := post(owner, "/galleries/3/members", form); code != http.StatusFound {
+		t.Fatalf("Expected the invite to be created. Received %d", code)
+	}
+	if len(sent) != 1 || sent[0].To != second.Email || !strings.Contains(sent[0].Text, "https://lenslocked.com/invites?token=token1") {
+		t.Fatalf("Expected the invite to be emailed to %s. Sent %+v", second.Email, sent)
+	}
+
+	token := url.Values{"token": {"token1"}}
+	if code := post(other, "/invites/1/accept", token); code != http.StatusNotFound {
+		t.Errorf("Expected invites sent to others to be not found. Received %d", code)
+	}
+	if code := post(second, "/invites/1/accept", nil); code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected the token to be required. Received %d", code)
+	}
+	if code := post(second, "/invites/1/accept", url.Values{"token": {"token2"}}); code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected a wrong token to be rejected. Received %d", code)
+	}
+	if code := post(second, "/invites/1/accept", token); code != http.StatusFound {
+		t.Errorf("Expected the invite to be accepted. Received %d", code)
+	}
+	if err := gs.Authorize(second, &gs.galleries[0], models.ActionUpload); err != nil {
+		t.Errorf("Expected the new member to upload. Received %v", err)
+	}
+}
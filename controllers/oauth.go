@@ -0,0 +1,518 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/hash"
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/apigban/lenslocked_v1/views"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// TODO - move to config before prod
+	consentSecretKey = "secret-consent-key"
+
+	pkceMethodS256 = "S256"
+)
+
+// OAuth2 error codes, see RFC 6749 sections 4.1.2.1 and 5.2
+const (
+	oauthErrInvalidRequest          = "invalid_request"
+	oauthErrInvalidClient           = "invalid_client"
+	oauthErrInvalidGrant            = "invalid_grant"
+	oauthErrInvalidScope            = "invalid_scope"
+	oauthErrAccessDenied            = "access_denied"
+	oauthErrUnsupportedResponseType = "unsupported_response_type"
+	oauthErrUnsupportedGrantType    = "unsupported_grant_type"
+	oauthErrServerError             = "server_error"
+)
+
+// NewOAuth is used to create a new OAuth controller, the
+// authorization server third-party apps send users to.
+// This function will panic if the templates are not
+// parsed correctly, and should only be used during
+// initial setup.
+func NewOAuth(os models.OAuthService) *OAuth {
+	return &OAuth{
+		ConsentView: views.NewView("bootstrap", "oauth/consent"),
+		AppsView:    views.NewView("bootstrap", "settings/apps"),
+		os:          os,
+		hmac:        hash.NewHMAC(consentSecretKey),
+	}
+}
+
+type OAuth struct {
+	ConsentView *views.View
+	AppsView    *views.View
+	os          models.OAuthService
+	hmac        hash.HMAC
+}
+
+// authorizeRequest holds the parameters of an authorization
+// request, they are carried over from the consent screen to the
+// form approving it
+type authorizeRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+func newAuthorizeRequest(values url.Values) authorizeRequest {
+	return authorizeRequest{
+		ResponseType:        values.Get("response_type"),
+		ClientID:            values.Get("client_id"),
+		RedirectURI:         values.Get("redirect_uri"),
+		Scope:               values.Get("scope"),
+		State:               values.Get("state"),
+		CodeChallenge:       values.Get("code_challenge"),
+		CodeChallengeMethod: values.Get("code_challenge_method"),
+	}
+}
+
+// consentPage is the Yield of the oauth/consent view
+type consentPage struct {
+	Client  *models.OAuthClient
+	Request authorizeRequest
+	Scopes  []string
+	// Consent ties the approval form to the signed in user
+	// and this request, so other sites can't submit it
+	Consent string
+}
+
+// oauthError is sent back to the client, either in the query of
+// its redirect URI or in the body of a token response
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// Authorize shows the consent screen of an authorization request
+//
+// GET /oauth/authorize
+func (o *OAuth) Authorize(w http.ResponseWriter, r *http.Request) {
+	req := newAuthorizeRequest(r.URL.Query())
+	client, oerr := o.checkAuthorize(w, r, &req)
+	if client == nil {
+		return
+	}
+	if oerr != nil {
+		redirectOAuthError(w, r, req, *oerr)
+		return
+	}
+	var vd views.Data
+	vd.Yield = consentPage{
+		Client:  client,
+		Request: req,
+		Scopes:  strings.Fields(req.Scope),
+		Consent: o.consent(r, req),
+	}
+	o.ConsentView.Render(w, r, vd)
+}
+
+// Approve handles the answer of the user on the consent screen
+// and sends them back to the client with an authorization code
+//
+// POST /oauth/authorize
+func (o *OAuth) Approve(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	req := newAuthorizeRequest(r.PostForm)
+	client, oerr := o.checkAuthorize(w, r, &req)
+	if client == nil {
+		return
+	}
+	if oerr != nil {
+		redirectOAuthError(w, r, req, *oerr)
+		return
+	}
+	if !hmac.Equal([]byte(r.PostForm.Get("consent")), []byte(o.consent(r, req))) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if r.PostForm.Get("approve") != "true" {
+		redirectOAuthError(w, r, req, oauthError{Code: oauthErrAccessDenied})
+		return
+	}
+
+	user := context.User(r.Context())
+	code := models.OAuthCode{
+		ClientID:      client.ID,
+		UserID:        user.ID,
+		RedirectURI:   req.RedirectURI,
+		Scopes:        req.Scope,
+		CodeChallenge: req.CodeChallenge,
+	}
+	if err := o.os.CreateCode(&code); err != nil {
+		views.LogError(r, err)
+		redirectOAuthError(w, r, req, oauthError{Code: oauthErrServerError})
+		return
+	}
+	http.Redirect(w, r, oauthRedirect(req, url.Values{"code": {code.Code}}), http.StatusFound)
+}
+
+// checkAuthorize validates an authorization request. Problems
+// with the client or its redirect URI are rendered to the user,
+// in which case the returned client is nil, as we can't trust
+// the redirect URI. The others must be sent to the client with
+// redirectOAuthError.
+func (o *OAuth) checkAuthorize(w http.ResponseWriter, r *http.Request, req *authorizeRequest) (*models.OAuthClient, *oauthError) {
+	client, err := o.os.ClientByClientID(req.ClientID)
+	if err != nil {
+		if err != models.ErrNotFound {
+			views.LogError(r, err)
+		}
+		o.renderAuthorizeError(w, r, "oauth.unknown_client")
+		return nil, nil
+	}
+	// The redirect URI may only be omitted if there is no doubt
+	// about which one to use
+	if req.RedirectURI == "" && len(client.RedirectURIList()) == 1 {
+		req.RedirectURI = client.RedirectURIList()[0]
+	}
+	if !client.HasRedirectURI(req.RedirectURI) {
+		o.renderAuthorizeError(w, r, "oauth.invalid_redirect_uri")
+		return nil, nil
+	}
+
+	if req.ResponseType != "code" {
+		return client, &oauthError{Code: oauthErrUnsupportedResponseType}
+	}
+	// PKCE is required from every client, with S256 only as
+	// the plain method doesn't protect anything
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != pkceMethodS256 {
+		return client, &oauthError{
+			Code:        oauthErrInvalidRequest,
+			Description: "code_challenge with code_challenge_method=S256 is required",
+		}
+	}
+	scopes := strings.Fields(req.Scope)
+	for _, s := range scopes {
+		if !models.IsScope(s) {
+			return client, &oauthError{Code: oauthErrInvalidScope, Description: "unknown scope " + s}
+		}
+	}
+	if len(scopes) == 0 {
+		return client, &oauthError{Code: oauthErrInvalidScope, Description: "scope is required"}
+	}
+	req.Scope = strings.Join(scopes, " ")
+	return client, nil
+}
+
+func (o *OAuth) renderAuthorizeError(w http.ResponseWriter, r *http.Request, msg string) {
+	var vd views.Data
+	vd.AlertError(msg)
+	o.ConsentView.RenderStatus(w, r, http.StatusBadRequest, vd)
+}
+
+// consent returns the value of the consent field for req
+func (o *OAuth) consent(r *http.Request, req authorizeRequest) string {
+	user := context.User(r.Context())
+	return o.hmac.Hash(strings.Join([]string{
+		strconv.FormatUint(uint64(user.ID), 10),
+		user.RememberHash,
+		req.ClientID,
+		req.RedirectURI,
+		req.Scope,
+		req.State,
+		req.CodeChallenge,
+	}, "\n"))
+}
+
+// oauthRedirect returns the redirect URI of req with params and
+// the state of the client added to its query
+func oauthRedirect(req authorizeRequest, params url.Values) string {
+	u, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		// Registered redirect URIs are validated
+		return req.RedirectURI
+	}
+	q := u.Query()
+	for key, values := range params {
+		q[key] = values
+	}
+	if req.State != "" {
+		q.Set("state", req.State)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func redirectOAuthError(w http.ResponseWriter, r *http.Request, req authorizeRequest, oerr oauthError) {
+	params := url.Values{"error": {oerr.Code}}
+	if oerr.Description != "" {
+		params.Set("error_description", oerr.Description)
+	}
+	http.Redirect(w, r, oauthRedirect(req, params), http.StatusFound)
+}
+
+// tokenResponse is the body of a successful token request,
+// see RFC 6749 section 5.1
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// Token exchanges an authorization code or a refresh token for
+// a new access token. Clients authenticate with HTTP Basic auth
+// or the client_id and client_secret parameters.
+//
+// POST /oauth/token
+func (o *OAuth) Token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, oauthError{Code: oauthErrInvalidRequest})
+		return
+	}
+	client, ok := o.tokenClient(w, r)
+	if !ok {
+		return
+	}
+
+	var token *models.OAuthToken
+	var err error
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		token, err = o.exchangeCode(client, r.PostForm)
+	case "refresh_token":
+		token, err = o.os.RefreshToken(client.ID, r.PostForm.Get("refresh_token"))
+	default:
+		writeOAuthError(w, http.StatusBadRequest, oauthError{Code: oauthErrUnsupportedGrantType})
+		return
+	}
+	switch {
+	case err == models.ErrNotFound:
+		writeOAuthError(w, http.StatusBadRequest, oauthError{Code: oauthErrInvalidGrant})
+		return
+	case err != nil:
+		if oerr, ok := err.(oauthError); ok {
+			writeOAuthError(w, http.StatusBadRequest, oerr)
+			return
+		}
+		views.LogError(r, err)
+		writeOAuthError(w, http.StatusInternalServerError, oauthError{Code: oauthErrServerError})
+		return
+	}
+	writeOAuthJSON(w, http.StatusOK, tokenResponse{
+		AccessToken:  token.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(models.OAuthAccessTTL.Seconds()),
+		RefreshToken: token.RefreshToken,
+		Scope:        token.Scopes,
+	})
+}
+
+// tokenClient authenticates the client of a token request. It
+// responds with invalid_client and returns false if it can't.
+func (o *OAuth) tokenClient(w http.ResponseWriter, r *http.Request) (*models.OAuthClient, bool) {
+	clientID, secret, basic := r.BasicAuth()
+	if !basic {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	client, err := o.os.AuthenticateClient(clientID, secret)
+	if err != nil {
+		if err != models.ErrNotFound && err != models.ErrPasswordIncorrect {
+			views.LogError(r, err)
+		}
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		writeOAuthError(w, http.StatusUnauthorized, oauthError{Code: oauthErrInvalidClient})
+		return nil, false
+	}
+	return client, true
+}
+
+// exchangeCode redeems the authorization code in form, checking
+// that it was issued to client for the same redirect URI and that
+// the PKCE code verifier matches its challenge
+func (o *OAuth) exchangeCode(client *models.OAuthClient, form url.Values) (*models.OAuthToken, error) {
+	code, err := o.os.RedeemCode(form.Get("code"))
+	if err != nil {
+		return nil, err
+	}
+	if code.ClientID != client.ID || code.RedirectURI != form.Get("redirect_uri") {
+		return nil, models.ErrNotFound
+	}
+	if !pkceVerify(form.Get("code_verifier"), code.CodeChallenge) {
+		return nil, oauthError{Code: oauthErrInvalidGrant, Description: "code_verifier doesn't match code_challenge"}
+	}
+	token := models.OAuthToken{
+		ClientID: client.ID,
+		UserID:   code.UserID,
+		Scopes:   code.Scopes,
+	}
+	if err := o.os.CreateToken(&token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// pkceVerify checks an S256 code verifier against its challenge,
+// see RFC 7636 section 4.6
+func pkceVerify(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+func (e oauthError) Error() string {
+	return fmt.Sprintf("controllers: oauth: %s: %s", e.Code, e.Description)
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, oerr oauthError) {
+	writeOAuthJSON(w, status, oerr)
+}
+
+// writeOAuthJSON responds with v, token responses must never
+// be cached
+func writeOAuthJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+type OAuthClientForm struct {
+	Name         string `schema:"name"`
+	RedirectURIs string `schema:"redirect_uris"`
+	Confidential bool   `schema:"confidential"`
+}
+
+// appsPage is the Yield of the settings/apps view
+type appsPage struct {
+	Clients []models.OAuthClient
+	// Authorized are the clients the user granted access to
+	Authorized []models.OAuthClient
+	// Created is the client that was just registered, the only
+	// time its secret can be displayed
+	Created *models.OAuthClient
+}
+
+// Apps lists the OAuth clients registered by the signed in user,
+// and the ones they authorized
+//
+// GET /settings/apps
+func (o *OAuth) Apps(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	o.renderApps(w, r, vd, nil)
+}
+
+// CreateApp registers a new OAuth client
+//
+// POST /settings/apps
+func (o *OAuth) CreateApp(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form OAuthClientForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		o.renderApps(w, r, vd, nil)
+		return
+	}
+	vd.KeepForm(r)
+	user := context.User(r.Context())
+	client := models.OAuthClient{
+		UserID:       user.ID,
+		Name:         form.Name,
+		RedirectURIs: form.RedirectURIs,
+		Confidential: form.Confidential,
+	}
+	if err := o.os.CreateClient(&client); err != nil {
+		vd.SetAlert(err)
+		o.renderApps(w, r, vd, nil)
+		return
+	}
+	vd.Form = nil
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "apps.created",
+	}
+	o.renderApps(w, r, vd, &client)
+}
+
+// DeleteApp removes one of the OAuth clients of the signed in
+// user, along with every token issued to it
+//
+// POST /settings/apps/{id}/delete
+func (o *OAuth) DeleteApp(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err == nil {
+		err = o.os.DeleteClient(uint(id), user.ID)
+	}
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		o.renderApps(w, r, vd, nil)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "apps.deleted",
+	}
+	views.RedirectAlert(w, r, "/settings/apps", http.StatusFound, alert)
+}
+
+// RevokeApp revokes the access the signed in user granted to an
+// OAuth client, whoever registered it
+//
+// POST /settings/apps/authorized/{id}/revoke
+func (o *OAuth) RevokeApp(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err == nil {
+		err = o.os.RevokeClient(uint(id), user.ID)
+	}
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		o.renderApps(w, r, vd, nil)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "apps.revoked",
+	}
+	views.RedirectAlert(w, r, "/settings/apps", http.StatusFound, alert)
+}
+
+func (o *OAuth) renderApps(w http.ResponseWriter, r *http.Request, vd views.Data, created *models.OAuthClient) {
+	user := context.User(r.Context())
+	clients, err := o.os.ClientsByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	authorized, err := o.os.AuthorizedClients(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = appsPage{
+		Clients:    clients,
+		Authorized: authorized,
+		Created:    created,
+	}
+	o.AppsView.Render(w, r, vd)
+}
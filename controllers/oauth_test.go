@@ -0,0 +1,477 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/api"
+	"github.com/apigban/lenslocked_v1/middleware"
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/apigban/lenslocked_v1/rand"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// fakeUsers resolves every remember token to the same user
+type fakeUsers struct {
+	models.UserService
+	user *models.User
+}
+
+func (fu *fakeUsers) ByRemember(token string) (*models.User, error) {
+	if token != fu.user.Remember {
+		return nil, models.ErrNotFound
+	}
+	return fu.user, nil
+}
+
+func (fu *fakeUsers) ByID(id uint) (*models.User, error) {
+	if id != fu.user.ID {
+		return nil, models.ErrNotFound
+	}
+	return fu.user, nil
+}
+
+// fakeLogins keeps the login history in memory
+type fakeLogins struct {
+	logins []models.Login
+}
+
+func (fl *fakeLogins) ByUserID(userID uint) ([]models.Login, error) {
+	var ret []models.Login
+	for _, login := range fl.logins {
+		if login.UserID == userID {
+			ret = append(ret, login)
+		}
+	}
+	return ret, nil
+}
+
+func (fl *fakeLogins) Create(login *models.Login) error {
+	fl.logins = append(fl.logins, *login)
+	return nil
+}
+
+// fakeOAuth keeps clients, codes and tokens in memory, by their
+// raw values rather than hashes
+type fakeOAuth struct {
+	mu      sync.Mutex
+	clients []*models.OAuthClient
+	codes   map[string]*models.OAuthCode
+	tokens  []*models.OAuthToken
+}
+
+func (fo *fakeOAuth) AuthenticateClient(clientID, secret string) (*models.OAuthClient, error) {
+	client, err := fo.ClientByClientID(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if client.Confidential && secret != client.Secret {
+		return nil, models.ErrPasswordIncorrect
+	}
+	return client, nil
+}
+
+func (fo *fakeOAuth) RefreshToken(clientID uint, refresh string) (*models.OAuthToken, error) {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+	for _, t := range fo.tokens {
+		if t.RefreshToken == refresh && t.ClientID == clientID && time.Now().Before(t.RefreshExpiresAt) {
+			fo.newTokens(t)
+			return t, nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+func (fo *fakeOAuth) ClientByClientID(clientID string) (*models.OAuthClient, error) {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+	for _, c := range fo.clients {
+		if c.ClientID == clientID {
+			return c, nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+func (fo *fakeOAuth) ClientsByUserID(userID uint) ([]models.OAuthClient, error) {
+	return nil, nil
+}
+
+func (fo *fakeOAuth) CreateClient(client *models.OAuthClient) error {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+	client.ID = uint(len(fo.clients) + 1)
+	client.ClientID, _ = rand.String(16)
+	if client.Confidential {
+		client.Secret, _ = rand.String(32)
+	}
+	fo.clients = append(fo.clients, client)
+	return nil
+}
+
+func (fo *fakeOAuth) DeleteClient(id, userID uint) error {
+	return models.ErrNotFound
+}
+
+func (fo *fakeOAuth) AuthorizedClients(userID uint) ([]models.OAuthClient, error) {
+	return nil, nil
+}
+
+func (fo *fakeOAuth) RevokeClient(id, userID uint) error {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+	var kept []*models.OAuthToken
+	for _, t := range fo.tokens {
+		if t.ClientID != id || t.UserID != userID {
+			kept = append(kept, t)
+		}
+	}
+	if len(kept) == len(fo.tokens) {
+		return models.ErrNotFound
+	}
+	fo.tokens = kept
+	return nil
+}
+
+func (fo *fakeOAuth) CreateCode(code *models.OAuthCode) error {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+	code.Code, _ = rand.String(32)
+	code.ExpiresAt = time.Now().Add(models.OAuthCodeTTL)
+	fo.codes[code.Code] = code
+	return nil
+}
+
+func (fo *fakeOAuth) RedeemCode(code string) (*models.OAuthCode, error) {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+	ret, ok := fo.codes[code]
+	if !ok {
+		return nil, models.ErrNotFound
+	}
+	delete(fo.codes, code)
+	return ret, nil
+}
+
+func (fo *fakeOAuth) CreateToken(token *models.OAuthToken) error {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+	fo.newTokens(token)
+	fo.tokens = append(fo.tokens, token)
+	return nil
+}
+
+func (fo *fakeOAuth) newTokens(token *models.OAuthToken) {
+	access, _ := rand.String(32)
+	refresh, _ := rand.String(32)
+	token.AccessToken = models.OAuthAccessPrefix + access
+	token.AccessExpiresAt = time.Now().Add(models.OAuthAccessTTL)
+	token.RefreshToken = models.OAuthRefreshPrefix + refresh
+	token.RefreshExpiresAt = time.Now().Add(models.OAuthRefreshTTL)
+}
+
+func (fo *fakeOAuth) ByAccessToken(access string) (*models.OAuthToken, error) {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+	for _, t := range fo.tokens {
+		if t.AccessToken == access {
+			return t, nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+func (fo *fakeOAuth) ByRefreshToken(refresh string) (*models.OAuthToken, error) {
+	panic("not used by the controller")
+}
+
+func (fo *fakeOAuth) RotateToken(token *models.OAuthToken, refreshHash string) error {
+	panic("not used by the controller")
+}
+
+// oauthTestServer serves the OAuth and API routes the way main
+// does, for the returned signed in user
+func oauthTestServer(t *testing.T) (*httptest.Server, *fakeOAuth, *models.User) {
+	user := &models.User{Model: gorm.Model{ID: 7}, Name: "Pam Beesly", Remember: "remember"}
+	fo := &fakeOAuth{codes: make(map[string]*models.OAuthCode)}
+	userMw := middleware.User{UserService: &fakeUsers{user: user}, OAuth: fo}
+	requireUserMw := middleware.RequireUser{User: userMw}
+	oauthC := NewOAuth(fo)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/oauth/authorize", requireUserMw.ApplyFn(oauthC.Authorize)).Methods("GET")
+	r.HandleFunc("/oauth/authorize", requireUserMw.ApplyFn(oauthC.Approve)).Methods("POST")
+	r.HandleFunc("/oauth/token", oauthC.Token).Methods("POST")
+	r.HandleFunc("/settings/apps/authorized/{id:[0-9]+}/revoke", requireUserMw.ApplyFn(oauthC.RevokeApp)).Methods("POST")
+	api.NewRouter(r, &models.Services{})
+
+	srv := httptest.NewServer(userMw.Apply(r))
+	t.Cleanup(srv.Close)
+	return srv, fo, user
+}
+
+// browser doesn't follow redirects so that the tests can read
+// the code the client would receive
+var browser = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+var consentRe = regexp.MustCompile(`name="consent" value="([^"]+)"`)
+
+// authorize walks the user through the consent screen and returns
+// the authorization code handed to the client
+func authorize(t *testing.T, srv *httptest.Server, user *models.User, params url.Values) string {
+	t.Helper()
+	req, _ := http.NewRequest("GET", srv.URL+"/oauth/authorize?"+params.Encode(), nil)
+	req.AddCookie(&http.Cookie{Name: "remember_token", Value: user.Remember})
+	resp, err := browser.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /oauth/authorize: expected 200. Received %d", resp.StatusCode)
+	}
+	m := consentRe.FindStringSubmatch(body)
+	if m == nil {
+		t.Fatal("consent field missing from the consent screen")
+	}
+
+	form := url.Values{}
+	for key := range params {
+		form.Set(key, params.Get(key))
+	}
+	form.Set("consent", m[1])
+	form.Set("approve", "true")
+	req, _ = http.NewRequest("POST", srv.URL+"/oauth/authorize", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "remember_token", Value: user.Remember})
+	resp, err = browser.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("POST /oauth/authorize: expected 302. Received %d", resp.StatusCode)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := location.Query().Get("state"); got != params.Get("state") {
+		t.Errorf("Expected state %q. Received %q", params.Get("state"), got)
+	}
+	return location.Query().Get("code")
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func requestToken(t *testing.T, srv *httptest.Server, form url.Values) (int, map[string]interface{}) {
+	t.Helper()
+	resp, err := http.PostForm(srv.URL+"/oauth/token", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func getMe(t *testing.T, srv *httptest.Server, accessToken string) int {
+	t.Helper()
+	req, _ := http.NewRequest("GET", srv.URL+api.Prefix+"/users/me", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestOAuthFlow(t *testing.T) {
+	srv, fo, user := oauthTestServer(t)
+	client := &models.OAuthClient{
+		UserID:       1,
+		Name:         "Photo printer",
+		RedirectURIs: "https://printer.example.com/callback",
+	}
+	fo.CreateClient(client)
+
+	verifier, _ := rand.String(32)
+	sum := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ClientID},
+		"redirect_uri":          {"https://printer.example.com/callback"},
+		"scope":                 {models.ScopeProfileRead},
+		"state":                 {"xyz"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+	code := authorize(t, srv, user, params)
+
+	exchange := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {"https://printer.example.com/callback"},
+		"client_id":     {client.ClientID},
+		"code_verifier": {verifier},
+	}
+	status, body := requestToken(t, srv, exchange)
+	if status != http.StatusOK {
+		t.Fatalf("Expected 200 from the token endpoint. Received %d %v", status, body)
+	}
+	access, _ := body["access_token"].(string)
+	refresh, _ := body["refresh_token"].(string)
+	if body["scope"] != models.ScopeProfileRead {
+		t.Errorf("Expected scope %q. Received %v", models.ScopeProfileRead, body["scope"])
+	}
+	if got := getMe(t, srv, access); got != http.StatusOK {
+		t.Errorf("Expected the access token to authenticate the user. Received %d", got)
+	}
+
+	// Codes can only be exchanged once
+	if status, body := requestToken(t, srv, exchange); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("Expected invalid_grant reusing the code. Received %d %v", status, body)
+	}
+
+	status, body = requestToken(t, srv, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refresh},
+		"client_id":     {client.ClientID},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("Expected 200 refreshing the token. Received %d %v", status, body)
+	}
+	if got := getMe(t, srv, access); got != http.StatusUnauthorized {
+		t.Errorf("Expected the old access token to be revoked. Received %d", got)
+	}
+	access, _ = body["access_token"].(string)
+	refresh, _ = body["refresh_token"].(string)
+	if got := getMe(t, srv, access); got != http.StatusOK {
+		t.Errorf("Expected the new access token to authenticate the user. Received %d", got)
+	}
+
+	// The user revokes the app from their settings
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%s/settings/apps/authorized/%d/revoke", srv.URL, client.ID), nil)
+	req.AddCookie(&http.Cookie{Name: "remember_token", Value: user.Remember})
+	resp, err := browser.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected a redirect revoking the app. Received %d", resp.StatusCode)
+	}
+	if got := getMe(t, srv, access); got != http.StatusUnauthorized {
+		t.Errorf("Expected the access token of a revoked app to be rejected. Received %d", got)
+	}
+	status, body = requestToken(t, srv, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refresh},
+		"client_id":     {client.ClientID},
+	})
+	if status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("Expected invalid_grant refreshing a revoked app. Received %d %v", status, body)
+	}
+}
+
+func TestOAuthPKCEMismatch(t *testing.T) {
+	srv, fo, user := oauthTestServer(t)
+	client := &models.OAuthClient{
+		UserID:       1,
+		Name:         "Photo printer",
+		RedirectURIs: "https://printer.example.com/callback",
+	}
+	fo.CreateClient(client)
+
+	verifier, _ := rand.String(32)
+	sum := sha256.Sum256([]byte(verifier))
+	code := authorize(t, srv, user, url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ClientID},
+		"scope":                 {models.ScopeGalleriesRead},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	})
+
+	other, _ := rand.String(32)
+	status, body := requestToken(t, srv, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {"https://printer.example.com/callback"},
+		"client_id":     {client.ClientID},
+		"code_verifier": {other},
+	})
+	if status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("Expected invalid_grant. Received %d %v", status, body)
+	}
+}
+
+func TestOAuthScope(t *testing.T) {
+	srv, fo, _ := oauthTestServer(t)
+	token := &models.OAuthToken{ClientID: 1, UserID: 7, Scopes: models.ScopeGalleriesRead}
+	fo.CreateToken(token)
+
+	if got := getMe(t, srv, token.AccessToken); got != http.StatusForbidden {
+		t.Errorf("Expected 403 without the %s scope. Received %d", models.ScopeProfileRead, got)
+	}
+}
+
+// Requests with a redirect URI the client didn't register must
+// never be redirected, they could leak the code to an attacker
+func TestOAuthRedirectURINotRegistered(t *testing.T) {
+	srv, fo, user := oauthTestServer(t)
+	client := &models.OAuthClient{
+		UserID:       1,
+		Name:         "Photo printer",
+		RedirectURIs: "https://printer.example.com/callback",
+	}
+	fo.CreateClient(client)
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ClientID},
+		"redirect_uri":          {"https://printer.example.com/callback/../evil"},
+		"scope":                 {models.ScopeProfileRead},
+		"code_challenge":        {"challenge"},
+		"code_challenge_method": {"S256"},
+	}
+	req, _ := http.NewRequest("GET", srv.URL+"/oauth/authorize?"+params.Encode(), nil)
+	req.AddCookie(&http.Cookie{Name: "remember_token", Value: user.Remember})
+	resp, err := browser.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400. Received %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
@@ -0,0 +1,234 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/hash"
+	"github.com/apigban/lenslocked_v1/metrics"
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/apigban/lenslocked_v1/oidc"
+	"github.com/apigban/lenslocked_v1/rand"
+	"github.com/apigban/lenslocked_v1/views"
+)
+
+const (
+	oidcStateCookie = "oidc_state"
+
+	// TODO - move to config before prod
+	oidcSecretKey = "secret-oidc-key"
+
+	// oidcStateMaxAge is how long users have to sign in at the
+	// provider before coming back
+	oidcStateMaxAge = 10 * time.Minute
+
+	oidcStateBytes = 32
+)
+
+// NewOIDC is used to create the controller signing users in with
+// an OpenID Connect provider. It is offered on the login page of
+// users as "Sign in with <name>". prefix is the path Login
+// and Callback are routed under, eg. "/auth/oidc".
+func NewOIDC(name, prefix string, provider *oidc.Provider, users *Users, is models.IdentityService) *OIDC {
+	users.AddProvider(name, prefix+"/login")
+	return &OIDC{
+		provider: provider,
+		users:    users,
+		is:       is,
+		path:     prefix,
+		hmac:     hash.NewHMAC(oidcSecretKey),
+	}
+}
+
+type OIDC struct {
+	provider *oidc.Provider
+	users    *Users
+	is       models.IdentityService
+	path     string
+	hmac     hash.HMAC
+}
+
+// oidcState is kept in a signed cookie while the user signs in
+// at the provider
+type oidcState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Next     string `json:"next,omitempty"`
+}
+
+// Login sends the user to the provider to sign in
+//
+// GET /auth/oidc/login
+func (o *OIDC) Login(w http.ResponseWriter, r *http.Request) {
+	var st oidcState
+	for _, v := range []*string{&st.State, &st.Nonce, &st.Verifier} {
+		s, err := rand.String(oidcStateBytes)
+		if err != nil {
+			o.fail(w, r, err)
+			return
+		}
+		*v = s
+	}
+	if next := r.URL.Query().Get("next"); next != "" {
+		st.Next = localRedirect(next)
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		o.fail(w, r, err)
+		return
+	}
+	payload := base64.URLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    payload + "." + o.hmac.Hash(payload),
+		Path:     o.path,
+		MaxAge:   int(oidcStateMaxAge.Seconds()),
+		HttpOnly: true,
+		// Lax, so that the cookie comes along when the provider
+		// redirects the user back to us
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, o.provider.AuthCodeURL(st.State, st.Nonce, oidc.Challenge(st.Verifier)), http.StatusFound)
+}
+
+// Callback verifies the ID token the provider issued for the user
+// and signs them in, linking the provider account to the user with
+// the same, verified, email address the first time
+//
+// GET /auth/oidc/callback
+func (o *OIDC) Callback(w http.ResponseWriter, r *http.Request) {
+	st, ok := o.state(r)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    "",
+		Path:     o.path,
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	q := r.URL.Query()
+	if !ok || !hmac.Equal([]byte(q.Get("state")), []byte(st.State)) {
+		o.fail(w, r, nil)
+		return
+	}
+	if q.Get("error") != "" {
+		// The user cancelled, or the provider refused
+		o.fail(w, r, nil)
+		return
+	}
+
+	raw, err := o.provider.Exchange(r.Context(), q.Get("code"), st.Verifier)
+	if err != nil {
+		o.fail(w, r, err)
+		return
+	}
+	claims, err := o.provider.Verify(r.Context(), raw, st.Nonce)
+	if err != nil {
+		o.fail(w, r, err)
+		return
+	}
+	user, err := o.user(claims)
+	if err != nil {
+		o.fail(w, r, err)
+		return
+	}
+
+	metrics.Logins.Inc(metrics.LoginSuccess)
+	if err := o.users.signIn(w, r, user, models.LoginMethodProvider); err != nil {
+		o.fail(w, r, err)
+		return
+	}
+	next := "/"
+	if st.Next != "" {
+		next = localRedirect(st.Next)
+	}
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// user returns the user claims are about. Provider accounts are
+// linked to users by email address, only if the provider verified
+// it, otherwise anyone could sign in as anyone. Users that don't
+// exist yet are created, without a password.
+func (o *OIDC) user(claims *oidc.Claims) (*models.User, error) {
+	identity, err := o.is.ByIssuerSubject(o.provider.Issuer(), claims.Subject)
+	switch err {
+	case nil:
+		return o.users.us.ByID(identity.UserID)
+	case models.ErrNotFound:
+	default:
+		return nil, err
+	}
+
+	if !claims.EmailVerified || claims.Email == "" {
+		return nil, errEmailUnverified
+	}
+	user, err := o.users.us.ByEmail(claims.Email)
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		user, err = o.users.signUpPasswordless(claims.Name, claims.Email)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	identity = &models.Identity{
+		UserID:  user.ID,
+		Issuer:  o.provider.Issuer(),
+		Subject: claims.Subject,
+		Email:   claims.Email,
+	}
+	if err := o.is.Create(identity); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// state returns the state stored by Login, ok is false if there
+// is none or its signature doesn't match
+func (o *OIDC) state(r *http.Request) (st oidcState, ok bool) {
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		return st, false
+	}
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(o.hmac.Hash(parts[0])), []byte(parts[1])) {
+		return st, false
+	}
+	b, err := base64.URLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return st, false
+	}
+	if err := json.Unmarshal(b, &st); err != nil || st.State == "" {
+		return st, false
+	}
+	return st, true
+}
+
+// fail renders the login page with an alert. err is logged, it
+// may be nil when there is nothing worth logging.
+func (o *OIDC) fail(w http.ResponseWriter, r *http.Request, err error) {
+	metrics.Logins.Inc(metrics.LoginFailure)
+	var vd views.Data
+	switch err {
+	case nil:
+		vd.AlertError("login.provider_failed")
+	case errEmailUnverified:
+		vd.AlertError("login.email_unverified")
+	default:
+		views.LogError(r, err)
+		vd.AlertError("login.provider_failed")
+	}
+	o.users.LoginView.RenderStatus(w, r, http.StatusUnauthorized, o.users.loginData(vd))
+}
+
+// errEmailUnverified is returned when the provider didn't verify
+// the email address of the user, which we link accounts by
+var errEmailUnverified = errors.New("controllers: provider didn't verify the email address")
@@ -0,0 +1,127 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/apigban/lenslocked_v1/oidc"
+	"github.com/apigban/lenslocked_v1/oidc/oidctest"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+func (fu *fakeUsers) ByEmail(email string) (*models.User, error) {
+	if email != fu.user.Email {
+		return nil, models.ErrNotFound
+	}
+	return fu.user, nil
+}
+
+type fakeIdentities struct {
+	identities []models.Identity
+}
+
+func (fi *fakeIdentities) ByIssuerSubject(issuer, subject string) (*models.Identity, error) {
+	for i := range fi.identities {
+		if fi.identities[i].Issuer == issuer && fi.identities[i].Subject == subject {
+			return &fi.identities[i], nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+func (fi *fakeIdentities) Create(identity *models.Identity) error {
+	fi.identities = append(fi.identities, *identity)
+	return nil
+}
+
+// signInWithOIDC goes through the whole flow with the fake issuer
+// signing in as issuerUser, and returns the remember_token cookie
+// set for the existing user, if any
+func signInWithOIDC(t *testing.T, issuerUser oidctest.User) (string, *fakeIdentities) {
+	iss := oidctest.NewIssuer()
+	t.Cleanup(iss.Close)
+	iss.User = issuerUser
+
+	user := &models.User{
+		Model:    gorm.Model{ID: 7},
+		Name:     "Pam Beesly",
+		Email:    "pam@dundermifflin.com",
+		Remember: "remember",
+	}
+	fi := &fakeIdentities{}
+	r := mux.NewRouter()
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	provider, err := oidc.Discover(context.Background(), oidc.Config{
+		Issuer:       iss.URL,
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  srv.URL + "/auth/oidc/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	usersC := NewUsers(&fakeUsers{user: user}, &fakeLogins{})
+	oidcC := NewOIDC("Test", "/auth/oidc", provider, usersC, fi)
+	r.HandleFunc("/auth/oidc/login", oidcC.Login)
+	r.HandleFunc("/auth/oidc/callback", oidcC.Callback)
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: jar,
+		// Stop once back on our site after the callback
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if via[len(via)-1].URL.Path == "/auth/oidc/callback" {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	resp, err := client.Get(srv.URL + "/auth/oidc/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	u, _ := url.Parse(srv.URL)
+	for _, c := range jar.Cookies(u) {
+		if c.Name == "remember_token" {
+			return c.Value, fi
+		}
+	}
+	return "", fi
+}
+
+func TestOIDCLinksVerifiedEmail(t *testing.T) {
+	remember, fi := signInWithOIDC(t, oidctest.User{
+		Subject:       "42",
+		Email:         "pam@dundermifflin.com",
+		EmailVerified: true,
+	})
+	if remember != "remember" {
+		t.Errorf("Expected the user to be signed in. Received remember_token %q", remember)
+	}
+	if len(fi.identities) != 1 || fi.identities[0].UserID != 7 || fi.identities[0].Subject != "42" {
+		t.Errorf("Expected the identity to be linked to the user. Received %+v", fi.identities)
+	}
+}
+
+func TestOIDCRejectsUnverifiedEmail(t *testing.T) {
+	remember, fi := signInWithOIDC(t, oidctest.User{
+		Subject: "42",
+		Email:   "pam@dundermifflin.com",
+	})
+	if remember != "" {
+		t.Error("Expected the user not to be signed in with an unverified email address")
+	}
+	if len(fi.identities) != 0 {
+		t.Errorf("Expected no identity to be linked. Received %+v", fi.identities)
+	}
+}
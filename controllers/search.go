@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/apigban/lenslocked_v1/views"
+)
+
+// NewSearch is used to create the controller searching the
+// galleries and images visitors may see
+func NewSearch(ss models.SearchService) *Search {
+	return &Search{
+		IndexView: views.NewView("bootstrap", "search/index"),
+		ss:        ss,
+	}
+}
+
+type Search struct {
+	IndexView *views.View
+	ss        models.SearchService
+}
+
+// searchPage is the Yield of the search/index view
+type searchPage struct {
+	Query string
+	Hits  []searchHit
+	Total int
+	Page  int
+	Pages int
+	// PrevPath and NextPath link to the neighbouring pages, they
+	// are empty on the first and last page
+	PrevPath string
+	NextPath string
+}
+
+// searchHit is a gallery, or one of its images, found by a search
+type searchHit struct {
+	Title       string
+	Description string
+	// Path is the page of the gallery
+	Path string
+	// ImagePath is the image that matched, or the cover of the
+	// gallery. It is empty for galleries without a cover.
+	ImagePath string
+	Caption   string
+	AltText   string
+	// IsImage is set when an image matched rather than the gallery
+	IsImage bool
+}
+
+// Index lists the galleries and images matching the "q" query
+// parameter, best matches first. The "page" parameter starts at 1.
+//
+// GET /search
+func (s *Search) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	vd.Form = url.Values{"q": {query}}
+	yield := searchPage{Query: query, Page: page}
+	if query == "" {
+		vd.Yield = yield
+		s.IndexView.Render(w, r, vd)
+		return
+	}
+
+	results, err := s.ss.Search(context.User(r.Context()), query, page)
+	if err != nil {
+		vd.SetAlert(err)
+		s.IndexView.Render(w, r, vd)
+		return
+	}
+	yield.Total = results.Total
+	yield.Pages = (results.Total + models.SearchPerPage - 1) / models.SearchPerPage
+	if page > 1 {
+		yield.PrevPath = searchPath(query, page-1)
+	}
+	if page < yield.Pages {
+		yield.NextPath = searchPath(query, page+1)
+	}
+	for _, hit := range results.Hits {
+		h := searchHit{
+			Title:       hit.Gallery.Title,
+			Description: hit.Gallery.Description,
+			Path:        hit.Gallery.Path(),
+			ImagePath:   hit.Gallery.CoverPath(),
+		}
+		if hit.Image != nil {
+			h.ImagePath = hit.Gallery.ImagePath(hit.Image)
+			h.Caption = hit.Image.Caption
+			h.AltText = hit.Image.AltText
+			h.IsImage = true
+		}
+		yield.Hits = append(yield.Hits, h)
+	}
+	vd.Yield = yield
+	s.IndexView.Render(w, r, vd)
+}
+
+// searchPath returns the path of the given page of the results
+// for query
+func searchPath(query string, page int) string {
+	return fmt.Sprintf("/search?q=%s&page=%d", url.QueryEscape(query), page)
+}
@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/jinzhu/gorm"
+)
+
+// fakeSearch returns hits, and records what it was asked for
+type fakeSearch struct {
+	hits  []models.SearchHit
+	total int
+	user  *models.User
+	query string
+	page  int
+}
+
+func (fs *fakeSearch) Search(user *models.User, query string, page int) (*models.SearchResults, error) {
+	fs.user, fs.query, fs.page = user, query, page
+	return &models.SearchResults{Hits: fs.hits, Total: fs.total}, nil
+}
+
+func TestSearch(t *testing.T) {
+	gallery := &models.Gallery{Model: gorm.Model{ID: 3}, Title: "Wedding", Visibility: models.VisibilityPublic, Description: "At the beach"}
+	ss := &fakeSearch{
+		hits: []models.SearchHit{
+			{Gallery: gallery},
+			{Gallery: gallery, Image: &models.Image{GalleryID: 3, Filename: "cove.jpg", Caption: "A quiet cove"}},
+		},
+		total: 2*models.SearchPerPage + 5,
+	}
+	searchC := NewSearch(ss)
+
+	rec := get(http.HandlerFunc(searchC.Index), "/search?q=beach+%26+sun&page=2", 0)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected visitors to search. Received %d", rec.Code)
+	}
+	if ss.user != nil || ss.query != "beach & sun" || ss.page != 2 {
+		t.Errorf("Expected a visitor's search for page 2. Received %v, %q, %d", ss.user, ss.query, ss.page)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		`href="/galleries/3"`,
+		"At the beach",
+		`src="/images/galleries/3/cove.jpg"`,
+		"A quiet cove",
+		`href="/search?q=beach&#43;%26&#43;sun&amp;page=1"`,
+		`href="/search?q=beach&#43;%26&#43;sun&amp;page=3"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected the results to contain %s", want)
+		}
+	}
+
+	ss.page = 0
+	rec = get(http.HandlerFunc(searchC.Index), "/search?q=+", 7)
+	if rec.Code != http.StatusOK || ss.page != 0 {
+		t.Errorf("Expected empty searches to be skipped. Received %d, page %d", rec.Code, ss.page)
+	}
+}
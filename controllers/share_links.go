@@ -0,0 +1,365 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/hash"
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/apigban/lenslocked_v1/views"
+	"github.com/gorilla/mux"
+)
+
+const (
+	shareSessionCookie = "share_session"
+
+	// shareSessionMaxAge is how long viewers can browse the
+	// gallery once they opened a share link
+	shareSessionMaxAge = 12 * time.Hour
+)
+
+// shareExpiries are the lifetimes offered for new share links, in
+// days. 0 means the link never expires.
+var shareExpiries = []int{7, 30, 90, 0}
+
+// validExpiry reports whether days is one of shareExpiries
+func validExpiry(days int) bool {
+	for _, d := range shareExpiries {
+		if d == days {
+			return true
+		}
+	}
+	return false
+}
+
+// NewShareLinks is used to create the controller letting owners
+// share galleries with people who don't have an account. Links
+// are built from baseURL, eg. "https://lenslocked.com".
+func NewShareLinks(sls models.ShareLinkService, galleries *Galleries, baseURL string) *ShareLinks {
+	return &ShareLinks{
+		IndexView:  views.NewView("bootstrap", "galleries/share"),
+		UnlockView: views.NewView("bootstrap", "galleries/unlock"),
+		sls:        sls,
+		galleries:  galleries,
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+type ShareLinks struct {
+	IndexView  *views.View
+	UnlockView *views.View
+	sls        models.ShareLinkService
+	galleries  *Galleries
+	baseURL    string
+}
+
+type ShareLinkForm struct {
+	Password      string `schema:"password"`
+	ExpiresIn     int    `schema:"expires_in"`
+	MaxViews      int    `schema:"max_views"`
+	AllowDownload bool   `schema:"allow_download"`
+}
+
+type UnlockForm struct {
+	Password string `schema:"password"`
+}
+
+// sharePage is the Yield of the galleries/share view
+type sharePage struct {
+	Gallery *models.Gallery
+	Links   []models.ShareLink
+	// Created is the link that was just created, the only time
+	// its URL can be displayed
+	Created  *models.ShareLink
+	URL      string
+	Expiries []int
+}
+
+// Index lists the share links of the gallery
+//
+// GET /galleries/{id}/share
+func (s *ShareLinks) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	gallery, err := s.galleries.authorized(r, models.ActionManage)
+	if err != nil {
+		vd.SetAlert(err)
+		s.IndexView.Render(w, r, vd)
+		return
+	}
+	s.render(w, r, vd, gallery, nil)
+}
+
+// Create generates a new share link for the gallery and displays
+// it once
+//
+// POST /galleries/{id}/share
+func (s *ShareLinks) Create(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	gallery, err := s.galleries.authorized(r, models.ActionManage)
+	if err != nil {
+		vd.SetAlert(err)
+		s.IndexView.Render(w, r, vd)
+		return
+	}
+	var form ShareLinkForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		s.render(w, r, vd, gallery, nil)
+		return
+	}
+	vd.KeepForm(r)
+	if !validExpiry(form.ExpiresIn) {
+		vd.SetAlert(models.ErrExpiryInvalid)
+		s.render(w, r, vd, gallery, nil)
+		return
+	}
+	link := models.ShareLink{
+		GalleryID:     gallery.ID,
+		Password:      form.Password,
+		MaxViews:      form.MaxViews,
+		AllowDownload: form.AllowDownload,
+	}
+	if form.ExpiresIn > 0 {
+		expiresAt := time.Now().AddDate(0, 0, form.ExpiresIn)
+		link.ExpiresAt = &expiresAt
+	}
+	if err := s.sls.Create(&link); err != nil {
+		vd.SetAlert(err)
+		s.render(w, r, vd, gallery, nil)
+		return
+	}
+	vd.Form = nil
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "share.created",
+	}
+	s.render(w, r, vd, gallery, &link)
+}
+
+// Revoke stops one of the share links of the gallery from
+// granting access. Viewers browsing the gallery are cut off too.
+//
+// POST /galleries/{id}/share/{link}/revoke
+func (s *ShareLinks) Revoke(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	gallery, err := s.galleries.authorized(r, models.ActionManage)
+	if err != nil {
+		vd.SetAlert(err)
+		s.IndexView.Render(w, r, vd)
+		return
+	}
+	id, err := strconv.ParseUint(mux.Vars(r)["link"], 10, 64)
+	if err == nil {
+		err = s.sls.Revoke(uint(id), gallery.ID)
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		s.render(w, r, vd, gallery, nil)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "share.revoked",
+	}
+	views.RedirectAlert(w, r, fmt.Sprintf("/galleries/%d/share", gallery.ID), http.StatusFound, alert)
+}
+
+// Show displays the gallery to the viewer of a share link. Links
+// with a password ask for it first. Opening the link counts as a
+// view, the viewer then gets a session limited to the link.
+//
+// GET /s/{token}
+func (s *ShareLinks) Show(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	link, err := s.sls.ByToken(mux.Vars(r)["token"])
+	if err != nil {
+		s.unavailable(w, r, err)
+		return
+	}
+	if !s.hasSession(r, link) {
+		if link.HasPassword() {
+			vd.Yield = link.Token
+			s.UnlockView.Render(w, r, vd)
+			return
+		}
+		if err := s.startSession(w, link); err != nil {
+			s.unavailable(w, r, err)
+			return
+		}
+	}
+	gallery, err := s.gallery(link, r, models.ActionView)
+	if err != nil {
+		s.unavailable(w, r, err)
+		return
+	}
+	s.galleries.renderShow(w, r, vd, gallery)
+}
+
+// Unlock checks the password of a share link before showing the
+// gallery
+//
+// POST /s/{token}
+func (s *ShareLinks) Unlock(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	link, err := s.sls.ByToken(mux.Vars(r)["token"])
+	if err != nil {
+		s.unavailable(w, r, err)
+		return
+	}
+	vd.Yield = link.Token
+	var form UnlockForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		s.UnlockView.Render(w, r, vd)
+		return
+	}
+	if err := s.sls.Authenticate(link, form.Password); err != nil {
+		vd.SetAlert(err)
+		s.UnlockView.Render(w, r, vd)
+		return
+	}
+	if err := s.startSession(w, link); err != nil {
+		s.unavailable(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/s/"+link.Token, http.StatusFound)
+}
+
+// Image serves a single image to the viewer of a share link
+//
+// GET /s/{token}/images/{filename}
+func (s *ShareLinks) Image(w http.ResponseWriter, r *http.Request) {
+	gallery, err := s.authorized(r, models.ActionView)
+	if err != nil {
+		views.LogError(r, err)
+		http.Error(w, http.StatusText(views.StatusCode(err)), views.StatusCode(err))
+		return
+	}
+	s.galleries.serveImage(w, r, gallery)
+}
+
+// Download streams the gallery to the viewer of a share link, if
+// the owner allowed downloads
+//
+// GET /s/{token}/download
+func (s *ShareLinks) Download(w http.ResponseWriter, r *http.Request) {
+	gallery, err := s.authorized(r, models.ActionDownload)
+	if err != nil {
+		views.LogError(r, err)
+		http.Error(w, http.StatusText(views.StatusCode(err)), views.StatusCode(err))
+		return
+	}
+	s.galleries.download(w, r, gallery)
+}
+
+// authorized looks up the gallery from the {token} route variable,
+// for viewers who already opened the link
+func (s *ShareLinks) authorized(r *http.Request, action models.Action) (*models.Gallery, error) {
+	link, err := s.sls.ByToken(mux.Vars(r)["token"])
+	if err != nil {
+		return nil, err
+	}
+	if !s.hasSession(r, link) {
+		return nil, models.ErrNotFound
+	}
+	return s.gallery(link, r, action)
+}
+
+// gallery looks up the gallery of link, and checks that the
+// viewer may take action on it
+func (s *ShareLinks) gallery(link *models.ShareLink, r *http.Request, action models.Action) (*models.Gallery, error) {
+	gallery, err := s.galleries.gs.ByShareLink(link)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.galleries.gs.Authorize(context.User(r.Context()), gallery, action); err != nil {
+		return nil, err
+	}
+	return gallery, nil
+}
+
+// startSession counts a view of link and lets the viewer browse
+// the gallery through it for shareSessionMaxAge. The cookie is
+// only sent under the path of the link, and signed with the
+// session key of the link.
+func (s *ShareLinks) startSession(w http.ResponseWriter, link *models.ShareLink) error {
+	if err := s.sls.RecordView(link); err != nil {
+		return err
+	}
+	payload := fmt.Sprintf("%d.%d", link.ID, time.Now().Add(shareSessionMaxAge).Unix())
+	http.SetCookie(w, &http.Cookie{
+		Name:     shareSessionCookie,
+		Value:    payload + "." + sessionHMAC(link).Hash(payload),
+		Path:     "/s/" + link.Token,
+		MaxAge:   int(shareSessionMaxAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// hasSession reports whether the viewer already opened link, see
+// startSession
+func (s *ShareLinks) hasSession(r *http.Request, link *models.ShareLink) bool {
+	cookie, err := r.Cookie(shareSessionCookie)
+	if err != nil {
+		return false
+	}
+	i := strings.LastIndex(cookie.Value, ".")
+	if i < 0 {
+		return false
+	}
+	payload, sig := cookie.Value[:i], cookie.Value[i+1:]
+	if link.SessionKey == "" || !hmac.Equal([]byte(sessionHMAC(link).Hash(payload)), []byte(sig)) {
+		return false
+	}
+	var id uint
+	var expires int64
+	if _, err := fmt.Sscanf(payload, "%d.%d", &id, &expires); err != nil {
+		return false
+	}
+	return id == link.ID && time.Now().Unix() < expires
+}
+
+// sessionHMAC signs the sessions of the viewers of link
+func sessionHMAC(link *models.ShareLink) hash.HMAC {
+	return hash.NewHMAC(link.SessionKey)
+}
+
+// unavailable renders the page viewers of a link that was revoked,
+// expired or opened too many times land on
+func (s *ShareLinks) unavailable(w http.ResponseWriter, r *http.Request, err error) {
+	var vd views.Data
+	if err != models.ErrNotFound {
+		vd.SetAlert(err)
+		s.UnlockView.Render(w, r, vd)
+		return
+	}
+	vd.AlertError("share.unavailable")
+	s.UnlockView.RenderStatus(w, r, http.StatusNotFound, vd)
+}
+
+// render displays the share links of gallery along with created,
+// if it isn't nil
+func (s *ShareLinks) render(w http.ResponseWriter, r *http.Request, vd views.Data, gallery *models.Gallery, created *models.ShareLink) {
+	links, err := s.sls.ByGalleryID(gallery.ID)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	page := sharePage{
+		Gallery:  gallery,
+		Links:    links,
+		Created:  created,
+		Expiries: shareExpiries,
+	}
+	if created != nil {
+		page.URL = s.baseURL + "/s/" + created.Token
+	}
+	vd.Yield = page
+	s.IndexView.Render(w, r, vd)
+}
@@ -0,0 +1,206 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/hash"
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// fakeShareLinks keeps links in memory by their raw token, with
+// their password in clear
+type fakeShareLinks struct {
+	models.ShareLinkService
+	links map[string]*models.ShareLink
+}
+
+func (fs *fakeShareLinks) ByToken(token string) (*models.ShareLink, error) {
+	link, ok := fs.links[token]
+	if !ok || !link.Active() {
+		return nil, models.ErrNotFound
+	}
+	return link, nil
+}
+
+func (fs *fakeShareLinks) Create(link *models.ShareLink) error {
+	link.Token = fmt.Sprint("link", len(fs.links))
+	fs.links[link.Token] = link
+	return nil
+}
+
+func (fs *fakeShareLinks) ByGalleryID(galleryID uint) ([]models.ShareLink, error) {
+	return nil, nil
+}
+
+func (fs *fakeShareLinks) Authenticate(link *models.ShareLink, password string) error {
+	if link.Password != password {
+		return models.ErrPasswordIncorrect
+	}
+	return nil
+}
+
+func (fs *fakeShareLinks) RecordView(link *models.ShareLink) error {
+	if link.Exhausted() {
+		return models.ErrNotFound
+	}
+	link.Views++
+	return nil
+}
+
+// ByShareLink doesn't attach the link, which only the models
+// package can do. The gallery is returned as public instead,
+// Authorize is tested along with the models.
+func (fg *fakeGalleries) ByShareLink(link *models.ShareLink) (*models.Gallery, error) {
+	gallery, err := fg.ByID(link.GalleryID)
+	if err != nil {
+		return nil, err
+	}
+	shared := *gallery
+	shared.Visibility = models.VisibilityPublic
+	return &shared, nil
+}
+
+func TestShareLink(t *testing.T) {
+	inTempDir(t)
+	is := models.NewImageService(&fakeImageDB{})
+	if err := is.Create(3, strings.NewReader("jpeg"), "a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	galleriesC := NewGalleries(newFakeGalleries(
+		models.Gallery{Model: gorm.Model{ID: 3}, UserID: 7, Title: "Proofs", Visibility: models.VisibilityPrivate},
+	), is, nil)
+	links := &fakeShareLinks{links: map[string]*models.ShareLink{
+		"locked": {Model: gorm.Model{ID: 1}, GalleryID: 3, Token: "locked", Password: "secret", PasswordHash: "x", SessionKey: "locked-key"},
+		"once":   {Model: gorm.Model{ID: 2}, GalleryID: 3, Token: "once", MaxViews: 1, SessionKey: "once-key"},
+		"nokey":  {Model: gorm.Model{ID: 3}, GalleryID: 3, Token: "nokey"},
+	}}
+	shareC := NewShareLinks(links, galleriesC, "")
+	r := mux.NewRouter()
+	r.HandleFunc("/s/{token}", shareC.Show).Methods("GET")
+	r.HandleFunc("/s/{token}", shareC.Unlock).Methods("POST")
+	r.HandleFunc("/s/{token}/images/{filename}", shareC.Image).Methods("GET")
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	newClient := func() *http.Client {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &http.Client{Jar: jar}
+	}
+	status := func(c *http.Client, method, path string, form url.Values) int {
+		var resp *http.Response
+		var err error
+		if method == "POST" {
+			resp, err = c.PostForm(srv.URL+path, form)
+		} else {
+			resp, err = c.Get(srv.URL + path)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Sessions are signed with the key of their link, one signed
+	// with any other key doesn't open it
+	forged := newClient()
+	payload := fmt.Sprintf("1.%d", time.Now().Add(time.Hour).Unix())
+	srvURL, _ := url.Parse(srv.URL + "/s/locked")
+	for _, key := range []string{"secret-share-key", ""} {
+		forged.Jar.SetCookies(srvURL, []*http.Cookie{{
+			Name:  shareSessionCookie,
+			Value: payload + "." + hash.NewHMAC(key).Hash(payload),
+			Path:  "/s/locked",
+		}})
+		if code := status(forged, "GET", "/s/locked/images/a.jpg", nil); code != http.StatusNotFound {
+			t.Errorf("Expected a session signed with %q to be rejected. Received %d", key, code)
+		}
+	}
+	nokey := fmt.Sprintf("3.%d", time.Now().Add(time.Hour).Unix())
+	srvURL, _ = url.Parse(srv.URL + "/s/nokey")
+	forged.Jar.SetCookies(srvURL, []*http.Cookie{{
+		Name:  shareSessionCookie,
+		Value: nokey + "." + hash.NewHMAC("").Hash(nokey),
+		Path:  "/s/nokey",
+	}})
+	if code := status(forged, "GET", "/s/nokey/images/a.jpg", nil); code != http.StatusNotFound {
+		t.Errorf("Expected links without a session key to have no sessions. Received %d", code)
+	}
+
+	client := newClient()
+	if code := status(client, "GET", "/s/locked/images/a.jpg", nil); code != http.StatusNotFound {
+		t.Errorf("Expected images to require opening the link first. Received %d", code)
+	}
+	if code := status(client, "POST", "/s/locked", url.Values{"password": {"wrong"}}); code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected a wrong password to be rejected. Received %d", code)
+	}
+	if code := status(client, "POST", "/s/locked", url.Values{"password": {"secret"}}); code != http.StatusOK {
+		t.Errorf("Expected the gallery once unlocked. Received %d", code)
+	}
+	if code := status(client, "GET", "/s/locked/images/a.jpg", nil); code != http.StatusOK {
+		t.Errorf("Expected images once unlocked. Received %d", code)
+	}
+	if code := status(client, "GET", "/s/once/images/a.jpg", nil); code != http.StatusNotFound {
+		t.Errorf("Expected the session to be limited to its link. Received %d", code)
+	}
+
+	if code := status(client, "GET", "/s/once", nil); code != http.StatusOK {
+		t.Errorf("Expected the first view to be allowed. Received %d", code)
+	}
+	if code := status(client, "GET", "/s/once", nil); code != http.StatusOK {
+		t.Errorf("Expected the first viewer to keep browsing. Received %d", code)
+	}
+	if code := status(newClient(), "GET", "/s/once", nil); code != http.StatusNotFound {
+		t.Errorf("Expected the link to stop after its max views. Received %d", code)
+	}
+	if views := links.links["once"].Views; views != 1 {
+		t.Errorf("Expected 1 view. Received %d", views)
+	}
+}
+
+func TestShareLinkCreateExpiry(t *testing.T) {
+	galleriesC := NewGalleries(newFakeGalleries(
+		models.Gallery{Model: gorm.Model{ID: 3}, UserID: 7, Title: "Proofs"},
+	), nil, nil)
+	links := &fakeShareLinks{links: map[string]*models.ShareLink{}}
+	shareC := NewShareLinks(links, galleriesC, "")
+	r := mux.NewRouter()
+	r.HandleFunc("/galleries/{id:[0-9]+}/share", shareC.Create).Methods("POST")
+
+	for _, tt := range []struct {
+		expiresIn string
+		want      int
+	}{
+		{"7", http.StatusOK},
+		{"0", http.StatusOK},
+		{"1", http.StatusUnprocessableEntity},
+		{"-30", http.StatusUnprocessableEntity},
+		{"36500", http.StatusUnprocessableEntity},
+	} {
+		form := url.Values{"expires_in": {tt.expiresIn}}
+		req := httptest.NewRequest("POST", "/galleries/3/share", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithUser(req.Context(), &models.User{Model: gorm.Model{ID: 7}}))
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s days: expected %d. Received %d", tt.expiresIn, tt.want, rec.Code)
+		}
+	}
+	if len(links.links) != 2 {
+		t.Errorf("Expected 2 links to be created. Received %d", len(links.links))
+	}
+}
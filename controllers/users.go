@@ -4,7 +4,14 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/i18n"
+	"github.com/apigban/lenslocked_v1/metrics"
+	"github.com/apigban/lenslocked_v1/middleware"
 	"github.com/apigban/lenslocked_v1/models"
 	"github.com/apigban/lenslocked_v1/rand"
 	"github.com/apigban/lenslocked_v1/views"
@@ -14,6 +21,16 @@ type Users struct {
 	NewView   *views.View
 	LoginView *views.View
 	us        models.UserService
+	ls        models.LoginService
+	providers []loginProvider
+}
+
+// loginProvider is an external provider users can sign in with,
+// offered on the login page
+type loginProvider struct {
+	Name string
+	// Path starts the sign in with the provider
+	Path string
 }
 
 type SignupForm struct {
@@ -25,10 +42,12 @@ type SignupForm struct {
 type LoginForm struct {
 	Email    string `schema:"email"`
 	Password string `schema:"password"`
+	// Next is the page to return to after signing in
+	Next string `schema:"next"`
 }
 
 func (u Users) New(w http.ResponseWriter, r *http.Request) {
-	u.NewView.Render(w, nil)
+	u.NewView.Render(w, r, nil)
 }
 
 // NewUsers is used to create a new Users controller.
@@ -37,11 +56,12 @@ func (u Users) New(w http.ResponseWriter, r *http.Request) {
 // initial setup.
 //
 // GET /signup
-func NewUsers(us models.UserService) *Users {
+func NewUsers(us models.UserService, ls models.LoginService) *Users {
 	return &Users{
 		NewView:   views.NewView("bootstrap", "users/new"),
 		LoginView: views.NewView("bootstrap", "users/login"),
 		us:        us,
+		ls:        ls,
 	}
 }
 
@@ -55,9 +75,10 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 	if err := parseForm(r, &form); err != nil {
 		log.Println(err)
 		vd.SetAlert(err)
-		u.NewView.Render(w, vd)
+		u.NewView.Render(w, r, vd)
 		return
 	}
+	vd.KeepForm(r)
 	user := models.User{
 		Name:     form.Name,
 		Email:    form.Email,
@@ -65,15 +86,20 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 	}
 	if err := u.us.Create(&user); err != nil {
 		vd.SetAlert(err)
-		u.NewView.Render(w, vd)
+		u.NewView.Render(w, r, vd)
 		return
 	}
-	err := u.signIn(w, &user)
+	metrics.Signups.Inc()
+	err := u.signIn(w, r, &user, models.LoginMethodSignup)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
-	http.Redirect(w, r, "/cookietest", http.StatusFound)
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "alert.welcome",
+	}
+	views.RedirectAlert(w, r, "/", http.StatusFound, alert)
 }
 
 // Login is used to verify the user provided user and password
@@ -86,38 +112,136 @@ func (u Users) Login(w http.ResponseWriter, r *http.Request) {
 	if err := parseForm(r, &form); err != nil {
 		log.Println(err)
 		vd.SetAlert(err)
-		u.LoginView.Render(w, vd)
+		u.LoginView.Render(w, r, u.loginData(vd))
 		return
 	}
+	vd.KeepForm(r)
 	user, err := u.us.Authenticate(form.Email, form.Password)
 	if err != nil {
+		metrics.Logins.Inc(metrics.LoginFailure)
 		switch err {
 		case models.ErrNotFound:
-			vd.AlertError("Invalid email address")
+			vd.AlertError("login.unknown_email")
+			vd.SetFieldError("email", "login.unknown_email")
+			u.LoginView.RenderStatus(w, r, http.StatusUnprocessableEntity, u.loginData(vd))
 		default:
 			// Default case - Pass in error message
 			// error will be generic enough it will
 			// the PublicError interface
 			vd.SetAlert(err)
+			u.LoginView.Render(w, r, u.loginData(vd))
 		}
-		u.LoginView.Render(w, vd)
 		return
 	}
+	metrics.Logins.Inc(metrics.LoginSuccess)
 
-	err = u.signIn(w, user)
+	err = u.signIn(w, r, user, models.LoginMethodPassword)
 	if err != nil {
 		// Display error just for better handling
 		// This error is guaranteed to never happen
 		vd.SetAlert(err)
-		u.LoginView.Render(w, vd)
+		u.LoginView.Render(w, r, u.loginData(vd))
+		return
+	}
+	if form.Next != "" {
+		http.Redirect(w, r, localRedirect(form.Next), http.StatusFound)
 		return
 	}
 	http.Redirect(w, r, "/cookietest", http.StatusFound)
 
 }
 
-// signIn is used to sign the given user in via cookies
-func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
+// ShowLogin renders the login form, keeping the page to return
+// to once signed in, see RequireUser
+//
+// GET /login
+func (u *Users) ShowLogin(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	if next := r.URL.Query().Get("next"); next != "" {
+		vd.Form = url.Values{"next": {localRedirect(next)}}
+	}
+	u.LoginView.Render(w, r, u.loginData(vd))
+}
+
+// Logout deletes the user's remember_token cookie and rotates
+// their remember token so the old cookie can't be reused
+//
+// POST /logout
+func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
+	cookie := http.Cookie{
+		Name:     "remember_token",
+		Value:    "",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+
+	user := context.User(r.Context())
+	if user != nil {
+		token, err := rand.RememberToken()
+		if err != nil {
+			log.Println(err)
+		} else {
+			user.Remember = token
+			if err := u.us.Update(user); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+type LocaleForm struct {
+	Locale string `schema:"locale"`
+}
+
+// SetLocale stores the language picked by the user, on their
+// account when signed in and in a cookie otherwise, then sends
+// them back to the page they came from
+//
+// POST /locale
+func (u *Users) SetLocale(w http.ResponseWriter, r *http.Request) {
+	var form LocaleForm
+	if err := parseForm(r, &form); err != nil || !i18n.IsSupported(form.Locale) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	cookie := http.Cookie{
+		Name:     middleware.LocaleCookie,
+		Value:    form.Locale,
+		Path:     "/",
+		Expires:  time.Now().AddDate(1, 0, 0),
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+
+	if user := context.User(r.Context()); user != nil {
+		user.Locale = form.Locale
+		if err := u.us.Update(user); err != nil {
+			views.LogError(r, err)
+		}
+	}
+	http.Redirect(w, r, localRedirect(r.Referer()), http.StatusFound)
+}
+
+// AddProvider offers signing in with an external provider on
+// the login page
+func (u *Users) AddProvider(name, path string) {
+	u.providers = append(u.providers, loginProvider{Name: name, Path: path})
+}
+
+// loginData sets the providers listed on the login page as
+// the Yield of vd
+func (u *Users) loginData(vd views.Data) views.Data {
+	vd.Yield = u.providers
+	return vd
+}
+
+// signIn is used to sign the given user in via cookies. The
+// login is added to their history along with method, one of the
+// models.LoginMethod constants.
+func (u *Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User, method string) error {
 	// Make sure a remember token is available on signIn
 	// If user has no remember_token
 	// create one, set the user.Remember as the token value
@@ -138,11 +262,44 @@ func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
 		Name:     "remember_token",
 		Value:    user.Remember,
 		HttpOnly: true,
+		// Users may sign in from under another path, eg. with a
+		// provider at /auth/oidc/callback
+		Path: "/",
 	}
 	http.SetCookie(w, &cookie)
+
+	login := models.Login{
+		UserID:    user.ID,
+		Method:    method,
+		IP:        remoteIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	if err := u.ls.Create(&login); err != nil {
+		// The user is signed in anyway
+		views.LogError(r, err)
+	}
 	return nil
 }
 
+// signUpPasswordless creates a user without a password, for
+// users who signed in some other way, eg. with a login link.
+// Without a name, the start of their email address is used.
+func (u *Users) signUpPasswordless(name, email string) (*models.User, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = strings.SplitN(email, "@", 2)[0]
+	}
+	user := models.User{
+		Name:  name,
+		Email: email,
+	}
+	if err := u.us.CreatePasswordless(&user); err != nil {
+		return nil, err
+	}
+	metrics.Signups.Inc()
+	return &user, nil
+}
+
 // CookieTest is used to display cookies set on the current user
 func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
 	cookie, err := r.Cookie("remember_token")
@@ -0,0 +1,343 @@
+// Package exports builds the archives users download their data
+// with, in the background.
+package exports
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/email"
+	"github.com/apigban/lenslocked_v1/i18n"
+	"github.com/apigban/lenslocked_v1/models"
+)
+
+// queueSize is how many exports can wait in the queue, Enqueue
+// leaves any more for the next look for pending exports
+const queueSize = 64
+
+// pendingInterval is how often Run looks for pending exports that
+// didn't make it into the queue
+const pendingInterval = time.Minute
+
+// Worker builds the exports queued with Enqueue one at a time, and
+// emails the user a link to download it once ready
+type Worker struct {
+	Exports   models.ExportService
+	Users     models.UserService
+	Galleries models.GalleryService
+	Images    models.ImageService
+	Tokens    models.APITokenService
+	Logins    models.LoginService
+	Mailer    email.Mailer
+	// BaseURL is what download links start with,
+	// eg. "https://lenslocked.com"
+	BaseURL string
+
+	queue chan uint
+}
+
+// NewWorker returns a worker using services, call Run to start it
+func NewWorker(services *models.Services, mailer email.Mailer, baseURL string) *Worker {
+	return &Worker{
+		Exports:   services.Export,
+		Users:     services.User,
+		Galleries: services.Gallery,
+		Images:    services.Image,
+		Tokens:    services.APIToken,
+		Logins:    services.Login,
+		Mailer:    mailer,
+		BaseURL:   baseURL,
+		queue:     make(chan uint, queueSize),
+	}
+}
+
+// Enqueue schedules export to be built. It never blocks: when the
+// queue is full the export stays pending until Run looks for it.
+func (w *Worker) Enqueue(export *models.Export) {
+	select {
+	case w.queue <- export.ID:
+	default:
+	}
+}
+
+// Run builds queued exports until ctx is done, starting with the
+// ones left pending when the site last stopped. Exports that
+// didn't fit in the queue are picked up every pendingInterval.
+func (w *Worker) Run(ctx context.Context) {
+	w.buildPending(ctx)
+	ticker := time.NewTicker(pendingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.buildPending(ctx)
+		case id := <-w.queue:
+			export, err := w.Exports.ByID(id)
+			if err != nil {
+				log.Printf("exports: %d: %v", id, err)
+				continue
+			}
+			w.build(ctx, export)
+		}
+	}
+}
+
+// buildPending builds every export that is still pending
+func (w *Worker) buildPending(ctx context.Context) {
+	pending, err := w.Exports.Pending()
+	if err != nil {
+		log.Println("exports:", err)
+		return
+	}
+	for i := range pending {
+		if ctx.Err() != nil {
+			return
+		}
+		w.build(ctx, &pending[i])
+	}
+}
+
+// build writes the archive of export and notifies its user.
+// Failures are recorded on the export rather than returned.
+func (w *Worker) build(ctx context.Context, export *models.Export) {
+	if export.Status != models.ExportPending {
+		return
+	}
+	user, err := w.Users.ByID(export.UserID)
+	if err == nil {
+		err = w.writeFile(export, user)
+	}
+	if err != nil {
+		log.Printf("exports: %d: %v", export.ID, err)
+		export.Status = models.ExportFailed
+		if err := w.Exports.Update(export); err != nil {
+			log.Printf("exports: %d: %v", export.ID, err)
+		}
+		return
+	}
+
+	expiresAt := time.Now().Add(models.ExportTTL)
+	export.Status = models.ExportReady
+	export.ExpiresAt = &expiresAt
+	if err := w.Exports.Update(export); err != nil {
+		log.Printf("exports: %d: %v", export.ID, err)
+		return
+	}
+	locale := user.Locale
+	msg := email.Message{
+		To:      user.Email,
+		Subject: i18n.T(locale, "export.email_subject"),
+		Text: i18n.T(locale, "export.email_body",
+			fmt.Sprintf("%s/settings/export/%d", w.BaseURL, export.ID),
+			expiresAt.Format("2006-01-02")),
+	}
+	if err := w.Mailer.Send(ctx, msg); err != nil {
+		log.Printf("exports: %d: %v", export.ID, err)
+	}
+}
+
+// writeFile writes the archive to a temporary file first, so that
+// a half written archive is never downloaded
+func (w *Worker) writeFile(export *models.Export, user *models.User) error {
+	if err := os.MkdirAll(models.ExportDir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(models.ExportDir, ".export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := w.write(f, user); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), export.Path())
+}
+
+// profile is the user, without any hash
+type profile struct {
+	ID          uint       `json:"id"`
+	Name        string     `json:"name"`
+	Email       string     `json:"email"`
+	Locale      string     `json:"locale,omitempty"`
+	HasPassword bool       `json:"has_password"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	PurgeAt     *time.Time `json:"purge_at,omitempty"`
+}
+
+type gallery struct {
+	ID          uint      `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Visibility  string    `json:"visibility"`
+	Tags        []string  `json:"tags"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// CoverImage is the path of the cover in the archive, if one
+	// was picked
+	CoverImage string  `json:"cover_image,omitempty"`
+	Images     []image `json:"images"`
+}
+
+type image struct {
+	// Path is where the file is in the archive
+	Path     string   `json:"path"`
+	Position int      `json:"position"`
+	Caption  string   `json:"caption"`
+	AltText  string   `json:"alt_text"`
+	Tags     []string `json:"tags"`
+}
+
+type login struct {
+	At        time.Time `json:"at"`
+	Method    string    `json:"method"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+type apiToken struct {
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+// write writes the zip archive of the data of user to dst:
+//
+//	profile.json
+//	galleries.json
+//	galleries/<id>/<image>
+//	logins.json
+//	api_tokens.json
+func (w *Worker) write(dst io.Writer, user *models.User) error {
+	zw := zip.NewWriter(dst)
+	err := writeJSON(zw, "profile.json", profile{
+		ID:          user.ID,
+		Name:        user.Name,
+		Email:       user.Email,
+		Locale:      user.Locale,
+		HasPassword: user.HasPassword(),
+		CreatedAt:   user.CreatedAt,
+		UpdatedAt:   user.UpdatedAt,
+		PurgeAt:     user.PurgeAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	galleries, err := w.Galleries.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+	exported := make([]gallery, 0, len(galleries))
+	for _, listed := range galleries {
+		// Lists leave out the tags, see models.Gallery
+		g, err := w.Galleries.ByID(listed.ID)
+		if err != nil {
+			return err
+		}
+		images, err := w.Images.ByGalleryID(g.ID)
+		if err != nil {
+			return err
+		}
+		dir := path.Join("galleries", fmt.Sprint(g.ID))
+		ret := gallery{
+			ID:          g.ID,
+			Title:       g.Title,
+			Description: g.Description,
+			Visibility:  g.Visibility,
+			Tags:        nonNil(g.Tags),
+			CreatedAt:   g.CreatedAt,
+			UpdatedAt:   g.UpdatedAt,
+			Images:      make([]image, 0, len(images)),
+		}
+		if g.CoverImage != "" {
+			ret.CoverImage = path.Join(dir, g.CoverImage)
+		}
+		for _, i := range images {
+			name := path.Join(dir, i.Filename)
+			if err := i.WriteZip(zw, name); err != nil {
+				return err
+			}
+			ret.Images = append(ret.Images, image{
+				Path:     name,
+				Position: i.Position,
+				Caption:  i.Caption,
+				AltText:  i.AltText,
+				Tags:     nonNil(i.Tags),
+			})
+		}
+		exported = append(exported, ret)
+	}
+	if err := writeJSON(zw, "galleries.json", exported); err != nil {
+		return err
+	}
+
+	logins, err := w.Logins.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+	history := make([]login, 0, len(logins))
+	for _, l := range logins {
+		history = append(history, login{
+			At:        l.CreatedAt,
+			Method:    l.Method,
+			IP:        l.IP,
+			UserAgent: l.UserAgent,
+		})
+	}
+	if err := writeJSON(zw, "logins.json", history); err != nil {
+		return err
+	}
+
+	tokens, err := w.Tokens.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+	metadata := make([]apiToken, 0, len(tokens))
+	for _, t := range tokens {
+		metadata = append(metadata, apiToken{
+			Name:       t.Name,
+			Scopes:     t.ScopeList(),
+			CreatedAt:  t.CreatedAt,
+			LastUsedAt: t.LastUsedAt,
+			ExpiresAt:  t.ExpiresAt,
+		})
+	}
+	if err := writeJSON(zw, "api_tokens.json", metadata); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// nonNil exports missing tags as an empty list
+func nonNil(tags []string) []string {
+	if tags == nil {
+		return []string{}
+	}
+	return tags
+}
+
+func writeJSON(zw *zip.Writer, name string, v interface{}) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,183 @@
+package exports
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/jinzhu/gorm"
+)
+
+type fakeGalleries struct {
+	models.GalleryService
+	galleries []models.Gallery
+}
+
+// ByUserID leaves out the tags, like GalleryService does
+func (fg *fakeGalleries) ByUserID(userID uint) ([]models.Gallery, error) {
+	ret := make([]models.Gallery, len(fg.galleries))
+	for i, g := range fg.galleries {
+		ret[i] = g
+		ret[i].Tags = nil
+	}
+	return ret, nil
+}
+
+func (fg *fakeGalleries) ByID(id uint) (*models.Gallery, error) {
+	for i := range fg.galleries {
+		if fg.galleries[i].ID == id {
+			return &fg.galleries[i], nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+type fakeTokens struct {
+	models.APITokenService
+	tokens []models.APIToken
+}
+
+func (ft *fakeTokens) ByUserID(userID uint) ([]models.APIToken, error) {
+	return ft.tokens, nil
+}
+
+type fakeLogins struct {
+	models.LoginService
+	logins []models.Login
+}
+
+func (fl *fakeLogins) ByUserID(userID uint) ([]models.Login, error) {
+	return fl.logins, nil
+}
+
+// fakeImageDB returns images, ignoring what is created
+type fakeImageDB struct {
+	models.ImageDB
+	images []models.Image
+}
+
+func (fi *fakeImageDB) ByGalleryID(galleryID uint) ([]models.Image, error) {
+	return fi.images, nil
+}
+
+func (fi *fakeImageDB) Create(image *models.Image) error {
+	return nil
+}
+
+func TestWrite(t *testing.T) {
+	// Images are stored relative to the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	images := models.NewImageService(&fakeImageDB{images: []models.Image{
+		{GalleryID: 3, Filename: "beach.jpg", Position: 1, Caption: "Sunset", AltText: "A beach at sunset", Tags: []string{"beach"}},
+	}})
+	if err := images.Create(3, strings.NewReader("jpeg bytes"), "beach.jpg"); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	w := &Worker{
+		Galleries: &fakeGalleries{galleries: []models.Gallery{
+			{Model: gorm.Model{ID: 3}, UserID: 7, Title: "Costa Rica", CoverImage: "beach.jpg", Tags: []string{"travel"}},
+		}},
+		Images: images,
+		Tokens: &fakeTokens{tokens: []models.APIToken{
+			{UserID: 7, Name: "backup", Scopes: "galleries:read", TokenHash: "token-hash", LastUsedAt: &now},
+		}},
+		Logins: &fakeLogins{logins: []models.Login{
+			{UserID: 7, Method: models.LoginMethodPassword, IP: "127.0.0.1"},
+		}},
+	}
+	user := &models.User{
+		Model:        gorm.Model{ID: 7},
+		Name:         "Pam Beesly",
+		Email:        "pam@dundermifflin.com",
+		PasswordHash: "password-hash",
+		RememberHash: "remember-hash",
+	}
+	var buf bytes.Buffer
+	if err := w.write(&buf, user); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(b)
+	}
+	beach := filepath.ToSlash(filepath.Join("galleries", "3", "beach.jpg"))
+	if files[beach] != "jpeg bytes" {
+		t.Errorf("Expected %s in the archive. Received %q", beach, files[beach])
+	}
+	for name, want := range map[string]string{
+		"profile.json":    `"email": "pam@dundermifflin.com"`,
+		"logins.json":     `"method": "password"`,
+		"api_tokens.json": `"name": "backup"`,
+	} {
+		if !strings.Contains(files[name], want) {
+			t.Errorf("Expected %s to contain %s. Received %s", name, want, files[name])
+		}
+	}
+	var galleries []gallery
+	if err := json.Unmarshal([]byte(files["galleries.json"]), &galleries); err != nil {
+		t.Fatal(err)
+	}
+	want := []gallery{{
+		ID:         3,
+		Title:      "Costa Rica",
+		Tags:       []string{"travel"},
+		CoverImage: beach,
+		Images: []image{
+			{Path: beach, Position: 1, Caption: "Sunset", AltText: "A beach at sunset", Tags: []string{"beach"}},
+		},
+	}}
+	if !reflect.DeepEqual(galleries, want) {
+		t.Errorf("Expected galleries.json to hold %+v. Received %+v", want, galleries)
+	}
+	for name, content := range files {
+		if strings.Contains(content, "hash") {
+			t.Errorf("Expected no hash in %s. Received %s", name, content)
+		}
+	}
+}
+
+func TestEnqueueFull(t *testing.T) {
+	w := &Worker{queue: make(chan uint, 1)}
+	done := make(chan struct{})
+	go func() {
+		w.Enqueue(&models.Export{Model: gorm.Model{ID: 1}})
+		w.Enqueue(&models.Export{Model: gorm.Model{ID: 2}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Enqueue not to block once the queue is full")
+	}
+	if id := <-w.queue; id != 1 {
+		t.Errorf("Expected export 1 to be queued. Received %d", id)
+	}
+}
@@ -2,12 +2,12 @@ module github.com/apigban/lenslocked_v1
 
 go 1.18
 
-require github.com/gorilla/mux v1.8.0
-
 require (
-	github.com/gorilla/schema v1.2.0 // indirect
-	github.com/jinzhu/gorm v1.9.16 // indirect
-	github.com/jinzhu/inflection v1.0.0 // indirect
-	github.com/lib/pq v1.1.1 // indirect
-	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa // indirect
+	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/schema v1.2.0
+	github.com/jinzhu/gorm v1.9.16
+	github.com/lib/pq v1.1.1
+	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa
 )
+
+require github.com/jinzhu/inflection v1.0.0 // indirect
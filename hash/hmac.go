@@ -4,28 +4,29 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
-	"hash"
 )
 
 // NewHMAC creates and returns a new HMAC object
 func NewHMAC(key string) HMAC {
-	h := hmac.New(sha256.New, []byte(key))
 	return HMAC{
-		hmac: h,
+		key: []byte(key),
 	}
 }
 
-// HMAC is a wrapper around the crypto/hmac package
+// HMAC is a wrapper around the crypto/hmac package.
+// It is safe for concurrent use.
 type HMAC struct {
-	hmac hash.Hash
+	key []byte
 }
 
 // Hash will hash the provided input string using HMAC
 // with the secret key provided when the HMAC object was created
 func (h HMAC) Hash(input string) string {
-	h.hmac.Reset()
-	h.hmac.Write([]byte(input))
-	b := h.hmac.Sum(nil)
+	// A new hash.Hash on every call, sharing one between
+	// goroutines would mix up their inputs
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(input))
+	b := mac.Sum(nil)
 
 	return base64.URLEncoding.EncodeToString(b)
 }
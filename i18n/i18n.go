@@ -0,0 +1,129 @@
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultLocale is used when no supported locale is requested,
+// and for messages missing from another locale's catalog
+const DefaultLocale = "en"
+
+//go:embed locales/*.json
+var localesFS embed.FS
+
+// catalogs maps a locale, eg. "de", to its messages by key
+var catalogs = mustLoad()
+
+func mustLoad() map[string]map[string]string {
+	files, err := localesFS.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	ret := make(map[string]map[string]string, len(files))
+	for _, f := range files {
+		b, err := localesFS.ReadFile("locales/" + f.Name())
+		if err != nil {
+			panic(err)
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(b, &messages); err != nil {
+			panic(fmt.Errorf("i18n: %s: %w", f.Name(), err))
+		}
+		locale := strings.TrimSuffix(f.Name(), path.Ext(f.Name()))
+		ret[locale] = messages
+	}
+	if _, ok := ret[DefaultLocale]; !ok {
+		panic("i18n: missing catalog for " + DefaultLocale)
+	}
+	return ret
+}
+
+// Supported returns every locale with a catalog, sorted
+func Supported() []string {
+	ret := make([]string, 0, len(catalogs))
+	for locale := range catalogs {
+		ret = append(ret, locale)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// IsSupported reports whether locale has a catalog
+func IsSupported(locale string) bool {
+	_, ok := catalogs[locale]
+	return ok
+}
+
+// Lookup returns the message for key in locale, falling back
+// to DefaultLocale. ok is false if neither catalog has the key.
+func Lookup(locale, key string) (msg string, ok bool) {
+	if msg, ok := catalogs[locale][key]; ok {
+		return msg, true
+	}
+	msg, ok = catalogs[DefaultLocale][key]
+	return msg, ok
+}
+
+// T translates key into locale. Extra args are formatted into
+// the message with fmt.Sprintf. Anything that isn't a known key
+// is returned as is, so already translated or literal text can
+// be passed through safely.
+func T(locale, key string, args ...interface{}) string {
+	msg, ok := Lookup(locale, key)
+	if !ok {
+		return key
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// Negotiate picks the supported locale that best matches an
+// Accept-Language header, eg. "de-CH,de;q=0.9,en;q=0.8". It
+// returns an empty string if none of them are supported.
+func Negotiate(acceptLanguage string) string {
+	type candidate struct {
+		locale string
+		q      float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		tag, q := part, 1.0
+		if i := strings.Index(part, ";"); i >= 0 {
+			tag = strings.TrimSpace(part[:i])
+			param := strings.TrimSpace(part[i+1:])
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		// Only the language matters to us, "de-CH" -> "de"
+		locale := strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+		candidates = append(candidates, candidate{locale, q})
+	}
+	// Stable so that equal weights keep the client's order
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+	for _, c := range candidates {
+		if IsSupported(c.locale) {
+			return c.locale
+		}
+	}
+	return ""
+}
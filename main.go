@@ -1,12 +1,27 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"io/fs"
+	"log"
+	"math"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/apigban/lenslocked_v1/api"
+	"github.com/apigban/lenslocked_v1/assets"
 	"github.com/apigban/lenslocked_v1/controllers"
+	"github.com/apigban/lenslocked_v1/email"
+	"github.com/apigban/lenslocked_v1/exports"
+	"github.com/apigban/lenslocked_v1/metrics"
 	"github.com/apigban/lenslocked_v1/middleware"
 	"github.com/apigban/lenslocked_v1/models"
+	"github.com/apigban/lenslocked_v1/oidc"
+	"github.com/apigban/lenslocked_v1/views"
 	"github.com/gorilla/mux"
 )
 
@@ -20,6 +35,19 @@ const (
 )
 
 func main() {
+	dev := flag.Bool("dev", false, "Read templates and assets from disk instead of the embedded copies")
+	baseURL := flag.String("base-url", "http://localhost:3000", "URL the site is reached at, used in callbacks")
+	oidcIssuer := flag.String("oidc-issuer", "", "Issuer URL of an OpenID Connect provider to sign in with, disabled if empty")
+	oidcName := flag.String("oidc-name", "SSO", "Name of the OpenID Connect provider shown on the login page")
+	oidcClientID := flag.String("oidc-client-id", "", "Client ID registered with the OpenID Connect provider")
+	oidcClientSecret := flag.String("oidc-client-secret", "", "Client secret registered with the OpenID Connect provider")
+	smtpAddr := flag.String("smtp-addr", "", "host:port of the SMTP server emails are sent with, they are logged if empty")
+	smtpFrom := flag.String("smtp-from", "LensLocked <no-reply@lenslocked.com>", "Sender of the emails")
+	smtpUsername := flag.String("smtp-username", "", "Username to authenticate with the SMTP server, if it requires one")
+	smtpPassword := flag.String("smtp-password", "", "Password to authenticate with the SMTP server")
+	deletionGrace := flag.Duration("deletion-grace", 14*24*time.Hour, "How long deleted accounts can be restored before they are purged")
+	flag.Parse()
+
 	// TODO - Fix before prod
 	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
 		host, port, user, password, dbname)
@@ -30,30 +58,225 @@ func main() {
 	// Additional note - the 3 methods are general to all services, it is proper to only have 1 top level set of methods
 	// instead of repeating Close(), AutoMigrate() and DestructiveReset() for every service
 	defer services.Close()
-	services.AutoMigrate()
+	must(services.AutoMigrate())
 	// services.DestructiveReset()
 
+	// Templates and assets are embedded in the binary, in development
+	// they are read from the working directory so edits show up
+	// without a rebuild.
+	var assetsFS fs.FS = assets.Embedded
+	if *dev {
+		views.UseDir("views")
+		views.Reload = true
+		assetsFS = os.DirFS("assets")
+	}
+	assetsSrv, err := assets.New(assetsFS, !*dev)
+	must(err)
+	views.AssetPath = assetsSrv.Path
+
+	var mailer email.Mailer = email.LogMailer{}
+	if *smtpAddr != "" {
+		mailer = email.SMTPMailer{
+			Addr:     *smtpAddr,
+			From:     *smtpFrom,
+			Username: *smtpUsername,
+			Password: *smtpPassword,
+		}
+	}
+
 	staticC := controllers.NewStatic()
-	usersC := controllers.NewUsers(services.User)
-	galleriesC := controllers.NewGalleries(services.Gallery)
-	requireUserMw := middleware.RequireUser{UserService: services.User}
+	usersC := controllers.NewUsers(services.User, services.Login)
+	loginLinksC := controllers.NewLoginLinks(services.LoginLink, usersC, mailer, *baseURL)
+	galleriesC := controllers.NewGalleries(services.Gallery, services.Image, services.User)
+	shareLinksC := controllers.NewShareLinks(services.ShareLink, galleriesC, *baseURL)
+	membersC := controllers.NewMembers(services.Member, galleriesC, mailer, *baseURL)
+	searchC := controllers.NewSearch(services.Search)
+	apiTokensC := controllers.NewAPITokens(services.APIToken)
+	oauthC := controllers.NewOAuth(services.OAuth)
+	accountC := controllers.NewAccount(services.User, services.LoginLink, mailer, *baseURL, *deletionGrace)
+	exportWorker := exports.NewWorker(services, mailer, strings.TrimSuffix(*baseURL, "/"))
+	go exportWorker.Run(context.Background())
+	exportsC := controllers.NewExports(services.Export, exportWorker)
+	healthC := controllers.NewHealth(services)
+	errorsC := controllers.NewErrors()
+	userMw := middleware.User{UserService: services.User, APITokens: services.APIToken, OAuth: services.OAuth}
+	requireUserMw := middleware.RequireUser{User: userMw}
+	localeMw := middleware.Locale{}
+	requestIDMw := middleware.RequestID{}
+	recoverMw := middleware.Recover{ErrorHandler: errorsC.InternalError}
+	registerServiceMetrics(services)
+	go purge(services, time.Hour)
 
 	r := mux.NewRouter()
+	r.NotFoundHandler = http.HandlerFunc(errorsC.NotFound)
+	r.MethodNotAllowedHandler = http.HandlerFunc(errorsC.MethodNotAllowed)
+	metricsMw := middleware.Metrics{Router: r}
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+	r.HandleFunc("/healthz", healthC.Live).Methods("GET")
+	r.HandleFunc("/readyz", healthC.Ready).Methods("GET")
+	r.PathPrefix("/assets/").Handler(http.StripPrefix("/assets/", assetsSrv)).Methods("GET")
 	r.Handle("/", staticC.Home).Methods("GET")
 	r.Handle("/contact", staticC.Contact).Methods("GET")
 	r.HandleFunc("/signup", usersC.New).Methods("GET")
 	r.HandleFunc("/signup", usersC.Create).Methods("POST")
-	r.Handle("/login", usersC.LoginView).Methods("GET")
+	r.HandleFunc("/login", usersC.ShowLogin).Methods("GET")
 	r.HandleFunc("/login", usersC.Login).Methods("POST")
+	r.HandleFunc("/login/link", loginLinksC.Create).Methods("POST")
+	r.HandleFunc("/login/link", loginLinksC.Confirm).Methods("GET")
+	r.HandleFunc("/login/link/confirm", loginLinksC.SignIn).Methods("POST")
+	r.HandleFunc("/logout", requireUserMw.ApplyFn(usersC.Logout)).Methods("POST")
+	r.HandleFunc("/locale", usersC.SetLocale).Methods("POST")
 	r.HandleFunc("/cookietest", usersC.CookieTest).Methods("GET")
 
 	// Gallery Routes
+	r.HandleFunc("/galleries", requireUserMw.ApplyFn(galleriesC.Index)).Methods("GET")
 	r.Handle("/galleries/new", requireUserMw.Apply(galleriesC.New)).Methods("GET")
 	r.HandleFunc("/galleries", requireUserMw.ApplyFn(galleriesC.Create)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/update", requireUserMw.ApplyFn(galleriesC.Update)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images", requireUserMw.ApplyFn(galleriesC.Upload)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/order", requireUserMw.ApplyFn(galleriesC.Reorder)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/update", requireUserMw.ApplyFn(galleriesC.UpdateImage)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete", requireUserMw.ApplyFn(galleriesC.DeleteImage)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/cover", requireUserMw.ApplyFn(galleriesC.SetCover)).Methods("POST")
+	// Visibility is checked by the handlers, public and unlisted
+	// galleries don't require signing in
+	r.HandleFunc("/galleries/{id:[0-9]+}", galleriesC.Show).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/download", galleriesC.Download).Methods("GET")
+	r.HandleFunc("/g/{slug}", galleriesC.Show).Methods("GET")
+	r.HandleFunc("/g/{slug}/download", galleriesC.Download).Methods("GET")
+	r.HandleFunc("/users/{id:[0-9]+}", galleriesC.Profile).Methods("GET")
+
+	r.HandleFunc("/galleries/{id:[0-9]+}/share", requireUserMw.ApplyFn(shareLinksC.Index)).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/share", requireUserMw.ApplyFn(shareLinksC.Create)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/share/{link:[0-9]+}/revoke", requireUserMw.ApplyFn(shareLinksC.Revoke)).Methods("POST")
+
+	r.HandleFunc("/galleries/{id:[0-9]+}/members", requireUserMw.ApplyFn(membersC.Index)).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/members", requireUserMw.ApplyFn(membersC.Invite)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/members/{member:[0-9]+}/delete", requireUserMw.ApplyFn(membersC.Remove)).Methods("POST")
+	r.HandleFunc("/invites", requireUserMw.ApplyFn(membersC.Invites)).Methods("GET")
+	r.HandleFunc("/invites/{id:[0-9]+}/accept", requireUserMw.ApplyFn(membersC.Accept)).Methods("POST")
+	r.HandleFunc("/invites/{id:[0-9]+}/decline", requireUserMw.ApplyFn(membersC.Decline)).Methods("POST")
+
+	// Viewers of share links don't have an account
+	r.HandleFunc("/s/{token}", shareLinksC.Show).Methods("GET")
+	r.HandleFunc("/s/{token}", shareLinksC.Unlock).Methods("POST")
+	r.HandleFunc("/s/{token}/images/{filename}", shareLinksC.Image).Methods("GET")
+	r.HandleFunc("/s/{token}/download", shareLinksC.Download).Methods("GET")
+
+	// Visitors who aren't signed in only find public galleries
+	r.HandleFunc("/search", searchC.Index).Methods("GET")
+
+	// Settings Routes
+	r.HandleFunc("/settings/tokens", requireUserMw.ApplyFn(apiTokensC.Index)).Methods("GET")
+	r.HandleFunc("/settings/tokens", requireUserMw.ApplyFn(apiTokensC.Create)).Methods("POST")
+	r.HandleFunc("/settings/tokens/{id:[0-9]+}/delete", requireUserMw.ApplyFn(apiTokensC.Delete)).Methods("POST")
+
+	r.HandleFunc("/settings/account", requireUserMw.ApplyFn(accountC.Edit)).Methods("GET")
+	r.HandleFunc("/settings/account/delete", requireUserMw.ApplyFn(accountC.Delete)).Methods("POST")
+	r.HandleFunc("/settings/account/delete", requireUserMw.ApplyFn(accountC.ConfirmDelete)).Methods("GET")
+	r.HandleFunc("/settings/account/delete/confirm", requireUserMw.ApplyFn(accountC.DeleteConfirmed)).Methods("POST")
+	r.HandleFunc("/settings/account/restore", requireUserMw.ApplyFn(accountC.Restore)).Methods("POST")
+
+	r.HandleFunc("/settings/export", requireUserMw.ApplyFn(exportsC.Index)).Methods("GET")
+	r.HandleFunc("/settings/export", requireUserMw.ApplyFn(exportsC.Create)).Methods("POST")
+	r.HandleFunc("/settings/export/{id:[0-9]+}", requireUserMw.ApplyFn(exportsC.Download)).Methods("GET")
+
+	r.HandleFunc("/settings/apps", requireUserMw.ApplyFn(oauthC.Apps)).Methods("GET")
+	r.HandleFunc("/settings/apps", requireUserMw.ApplyFn(oauthC.CreateApp)).Methods("POST")
+	r.HandleFunc("/settings/apps/{id:[0-9]+}/delete", requireUserMw.ApplyFn(oauthC.DeleteApp)).Methods("POST")
+	r.HandleFunc("/settings/apps/authorized/{id:[0-9]+}/revoke", requireUserMw.ApplyFn(oauthC.RevokeApp)).Methods("POST")
+
+	// Sign in with an OpenID Connect provider
+	if *oidcIssuer != "" {
+		const prefix = "/auth/oidc"
+		provider, err := oidc.Discover(context.Background(), oidc.Config{
+			Issuer:       *oidcIssuer,
+			ClientID:     *oidcClientID,
+			ClientSecret: *oidcClientSecret,
+			RedirectURL:  strings.TrimSuffix(*baseURL, "/") + prefix + "/callback",
+		})
+		must(err)
+		oidcC := controllers.NewOIDC(*oidcName, prefix, provider, usersC, services.Identity)
+		r.HandleFunc(prefix+"/login", oidcC.Login).Methods("GET")
+		r.HandleFunc(prefix+"/callback", oidcC.Callback).Methods("GET")
+	}
+
+	// OAuth2 authorization server
+	r.HandleFunc("/oauth/authorize", requireUserMw.ApplyFn(oauthC.Authorize)).Methods("GET")
+	r.HandleFunc("/oauth/authorize", requireUserMw.ApplyFn(oauthC.Approve)).Methods("POST")
+	r.HandleFunc("/oauth/token", oauthC.Token).Methods("POST")
+
+	// Image Routes
+	r.HandleFunc("/images/galleries/{id:[0-9]+}/{filename}", galleriesC.Image).Methods("GET")
+	r.HandleFunc("/g/{slug}/images/{filename}", galleriesC.Image).Methods("GET")
+
+	// JSON API
+	api.NewRouter(r, services)
 
 	fmt.Println("Starting the server on :3000...")
-	http.ListenAndServe(":3000", r)
+	// userMw and localeMw run on every request, including the 404
+	// and 405 pages, so that the navbar knows who is signed in and
+	// which language to use
+	http.ListenAndServe(":3000", requestIDMw.Apply(metricsMw.Apply(recoverMw.Apply(userMw.Apply(localeMw.Apply(r))))))
+
+}
 
+// registerServiceMetrics exposes gallery and image counts and
+// database pool statistics, computed at scrape time
+func registerServiceMetrics(services *models.Services) {
+	metrics.NewGaugeFunc("lenslocked_galleries", "Number of galleries.", func() float64 {
+		n, err := services.Gallery.Count()
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(n)
+	})
+	metrics.NewGaugeFunc("lenslocked_images", "Number of images.", func() float64 {
+		n, err := services.Image.Count()
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(n)
+	})
+	metrics.NewGaugeFunc("lenslocked_db_open_connections", "Established database connections, in use and idle.", func() float64 {
+		return float64(services.DBStats().OpenConnections)
+	})
+	metrics.NewGaugeFunc("lenslocked_db_in_use_connections", "Database connections currently in use.", func() float64 {
+		return float64(services.DBStats().InUse)
+	})
+	metrics.NewGaugeFunc("lenslocked_db_idle_connections", "Idle database connections.", func() float64 {
+		return float64(services.DBStats().Idle)
+	})
+	metrics.NewGaugeFunc("lenslocked_db_max_open_connections", "Maximum number of open database connections.", func() float64 {
+		return float64(services.DBStats().MaxOpenConnections)
+	})
+	metrics.NewGaugeFunc("lenslocked_db_wait_count", "Total number of connections waited for.", func() float64 {
+		return float64(services.DBStats().WaitCount)
+	})
+	metrics.NewGaugeFunc("lenslocked_db_wait_duration_seconds", "Total time blocked waiting for a new connection.", func() float64 {
+		return services.DBStats().WaitDuration.Seconds()
+	})
+}
+
+// purge deletes the accounts whose grace period ended and the
+// expired data exports, now and then every interval
+func purge(services *models.Services, interval time.Duration) {
+	for {
+		n, err := services.PurgeUsers()
+		if err != nil {
+			log.Println("purge users:", err)
+		}
+		if n > 0 {
+			log.Printf("purged %d users", n)
+		}
+		n, err = services.PurgeExports()
+		if err != nil {
+			log.Println("purge exports:", err)
+		} else if n > 0 {
+			log.Printf("purged %d exports", n)
+		}
+		time.Sleep(interval)
+	}
 }
 
 func must(err error) {
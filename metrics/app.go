@@ -0,0 +1,30 @@
+package metrics
+
+// Application metrics exposed on /metrics
+var (
+	// HTTPRequests counts handled requests by method, mux route
+	// template and response status code
+	HTTPRequests = NewCounter("lenslocked_http_requests_total",
+		"Total number of HTTP requests handled.",
+		"method", "route", "code")
+
+	// HTTPDuration observes request latency by method and mux route template
+	HTTPDuration = NewHistogram("lenslocked_http_request_duration_seconds",
+		"HTTP request latency in seconds.",
+		nil, "method", "route")
+
+	// Logins counts login attempts, labeled with result
+	// "success" or "failure"
+	Logins = NewCounter("lenslocked_logins_total",
+		"Total number of login attempts by result.",
+		"result")
+
+	// Signups counts accounts created through the signup form
+	Signups = NewCounter("lenslocked_signups_total",
+		"Total number of successful signups.")
+)
+
+const (
+	LoginSuccess = "success"
+	LoginFailure = "failure"
+)
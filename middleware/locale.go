@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/i18n"
+)
+
+// LocaleCookie remembers the language picked by visitors
+// that are not signed in
+const LocaleCookie = "locale"
+
+// Locale picks the language of the response and stores it in
+// the request context. The preference of the signed in user wins,
+// then the locale cookie, then the Accept-Language header.
+// It needs to run after the User middleware.
+type Locale struct{}
+
+func (mw *Locale) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *Locale) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithLocale(r.Context(), negotiateLocale(r))
+			next(w, r.WithContext(ctx))
+		})
+}
+
+func negotiateLocale(r *http.Request) string {
+	if user := context.User(r.Context()); user != nil && i18n.IsSupported(user.Locale) {
+		return user.Locale
+	}
+	if cookie, err := r.Cookie(LocaleCookie); err == nil && i18n.IsSupported(cookie.Value) {
+		return cookie.Value
+	}
+	if locale := i18n.Negotiate(r.Header.Get("Accept-Language")); locale != "" {
+		return locale
+	}
+	return i18n.DefaultLocale
+}
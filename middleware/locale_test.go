@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/models"
+)
+
+func TestLocale(t *testing.T) {
+	var mw Locale
+	var got string
+	handler := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		got = context.Locale(r.Context())
+	})
+
+	tests := []struct {
+		name           string
+		user           *models.User
+		cookie         string
+		acceptLanguage string
+		want           string
+	}{
+		{"default", nil, "", "", "en"},
+		{"header", nil, "", "de-CH,de;q=0.9,en;q=0.8", "de"},
+		{"highest q wins", nil, "", "en;q=0.5,de;q=0.8", "de"},
+		{"equal q keeps order", nil, "", "de;q=0.7,en;q=0.7", "de"},
+		{"unsupported skipped", nil, "", "fr-FR,fr;q=0.9,de;q=0.5", "de"},
+		{"q=0 excluded", nil, "", "de;q=0,en;q=0.1", "en"},
+		{"none supported", nil, "", "fr,ja;q=0.9", "en"},
+		{"malformed", nil, "", ";;,de;q=abc", "de"},
+		{"cookie over header", nil, "de", "en", "de"},
+		{"unsupported cookie", nil, "fr", "de", "de"},
+		{"user over cookie", &models.User{Locale: "en"}, "de", "de", "en"},
+		{"user without preference", &models.User{}, "", "de", "de"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.acceptLanguage != "" {
+			req.Header.Set("Accept-Language", tt.acceptLanguage)
+		}
+		if tt.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: LocaleCookie, Value: tt.cookie})
+		}
+		if tt.user != nil {
+			req = req.WithContext(context.WithUser(req.Context(), tt.user))
+		}
+		got = ""
+		handler(httptest.NewRecorder(), req)
+		if got != tt.want {
+			t.Errorf("%s: expected %q. Received %q", tt.name, tt.want, got)
+		}
+	}
+}
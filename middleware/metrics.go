@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/metrics"
+	"github.com/gorilla/mux"
+)
+
+// Metrics records request counts and latencies per
+// gorilla/mux route template of Router
+type Metrics struct {
+	Router *mux.Router
+}
+
+// Apply is meant to wrap the whole router, rather than being
+// registered with mux.Router.Use which only runs for matched
+// routes, so that not found pages and recovered panics are counted
+func (mw *Metrics) Apply(next http.Handler) http.Handler {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *Metrics) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+			next(sw, r)
+
+			route := mw.routeTemplate(r)
+			metrics.HTTPRequests.Inc(r.Method, route, strconv.Itoa(sw.status))
+			metrics.HTTPDuration.Observe(time.Since(start).Seconds(), r.Method, route)
+		})
+}
+
+// routeTemplate returns the path template of the route matching
+// r, eg. "/galleries/{id}", to keep label cardinality bounded. The
+// router only sets the current route on its own copy of r, so the
+// route is matched again.
+func (mw *Metrics) routeTemplate(r *http.Request) string {
+	var match mux.RouteMatch
+	if !mw.Router.Match(r, &match) || match.MatchErr != nil || match.Route == nil {
+		return "unmatched"
+	}
+	route := match.Route
+	tpl, err := route.GetPathTemplate()
+	if err != nil {
+		return "unknown"
+	}
+	return tpl
+}
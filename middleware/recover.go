@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/apigban/lenslocked_v1/context"
+)
+
+// Recover turns a panic in any handler into a logged stack trace
+// and a 500 response rendered by ErrorHandler, instead of a
+// dropped connection.
+type Recover struct {
+	// ErrorHandler renders the error page. It is only called if
+	// the panicking handler had not written a response yet.
+	ErrorHandler http.HandlerFunc
+}
+
+func (mw *Recover) Apply(next http.Handler) http.Handler {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *Recover) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			defer func() {
+				rec := recover()
+				if rec == nil {
+					return
+				}
+				// The net/http server uses this sentinel to abort a
+				// response silently, let it through.
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+				log.Printf("panic: %v request_id=%s method=%s path=%s\n%s",
+					rec, context.RequestID(r.Context()), r.Method, r.URL.Path, debug.Stack())
+
+				if sw.wroteHeader {
+					// Part of the response is already out, nothing
+					// sensible can be rendered anymore.
+					return
+				}
+				if mw.ErrorHandler == nil {
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+				mw.ErrorHandler(w, r)
+			}()
+
+			next(sw, r)
+		})
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/rand"
+)
+
+const (
+	RequestIDHeader = "X-Request-ID"
+
+	requestIDBytes = 12
+)
+
+// validRequestID limits what we accept from an upstream proxy
+// so that request IDs are safe to log
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._\-]{1,64}$`)
+
+// RequestID tags every request with an ID, reusing the one
+// set by an upstream proxy when present. The ID is stored in
+// the request context and echoed in the response headers.
+type RequestID struct{}
+
+func (mw *RequestID) Apply(next http.Handler) http.Handler {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *RequestID) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(RequestIDHeader)
+			if !validRequestID.MatchString(id) {
+				var err error
+				id, err = rand.String(requestIDBytes)
+				if err != nil {
+					id = "unknown"
+				}
+			}
+			w.Header().Set(RequestIDHeader, id)
+			ctx := context.WithRequestID(r.Context(), id)
+			next(w, r.WithContext(ctx))
+		})
+}
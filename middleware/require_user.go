@@ -1,35 +1,59 @@
 package middleware
 
 import (
-	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/apigban/lenslocked_v1/context"
 	"github.com/apigban/lenslocked_v1/models"
 )
 
-type RequireUser struct {
+// User looks up the user from the remember_token cookie, or from
+// an "Authorization: Bearer" API token or OAuth access token, and
+// if found stores it in the request context. Requests without valid credentials go
+// through untouched, see RequireUser to restrict access to signed
+// in users.
+type User struct {
 	models.UserService
+	APITokens models.APITokenService
+	OAuth     models.OAuthService
 }
 
-func (mw *RequireUser) Apply(next http.Handler) http.HandlerFunc {
+// apiTokenTouchInterval limits how often the last used time of
+// an API token is written, scripts may send many requests
+const apiTokenTouchInterval = time.Minute
+
+func (mw *User) Apply(next http.Handler) http.HandlerFunc {
 	return mw.ApplyFn(next.ServeHTTP)
 }
 
-func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			// Redirect user to Login page if cookie is not found
+			// User was already resolved further up the chain
+			if context.User(r.Context()) != nil {
+				next(w, r)
+				return
+			}
+
+			// A request with an Authorization header is never
+			// authenticated by its cookies
+			if token, ok := bearerToken(r); ok {
+				next(w, mw.withToken(r, token))
+				return
+			}
+
 			cookie, err := r.Cookie("remember_token")
 			if err != nil {
-				http.Redirect(w, r, "/login", http.StatusFound)
+				next(w, r)
 				return
 			}
-
-			// Redirect user to Login page if remember_token is not found
 			user, err := mw.ByRemember(cookie.Value)
 			if err != nil {
-				http.Redirect(w, r, "/login", http.StatusFound)
+				next(w, r)
 				return
 			}
 
@@ -38,8 +62,98 @@ func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 			ctx = context.WithUser(ctx, user) // update the current context with the user associated to remember_token
 			r = r.WithContext(ctx)            // update request to have the updated context
 
-			fmt.Println("User Found:", user)
+			next(w, r)
+		})
+}
+
+// withToken returns r with the token and its user in the
+// context, or r as is if the token isn't valid
+func (mw *User) withToken(r *http.Request, raw string) *http.Request {
+	var token models.ScopedToken
+	var userID uint
+	switch {
+	case strings.HasPrefix(raw, models.APITokenPrefix) && mw.APITokens != nil:
+		apiToken, err := mw.APITokens.ByToken(raw)
+		if err != nil {
+			return r
+		}
+		if apiToken.LastUsedAt == nil || time.Since(*apiToken.LastUsedAt) > apiTokenTouchInterval {
+			if err := mw.APITokens.Touch(apiToken); err != nil {
+				log.Println(err)
+			}
+		}
+		token, userID = apiToken, apiToken.UserID
+	case strings.HasPrefix(raw, models.OAuthAccessPrefix) && mw.OAuth != nil:
+		oauthToken, err := mw.OAuth.ByAccessToken(raw)
+		if err != nil {
+			return r
+		}
+		token, userID = oauthToken, oauthToken.UserID
+	default:
+		return r
+	}
+	user, err := mw.ByID(userID)
+	if err != nil {
+		return r
+	}
+	// Users deleting their account can still sign in to change
+	// their mind, their tokens stop working right away
+	if user.PurgeAt != nil {
+		return r
+	}
+	ctx := context.WithUser(r.Context(), user)
+	ctx = context.WithToken(ctx, token)
+	return r.WithContext(ctx)
+}
+
+// bearerToken returns the token of an "Authorization: Bearer"
+// header. ok is true if the request has an Authorization header
+// at all, even one we can't use.
+func bearerToken(r *http.Request) (token string, ok bool) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", false
+	}
+	const prefix = "bearer "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", true
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
+
+// RequireUser redirects to the login page unless the
+// request comes from a signed in user. Pages are for browsers,
+// requests authenticated with a token are forbidden so that a
+// leaked token can't be used to manage the account, eg. to
+// create more tokens.
+type RequireUser struct {
+	User
+}
+
+func (mw *RequireUser) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
 
+func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return mw.User.ApplyFn(
+		func(w http.ResponseWriter, r *http.Request) {
+			// Redirect user to Login page if no user was found
+			// from the remember_token
+			user := context.User(r.Context())
+			if user == nil {
+				// Pages can be returned to after signing in,
+				// form submissions can't
+				target := "/login"
+				if r.Method == http.MethodGet {
+					target += "?next=" + url.QueryEscape(r.URL.RequestURI())
+				}
+				http.Redirect(w, r, target, http.StatusFound)
+				return
+			}
+			if context.Token(r.Context()) != nil {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
 			next(w, r)
 		})
 }
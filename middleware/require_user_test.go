@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/models"
+	"github.com/jinzhu/gorm"
+)
+
+// fakeUsers knows users by ID, and by their remember token
+type fakeUsers struct {
+	models.UserService
+	users    map[uint]*models.User
+	remember map[string]uint
+}
+
+func (fu *fakeUsers) ByID(id uint) (*models.User, error) {
+	if user, ok := fu.users[id]; ok {
+		return user, nil
+	}
+	return nil, models.ErrNotFound
+}
+
+func (fu *fakeUsers) ByRemember(token string) (*models.User, error) {
+	return fu.ByID(fu.remember[token])
+}
+
+// fakeAPITokens knows tokens by their raw value. Like the real
+// service it treats revoked, ie. deleted, and expired tokens as
+// missing.
+type fakeAPITokens struct {
+	models.APITokenService
+	tokens  map[string]*models.APIToken
+	revoked map[string]bool
+}
+
+func (ft *fakeAPITokens) ByToken(token string) (*models.APIToken, error) {
+	apiToken, ok := ft.tokens[token]
+	if !ok || ft.revoked[token] || apiToken.Expired() {
+		return nil, models.ErrNotFound
+	}
+	return apiToken, nil
+}
+
+func (ft *fakeAPITokens) Touch(token *models.APIToken) error {
+	now := time.Now()
+	token.LastUsedAt = &now
+	return nil
+}
+
+func TestUserBearerToken(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	users := &fakeUsers{
+		users: map[uint]*models.User{
+			1: {Model: gorm.Model{ID: 1}},
+			2: {Model: gorm.Model{ID: 2}, PurgeAt: &past},
+		},
+		remember: map[string]uint{"cookie": 1},
+	}
+	tokens := &fakeAPITokens{
+		tokens: map[string]*models.APIToken{
+			"llk_valid":   {UserID: 1, Scopes: models.ScopeGalleriesRead},
+			"llk_expired": {UserID: 1, Scopes: models.ScopeGalleriesRead, ExpiresAt: &past},
+			"llk_revoked": {UserID: 1, Scopes: models.ScopeGalleriesRead},
+			"llk_purging": {UserID: 2, Scopes: models.ScopeGalleriesRead},
+		},
+		revoked: map[string]bool{"llk_revoked": true},
+	}
+	mw := User{UserService: users, APITokens: tokens}
+
+	tests := []struct {
+		name          string
+		authorization string
+		cookie        string
+		wantUser      uint
+		wantToken     bool
+	}{
+		{"valid token", "Bearer llk_valid", "", 1, true},
+		{"lowercase scheme", "bearer llk_valid", "", 1, true},
+		{"expired token", "Bearer llk_expired", "", 0, false},
+		{"revoked token", "Bearer llk_revoked", "", 0, false},
+		{"unknown token", "Bearer llk_unknown", "", 0, false},
+		{"user being purged", "Bearer llk_purging", "", 0, false},
+		{"other scheme ignores cookie", "Basic dXNlcjpwYXNz", "cookie", 0, false},
+		{"invalid token ignores cookie", "Bearer llk_unknown", "cookie", 0, false},
+		{"cookie", "", "cookie", 1, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		if tt.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "remember_token", Value: tt.cookie})
+		}
+		var gotUser uint
+		var gotToken bool
+		mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+			if user := context.User(r.Context()); user != nil {
+				gotUser = user.ID
+			}
+			gotToken = context.Token(r.Context()) != nil
+		})(httptest.NewRecorder(), req)
+		if gotUser != tt.wantUser || gotToken != tt.wantToken {
+			t.Errorf("%s: expected user %d and token %v. Received user %d and token %v",
+				tt.name, tt.wantUser, tt.wantToken, gotUser, gotToken)
+		}
+	}
+	if tokens.tokens["llk_valid"].LastUsedAt == nil {
+		t.Error("Expected the last use of the token to be recorded")
+	}
+}
+
+func TestRequireUser(t *testing.T) {
+	users := &fakeUsers{
+		users:    map[uint]*models.User{1: {Model: gorm.Model{ID: 1}}},
+		remember: map[string]uint{"cookie": 1},
+	}
+	tokens := &fakeAPITokens{
+		tokens: map[string]*models.APIToken{
+			"llk_valid": {UserID: 1, Scopes: models.ScopeGalleriesRead},
+		},
+	}
+	mw := RequireUser{User{UserService: users, APITokens: tokens}}
+	handler := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name          string
+		authorization string
+		cookie        string
+		want          int
+	}{
+		{"signed in", "", "cookie", http.StatusOK},
+		{"api token", "Bearer llk_valid", "", http.StatusForbidden},
+		{"api token with cookie", "Bearer llk_valid", "cookie", http.StatusForbidden},
+		{"anonymous", "", "", http.StatusFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/galleries", nil)
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		if tt.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "remember_token", Value: tt.cookie})
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: expected %d. Received %d", tt.name, tt.want, rec.Code)
+		}
+	}
+}
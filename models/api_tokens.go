@@ -0,0 +1,275 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/hash"
+	"github.com/apigban/lenslocked_v1/rand"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// APITokenPrefix makes tokens easy to recognize, eg. by
+	// secret scanners, and is not part of the random bytes
+	APITokenPrefix = "llk_"
+
+	apiTokenBytes = 32
+)
+
+// Scopes an API token can be granted
+const (
+	ScopeProfileRead    = "profile:read"
+	ScopeGalleriesRead  = "galleries:read"
+	ScopeGalleriesWrite = "galleries:write"
+	ScopeImagesWrite    = "images:write"
+)
+
+// Scopes lists every scope an API token can be granted
+var Scopes = []string{
+	ScopeProfileRead,
+	ScopeGalleriesRead,
+	ScopeGalleriesWrite,
+	ScopeImagesWrite,
+}
+
+// ScopedToken is a credential limited to some scopes, like an
+// APIToken or an OAuthToken
+type ScopedToken interface {
+	HasScope(scope string) bool
+}
+
+// normalizeScopes checks that the space separated scopes are
+// all known, and that there is at least one of them
+func normalizeScopes(scopes string) (string, error) {
+	list := strings.Fields(scopes)
+	if len(list) == 0 {
+		return "", ErrScopeRequired
+	}
+	for _, s := range list {
+		if !IsScope(s) {
+			return "", ErrScopeInvalid
+		}
+	}
+	return strings.Join(list, " "), nil
+}
+
+// IsScope reports whether scope is one of Scopes
+func IsScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func hasScope(scopes, scope string) bool {
+	for _, s := range strings.Fields(scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APIToken lets scripts authenticate as a user through the
+// Authorization: Bearer header. Only the HMAC of the token is
+// stored, the token itself is shown once when it is created.
+type APIToken struct {
+	gorm.Model
+	UserID     uint   `gorm:"not null;index"`
+	Name       string `gorm:"not null"`
+	Token      string `gorm:"-"` //not going to be stored in the database
+	TokenHash  string `gorm:"not null;unique_index"`
+	Scopes     string `gorm:"not null"` // space separated
+	LastUsedAt *time.Time
+	ExpiresAt  *time.Time
+}
+
+// ScopeList returns the scopes granted to the token
+func (t *APIToken) ScopeList() []string {
+	return strings.Fields(t.Scopes)
+}
+
+// HasScope reports whether the token was granted scope
+func (t *APIToken) HasScope(scope string) bool {
+	return hasScope(t.Scopes, scope)
+}
+
+// Expired reports whether the token can't be used anymore
+func (t *APIToken) Expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+// APITokenService is a set of methods used to manipulate
+// and work with the API token model
+type APITokenService interface {
+	APITokenDB
+}
+
+// APITokenDB is used to interact with the api_tokens table
+type APITokenDB interface {
+	// ByToken looks up an unexpired token from the raw value
+	// sent by a client
+	ByToken(token string) (*APIToken, error)
+	ByUserID(userID uint) ([]APIToken, error)
+
+	// Create generates a new token, the raw value is only
+	// available in the Token field after this call
+	Create(token *APIToken) error
+	// Touch records that the token was just used
+	Touch(token *APIToken) error
+	// Delete revokes the token with the provided ID, as long
+	// as it belongs to the user with the provided ID
+	Delete(id, userID uint) error
+}
+
+func NewAPITokenService(db *gorm.DB) APITokenService {
+	return &apiTokenService{
+		APITokenDB: &apiTokenValidator{
+			APITokenDB: &apiTokenGorm{db},
+			hmac:       hash.NewHMAC(hmacSecretKey),
+		},
+	}
+}
+
+type apiTokenService struct {
+	APITokenDB
+}
+
+var _ APITokenDB = &apiTokenValidator{}
+
+type apiTokenValidator struct {
+	APITokenDB
+	hmac hash.HMAC
+}
+
+// ByToken hashes the token before looking it up and treats
+// expired tokens as missing
+func (tv *apiTokenValidator) ByToken(token string) (*APIToken, error) {
+	if !strings.HasPrefix(token, APITokenPrefix) {
+		return nil, ErrNotFound
+	}
+	apiToken, err := tv.APITokenDB.ByToken(tv.hmac.Hash(token))
+	if err != nil {
+		return nil, err
+	}
+	if apiToken.Expired() {
+		return nil, ErrNotFound
+	}
+	return apiToken, nil
+}
+
+func (tv *apiTokenValidator) Create(token *APIToken) error {
+	err := collectValFuncs(token,
+		tv.nameRequired,
+		tv.scopesValid)
+	if err != nil {
+		return err
+	}
+	err = runAPITokenValFuncs(token,
+		tv.userIDRequired,
+		tv.generateToken,
+		tv.hmacToken)
+	if err != nil {
+		return err
+	}
+	return tv.APITokenDB.Create(token)
+}
+
+func (tv *apiTokenValidator) userIDRequired(t *APIToken) error {
+	if t.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (tv *apiTokenValidator) nameRequired(t *APIToken) error {
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" {
+		return ErrNameRequired
+	}
+	return nil
+}
+
+func (tv *apiTokenValidator) scopesValid(t *APIToken) error {
+	scopes, err := normalizeScopes(t.Scopes)
+	if err != nil {
+		return err
+	}
+	t.Scopes = scopes
+	return nil
+}
+
+func (tv *apiTokenValidator) generateToken(t *APIToken) error {
+	token, err := rand.String(apiTokenBytes)
+	if err != nil {
+		return err
+	}
+	t.Token = APITokenPrefix + token
+	return nil
+}
+
+func (tv *apiTokenValidator) hmacToken(t *APIToken) error {
+	t.TokenHash = tv.hmac.Hash(t.Token)
+	return nil
+}
+
+var _ APITokenDB = &apiTokenGorm{}
+
+type apiTokenGorm struct {
+	db *gorm.DB
+}
+
+// ByToken expects the token to be hashed
+func (tg *apiTokenGorm) ByToken(tokenHash string) (*APIToken, error) {
+	var token APIToken
+	err := first(tg.db.Where("token_hash = ?", tokenHash), &token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (tg *apiTokenGorm) ByUserID(userID uint) ([]APIToken, error) {
+	var tokens []APIToken
+	err := tg.db.Where("user_id = ?", userID).Order("created_at desc").Find(&tokens).Error
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (tg *apiTokenGorm) Create(token *APIToken) error {
+	return translateDBError(tg.db.Create(token).Error)
+}
+
+// Touch only updates last_used_at, leaving updated_at alone
+func (tg *apiTokenGorm) Touch(token *APIToken) error {
+	now := time.Now()
+	token.LastUsedAt = &now
+	return tg.db.Model(token).UpdateColumn("last_used_at", now).Error
+}
+
+func (tg *apiTokenGorm) Delete(id, userID uint) error {
+	db := tg.db.Where("id = ? AND user_id = ?", id, userID).Delete(&APIToken{})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type apiTokenValFunc func(*APIToken) error
+
+func runAPITokenValFuncs(token *APIToken, fns ...apiTokenValFunc) error {
+	for _, fn := range fns {
+		if err := fn(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/hash"
+)
+
+// tokensByHash is an APITokenDB knowing tokens by their hash
+type tokensByHash struct {
+	APITokenDB
+	tokens map[string]*APIToken
+}
+
+func (tb tokensByHash) ByToken(tokenHash string) (*APIToken, error) {
+	if token, ok := tb.tokens[tokenHash]; ok {
+		return token, nil
+	}
+	return nil, ErrNotFound
+}
+
+func TestAPITokenByToken(t *testing.T) {
+	hmac := hash.NewHMAC(hmacSecretKey)
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	tv := &apiTokenValidator{
+		APITokenDB: tokensByHash{tokens: map[string]*APIToken{
+			hmac.Hash("llk_valid"):    {},
+			hmac.Hash("llk_expiring"): {ExpiresAt: &future},
+			hmac.Hash("llk_expired"):  {ExpiresAt: &past},
+			hmac.Hash("other"):        {},
+		}},
+		hmac: hmac,
+	}
+	tests := []struct {
+		token string
+		want  error
+	}{
+		{"llk_valid", nil},
+		{"llk_expiring", nil},
+		{"llk_expired", ErrNotFound},
+		{"llk_unknown", ErrNotFound},
+		{"other", ErrNotFound},
+	}
+	for _, tt := range tests {
+		if _, err := tv.ByToken(tt.token); err != tt.want {
+			t.Errorf("%s: expected %v. Received %v", tt.token, tt.want, err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package models
+
+import "github.com/lib/pq"
+
+// Postgres error codes, see
+// https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	pqNotNullViolation pq.ErrorCode = "23502"
+	pqUniqueViolation  pq.ErrorCode = "23505"
+)
+
+// constraintErrors maps the name of a unique index, as created by
+// gorm's unique_index tag, to the error returned when it is violated
+var constraintErrors = map[string]error{
+	"uix_users_email_active":  ErrEmailTaken,
+	"uix_users_remember_hash": ErrRememberTaken,
+
+	"uix_identities_issuer_subject": ErrIdentityTaken,
+
+	"uix_gallery_members_gallery_email": ErrMemberTaken,
+}
+
+// notNullErrors maps "<table>.<column>" to the error returned
+// when a NULL is inserted in that column
+var notNullErrors = map[string]error{
+	"users.email":         ErrEmailRequired,
+	"users.password_hash": ErrPasswordRequired,
+	"users.remember_hash": ErrRememberRequired,
+	"galleries.user_id":   ErrUserIDRequired,
+	"galleries.title":     ErrTitleRequired,
+	"api_tokens.name":     ErrNameRequired,
+	"api_tokens.user_id":  ErrUserIDRequired,
+	"login_links.email":   ErrEmailRequired,
+
+	"share_links.gallery_id": ErrGalleryIDRequired,
+
+	"gallery_members.gallery_id": ErrGalleryIDRequired,
+	"gallery_members.email":      ErrEmailRequired,
+
+	"images.gallery_id": ErrGalleryIDRequired,
+}
+
+// translateDBError converts constraint violations raised by Postgres
+// into model errors. Validators catch these cases ahead of time, but
+// can't prevent races like two signups with the same email address.
+// Any other error is returned as is.
+func translateDBError(err error) error {
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return err
+	}
+	switch pqErr.Code {
+	case pqUniqueViolation:
+		if e, ok := constraintErrors[pqErr.Constraint]; ok {
+			return e
+		}
+	case pqNotNullViolation:
+		if e, ok := notNullErrors[pqErr.Table+"."+pqErr.Column]; ok {
+			return e
+		}
+	}
+	return err
+}
@@ -1,6 +1,10 @@
 package models
 
-import "strings"
+import (
+	"strings"
+
+	"github.com/apigban/lenslocked_v1/i18n"
+)
 
 const (
 	// ErrNotFound is returned when a resource is not found in the database
@@ -29,6 +33,69 @@ const (
 
 	ErrTitleRequired modelError = "models: title is required"
 
+	// ErrImageRequired is returned when an upload contains no image
+	ErrImageRequired modelError = "models: at least one image is required"
+
+	// ErrImageInvalid is returned when an uploaded file is not
+	// one of the supported image formats
+	ErrImageInvalid modelError = "models: only jpg, png and gif images are supported"
+
+	// ErrImageOrderInvalid is returned when images are reordered
+	// without listing every image of the gallery exactly once
+	ErrImageOrderInvalid modelError = "models: the order must list every image of the gallery once"
+
+	// ErrNameRequired is returned when a named resource,
+	// like an API token, is created without a name
+	ErrNameRequired modelError = "models: name is required"
+
+	// ErrScopeRequired is returned when an API token is
+	// created without any scope
+	ErrScopeRequired modelError = "models: at least one scope is required"
+
+	// ErrScopeInvalid is returned when an API token is
+	// created with a scope we don't know about
+	ErrScopeInvalid modelError = "models: scope provided is invalid"
+
+	// ErrRedirectURIRequired is returned when an OAuth client
+	// is registered without a redirect URI
+	ErrRedirectURIRequired modelError = "models: at least one redirect URI is required"
+
+	// ErrRedirectURIInvalid is returned when a redirect URI of an
+	// OAuth client isn't an absolute https URL
+	ErrRedirectURIInvalid modelError = "models: redirect URI provided is invalid"
+
+	// ErrVisibilityInvalid is returned when a gallery is saved
+	// with a visibility other than the Visibility constants
+	ErrVisibilityInvalid modelError = "models: visibility provided is invalid"
+
+	// ErrMaxViewsInvalid is returned when a share link is
+	// created with a negative number of views
+	ErrMaxViewsInvalid modelError = "models: max views can't be negative"
+
+	// ErrExpiryInvalid is returned when a share link is created
+	// with a lifetime other than the ones offered
+	ErrExpiryInvalid modelError = "models: expiry provided is invalid"
+
+	// ErrRoleInvalid is returned when a gallery member is invited
+	// with a role other than the Role constants
+	ErrRoleInvalid modelError = "models: role provided is invalid"
+
+	// ErrMemberTaken is returned when an email address is invited
+	// to a gallery it is already a member of
+	ErrMemberTaken modelError = "models: email address is already a member of the gallery"
+
+	// ErrInviteTokenInvalid is returned when an invite is accepted
+	// without the token emailed with it
+	ErrInviteTokenInvalid modelError = "models: open the link in the invite email to accept it"
+
+	// ErrTagInvalid is returned when a gallery or image is tagged
+	// with a tag longer than 50 characters
+	ErrTagInvalid modelError = "models: tags can't be longer than 50 characters"
+
+	// ErrForbidden is returned when a user may see a resource,
+	// but not take the action they attempted on it
+	ErrForbidden modelError = "models: you are not allowed to do this"
+
 	// ErrIDInvalid is returned when an invalid ID is provided to a method like Delete()
 	ErrIDInvalid privateError = "models: ID provided was invalid"
 
@@ -39,23 +106,148 @@ const (
 	// without a user remember token hash
 	ErrRememberRequired privateError = "models: remember token is required"
 
+	// ErrRememberTaken is returned when a remember token hash
+	// collides with the one of another user
+	ErrRememberTaken privateError = "models: remember token is already in use"
+
 	ErrUserIDRequired privateError = "models: user ID is required"
+
+	// ErrGalleryIDRequired is returned when a resource that belongs
+	// to a gallery, like a share link, is created without one
+	ErrGalleryIDRequired privateError = "models: gallery ID is required"
+
+	// ErrIdentityRequired is returned when an identity is
+	// created without an issuer or subject
+	ErrIdentityRequired privateError = "models: identity issuer and subject are required"
+
+	// ErrIdentityTaken is returned when an identity at a
+	// provider is already linked to a user
+	ErrIdentityTaken privateError = "models: identity is already linked"
+)
+
+// ErrorKind classifies errors returned by the models package,
+// see Kind
+type ErrorKind int
+
+const (
+	// KindInternal is any unexpected error, eg. a database
+	// failure or a privateError
+	KindInternal ErrorKind = iota
+	// KindInvalid means the provided data didn't pass validation
+	KindInvalid
+	// KindNotFound means the requested resource doesn't exist
+	KindNotFound
+	// KindConflict means the data conflicts with an existing
+	// resource, eg. an email address that is already taken
+	KindConflict
+	// KindForbidden means the user isn't allowed to take the
+	// action, see GalleryService.Authorize
+	KindForbidden
 )
 
+// Kind returns what kind of failure err is
+func Kind(err error) ErrorKind {
+	switch e := err.(type) {
+	case ValidationError:
+		if len(e) == 1 {
+			return Kind(e[0])
+		}
+		return KindInvalid
+	case modelError:
+		switch e {
+		case ErrNotFound:
+			return KindNotFound
+		case ErrEmailTaken, ErrMemberTaken:
+			return KindConflict
+		case ErrForbidden:
+			return KindForbidden
+		}
+		return KindInvalid
+	}
+	return KindInternal
+}
+
 type modelError string
 
 func (e modelError) Error() string {
 	return string(e)
 }
 
-// Public modifies an error to be publicly displayed.
-// Capitalizes the first character of the string
-// after prefix is trimmed
+// errorCodes identify public errors in the i18n message
+// catalogs, under the "error.<code>" key
+var errorCodes = map[modelError]string{
+	ErrNotFound:          "not_found",
+	ErrPasswordIncorrect: "password_incorrect",
+	ErrEmailRequired:     "email_required",
+	ErrEmailInvalid:      "email_invalid",
+	ErrEmailTaken:        "email_taken",
+	ErrPasswordTooShort:  "password_too_short",
+	ErrPasswordRequired:  "password_required",
+	ErrTitleRequired:     "title_required",
+	ErrImageRequired:     "image_required",
+	ErrImageInvalid:      "image_invalid",
+	ErrNameRequired:      "name_required",
+	ErrScopeRequired:     "scope_required",
+	ErrScopeInvalid:      "scope_invalid",
+
+	ErrRedirectURIRequired: "redirect_uri_required",
+	ErrRedirectURIInvalid:  "redirect_uri_invalid",
+	ErrVisibilityInvalid:   "visibility_invalid",
+	ErrMaxViewsInvalid:     "max_views_invalid",
+	ErrExpiryInvalid:       "expiry_invalid",
+	ErrRoleInvalid:         "role_invalid",
+	ErrMemberTaken:         "member_taken",
+	ErrInviteTokenInvalid:  "invite_token_invalid",
+	ErrForbidden:           "forbidden",
+	ErrImageOrderInvalid:   "image_order_invalid",
+	ErrTagInvalid:          "tag_invalid",
+}
+
+// Code returns the stable identifier of the error, used
+// to look up its translations
+func (e modelError) Code() string {
+	return errorCodes[e]
+}
+
+// Public returns the message displayed to end users, in the
+// default locale. See the i18n package for other locales.
 func (e modelError) Public() string {
-	s := strings.Replace(string(e), "models: ", "", 1)
-	split := strings.Split(s, " ")
-	split[0] = strings.Title(split[0])
-	return strings.Join(split, " ")
+	if msg, ok := i18n.Lookup(i18n.DefaultLocale, "error."+e.Code()); ok {
+		return msg
+	}
+	return strings.Replace(string(e), "models: ", "", 1)
+}
+
+// Field returns the name of the form field an error is
+// about, or an empty string if it isn't about a single field
+func (e modelError) Field() string {
+	switch e {
+	case ErrEmailRequired, ErrEmailInvalid, ErrEmailTaken, ErrMemberTaken:
+		return "email"
+	case ErrPasswordIncorrect, ErrPasswordTooShort, ErrPasswordRequired:
+		return "password"
+	case ErrTitleRequired:
+		return "title"
+	case ErrImageRequired, ErrImageInvalid:
+		return "images"
+	case ErrNameRequired:
+		return "name"
+	case ErrScopeRequired, ErrScopeInvalid:
+		return "scopes"
+	case ErrRedirectURIRequired, ErrRedirectURIInvalid:
+		return "redirect_uris"
+	case ErrVisibilityInvalid:
+		return "visibility"
+	case ErrMaxViewsInvalid:
+		return "max_views"
+	case ErrExpiryInvalid:
+		return "expires_in"
+	case ErrRoleInvalid:
+		return "role"
+	case ErrTagInvalid:
+		return "tags"
+	}
+	return ""
 }
 
 type privateError string
@@ -63,3 +255,77 @@ type privateError string
 func (e privateError) Error() string {
 	return string(e)
 }
+
+// ValidationError collects every public failure found while
+// validating a resource, so they can all be reported at once
+type ValidationError []error
+
+func (ve ValidationError) Error() string {
+	msgs := make([]string, len(ve))
+	for i, err := range ve {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Public joins the public message of every failure
+func (ve ValidationError) Public() string {
+	msgs := make([]string, 0, len(ve))
+	for _, err := range ve {
+		if pub, ok := err.(publicError); ok {
+			msgs = append(msgs, pub.Public())
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Errors returns the individual failures
+func (ve ValidationError) Errors() []error {
+	return ve
+}
+
+// Unwrap allows errors.Is to match any of the failures
+func (ve ValidationError) Unwrap() []error {
+	return ve
+}
+
+// publicError is implemented by errors that are safe
+// to be displayed to the end user
+type publicError interface {
+	error
+	Public() string
+}
+
+// collectError adds err to errs if it can be shown to the end
+// user. Any other error is returned so validation stops there.
+func collectError(errs ValidationError, err error) (ValidationError, error) {
+	if _, ok := err.(publicError); !ok {
+		return errs, err
+	}
+	return append(errs, err), nil
+}
+
+// collectValFuncs runs every validation function and returns all
+// public failures as a ValidationError. A failure that isn't
+// public (eg. a database error) is returned right away.
+func collectValFuncs[T any](v T, fns ...func(T) error) error {
+	var errs ValidationError
+	for _, fn := range fns {
+		if err := fn(v); err != nil {
+			var stop error
+			if errs, stop = collectError(errs, err); stop != nil {
+				return stop
+			}
+		}
+	}
+	return errs.orNil()
+}
+
+// orNil returns nil when no failures were collected, so that
+// callers don't end up with a non-nil error interface
+func (ve ValidationError) orNil() error {
+	if len(ve) == 0 {
+		return nil
+	}
+	return ve
+}
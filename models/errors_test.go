@@ -0,0 +1,64 @@
+package models
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCollectValFuncs(t *testing.T) {
+	failWith := func(err error) func(*User) error {
+		return func(*User) error { return err }
+	}
+	pass := failWith(nil)
+	dbErr := errors.New("connection refused")
+	tests := []struct {
+		name string
+		fns  []func(*User) error
+		want error
+		// ran is how many functions should run
+		ran int
+	}{
+		{"none fail", []func(*User) error{pass, pass}, nil, 2},
+		{"public failures are collected", []func(*User) error{failWith(ErrEmailRequired), pass, failWith(ErrPasswordTooShort)},
+			ValidationError{ErrEmailRequired, ErrPasswordTooShort}, 3},
+		{"private failures stop", []func(*User) error{failWith(ErrEmailRequired), failWith(ErrRememberTooShort), failWith(ErrNameRequired)},
+			ErrRememberTooShort, 2},
+		{"unexpected failures stop", []func(*User) error{failWith(dbErr), failWith(ErrNameRequired)},
+			dbErr, 1},
+	}
+	for _, tt := range tests {
+		var ran int
+		fns := make([]func(*User) error, len(tt.fns))
+		for i, fn := range tt.fns {
+			fn := fn
+			fns[i] = func(user *User) error {
+				ran++
+				return fn(user)
+			}
+		}
+		err := collectValFuncs(&User{}, fns...)
+		if !reflect.DeepEqual(err, tt.want) {
+			t.Errorf("%s: expected %#v. Received %#v", tt.name, tt.want, err)
+		}
+		if ran != tt.ran {
+			t.Errorf("%s: expected %d functions to run. Received %d", tt.name, tt.ran, ran)
+		}
+	}
+}
+
+func TestValidationError(t *testing.T) {
+	ve := ValidationError{ErrEmailRequired, ErrPasswordTooShort}
+	if !errors.Is(ve, ErrPasswordTooShort) {
+		t.Error("Expected errors.Is to match any of the failures")
+	}
+	if kind := Kind(ve); kind != KindInvalid {
+		t.Errorf("Expected KindInvalid. Received %v", kind)
+	}
+	if kind := Kind(ValidationError{ErrEmailTaken}); kind != KindConflict {
+		t.Errorf("Expected a single failure to keep its kind. Received %v", kind)
+	}
+	if err := (ValidationError{}).orNil(); err != nil {
+		t.Errorf("Expected no error without failures. Received %#v", err)
+	}
+}
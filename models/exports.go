@@ -0,0 +1,131 @@
+package models
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ExportDir is the directory archives are stored under
+	ExportDir = "archives/"
+
+	// ExportTTL is how long an archive can be downloaded once
+	// it is ready
+	ExportTTL = 7 * 24 * time.Hour
+)
+
+// Statuses of an Export
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// Export is an archive of the data of a user, built in the
+// background after they asked for it
+type Export struct {
+	gorm.Model
+	UserID uint   `gorm:"not null;index"`
+	Status string `gorm:"not null"`
+	// ExpiresAt is set once the archive is ready
+	ExpiresAt *time.Time
+}
+
+// Path is where the archive is stored on the local disk,
+// relative to where the binary is run from
+func (e *Export) Path() string {
+	return filepath.Join(ExportDir, fmt.Sprintf("%d.zip", e.ID))
+}
+
+// Downloadable reports whether the archive is ready and didn't
+// expire yet
+func (e *Export) Downloadable() bool {
+	return e.Status == ExportReady && e.ExpiresAt != nil && time.Now().Before(*e.ExpiresAt)
+}
+
+// ExportService is a set of methods used to manipulate
+// and work with the export model
+type ExportService interface {
+	ExportDB
+}
+
+// ExportDB is used to interact with the exports table
+type ExportDB interface {
+	ByID(id uint) (*Export, error)
+	// ByUserID returns the exports of the user, latest first
+	ByUserID(userID uint) ([]Export, error)
+	// Pending returns the exports still to be built, eg. after
+	// a restart
+	Pending() ([]Export, error)
+	// Create adds a pending export
+	Create(export *Export) error
+	Update(export *Export) error
+}
+
+func NewExportService(db *gorm.DB) ExportService {
+	return &exportService{
+		ExportDB: &exportValidator{&exportGorm{db}},
+	}
+}
+
+type exportService struct {
+	ExportDB
+}
+
+var _ ExportDB = &exportValidator{}
+
+type exportValidator struct {
+	ExportDB
+}
+
+func (ev *exportValidator) Create(export *Export) error {
+	if export.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	export.Status = ExportPending
+	export.ExpiresAt = nil
+	return ev.ExportDB.Create(export)
+}
+
+var _ ExportDB = &exportGorm{}
+
+type exportGorm struct {
+	db *gorm.DB
+}
+
+func (eg *exportGorm) ByID(id uint) (*Export, error) {
+	var export Export
+	if err := first(eg.db.Where("id = ?", id), &export); err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+func (eg *exportGorm) ByUserID(userID uint) ([]Export, error) {
+	var exports []Export
+	err := eg.db.Where("user_id = ?", userID).Order("created_at desc").Find(&exports).Error
+	if err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+func (eg *exportGorm) Pending() ([]Export, error) {
+	var exports []Export
+	err := eg.db.Where("status = ?", ExportPending).Order("id").Find(&exports).Error
+	if err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+func (eg *exportGorm) Create(export *Export) error {
+	return translateDBError(eg.db.Create(export).Error)
+}
+
+func (eg *exportGorm) Update(export *Export) error {
+	return translateDBError(eg.db.Save(export).Error)
+}
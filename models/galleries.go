@@ -1,45 +1,276 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/apigban/lenslocked_v1/rand"
+	"github.com/jinzhu/gorm"
+)
+
+// Visibility of a gallery, who may see it
+const (
+	// VisibilityPrivate galleries are only seen by their owner
+	VisibilityPrivate = "private"
+	// VisibilityUnlisted galleries are seen by anyone with their
+	// link, which uses the Slug of the gallery
+	VisibilityUnlisted = "unlisted"
+	// VisibilityPublic galleries are seen by anyone and listed on
+	// the profile page of their owner
+	VisibilityPublic = "public"
+)
+
+// Visibilities lists every visibility, in the order they are
+// offered to users
+var Visibilities = []string{VisibilityPrivate, VisibilityUnlisted, VisibilityPublic}
+
+// gallerySlugBytes is the number of random bytes in the slug of
+// unlisted galleries, enough that links can't be guessed. A
+// multiple of 3 keeps the base64 encoded slug free of padding.
+const gallerySlugBytes = 18
+
+// Action is something a user does with a gallery, see
+// GalleryService.Authorize
+type Action string
+
+const (
+	// ActionView is seeing the gallery and its images
+	ActionView Action = "view"
+	// ActionDownload is getting the images as a zip archive
+	ActionDownload Action = "download"
+	// ActionUpload is adding images
+	ActionUpload Action = "upload"
+	// ActionEdit is changing the title, and reordering and deleting
+	// images
+	ActionEdit Action = "edit"
+	// ActionManage is changing the visibility and deleting the
+	// gallery
+	ActionManage Action = "manage"
+)
 
 type Gallery struct {
 	gorm.Model
-	UserID uint   `gorm:"not_null;index"`
-	Title  string `gorm:"not_null"`
+	UserID     uint   `gorm:"not_null;index"`
+	Title      string `gorm:"not_null"`
+	Visibility string `gorm:"not null;default:'private'"`
+	// Description is shown on the page of the gallery
+	Description string
+	// Slug identifies unlisted galleries in their link, it is
+	// empty for any other visibility
+	Slug string `gorm:"index"`
+	// CoverImage is the filename of the image shown for the
+	// gallery in lists, empty when none was picked
+	CoverImage string
+	// Tags are the normalized tags of the gallery, see ParseTags.
+	// Only galleries looked up on their own have their tags loaded,
+	// saving a gallery with nil Tags leaves them unchanged.
+	Tags []string `gorm:"-"`
+
+	// bySlug is set when the gallery was looked up by its Slug,
+	// the only way others may reach an unlisted gallery
+	bySlug bool
+	// shareLink is set when the gallery was looked up through
+	// one of its share links, see ByShareLink
+	shareLink *ShareLink
+	// ownerPurging is set when the owner of the gallery deleted
+	// their account, see User.PurgeAt
+	ownerPurging bool
+}
+
+// Path returns the URL path of the page of the gallery. Unlisted
+// galleries are only reachable through their slug, and galleries
+// looked up through a share link are kept under the link.
+func (g *Gallery) Path() string {
+	if g.shareLink != nil {
+		return "/s/" + g.shareLink.Token
+	}
+	if g.Visibility == VisibilityUnlisted && g.Slug != "" {
+		return "/g/" + g.Slug
+	}
+	return fmt.Sprintf("/galleries/%d", g.ID)
+}
+
+// ImagePath returns the URL path image is served from when
+// viewed through the page of the gallery, see Path
+func (g *Gallery) ImagePath(image *Image) string {
+	if g.shareLink != nil || (g.Visibility == VisibilityUnlisted && g.Slug != "") {
+		return g.Path() + "/images/" + url.PathEscape(image.Filename)
+	}
+	return image.Path()
+}
+
+// CoverPath returns the URL path of the cover image of the
+// gallery, or an empty string if it doesn't have one
+func (g *Gallery) CoverPath() string {
+	if g.CoverImage == "" {
+		return ""
+	}
+	return g.ImagePath(&Image{GalleryID: g.ID, Filename: g.CoverImage})
 }
 
 type GalleryService interface {
+	// Authorize returns nil when user may take action on gallery,
+	// as its owner, one of its members or through its visibility.
+	// user is nil for visitors who aren't signed in. ErrNotFound is
+	// returned when the user may not even view the gallery, so
+	// that its existence isn't leaked, ErrForbidden otherwise.
+	// Galleries of users deleting their account are hidden from
+	// everyone else until the account is restored.
+	Authorize(user *User, gallery *Gallery, action Action) error
 	GalleryDB
 }
 
 type GalleryDB interface {
+	ByID(id uint) (*Gallery, error)
+	// BySlug looks up an unlisted gallery by its slug
+	BySlug(slug string) (*Gallery, error)
+	// ByShareLink looks up the gallery link was created for.
+	// Authorize then lets anyone view it while link is active.
+	ByShareLink(link *ShareLink) (*Gallery, error)
+	// PublicByUserID returns the public galleries of the user,
+	// none while the user is deleting their account
+	PublicByUserID(userID uint) ([]Gallery, error)
+	// ByMemberUserID returns the galleries the user is a member of,
+	// leaving out those of owners deleting their account
+	ByMemberUserID(userID uint) ([]Gallery, error)
+	ByUserID(userID uint) ([]Gallery, error)
 	Create(gallery *Gallery) error
+	Update(gallery *Gallery) error
+	// Delete removes the gallery along with its share links,
+	// members and tags. Its images are left to
+	// ImageService.DeleteAll, which should run first.
+	Delete(id uint) error
+	// Count returns the total number of galleries
+	Count() (int, error)
 }
 
-func NewGalleryService(db *gorm.DB) GalleryService {
+// NewGalleryService looks up the roles of the members of
+// galleries in members, see Authorize
+func NewGalleryService(db *gorm.DB, members GalleryMemberDB) GalleryService {
 	return &galleryService{
 		GalleryDB: &galleryValidator{&galleryGorm{db}},
+		members:   members,
 	}
 }
 
 type galleryService struct {
 	GalleryDB
+	members GalleryMemberDB
+}
+
+func (gs *galleryService) Authorize(user *User, gallery *Gallery, action Action) error {
+	if user != nil && user.ID == gallery.UserID {
+		return nil
+	}
+	if gallery.ownerPurging {
+		return ErrNotFound
+	}
+	var role string
+	if user != nil {
+		var err error
+		if role, err = gs.members.Role(gallery.ID, user.ID); err != nil {
+			return err
+		}
+	}
+	var visible bool
+	switch gallery.Visibility {
+	case VisibilityPublic:
+		visible = true
+	case VisibilityUnlisted:
+		visible = gallery.bySlug
+	}
+	link := gallery.shareLink
+	shared := link != nil && link.GalleryID == gallery.ID && link.Active()
+	if role == "" && !visible && !shared {
+		return ErrNotFound
+	}
+	if roleAllows(role, action) {
+		return nil
+	}
+	switch action {
+	case ActionView:
+		return nil
+	case ActionDownload:
+		if visible || (shared && link.AllowDownload) {
+			return nil
+		}
+	}
+	return ErrForbidden
 }
 
 type galleryValidator struct {
 	GalleryDB
 }
 
+func (gv *galleryValidator) BySlug(slug string) (*Gallery, error) {
+	if slug == "" {
+		return nil, ErrNotFound
+	}
+	return gv.GalleryDB.BySlug(slug)
+}
+
+func (gv *galleryValidator) ByShareLink(link *ShareLink) (*Gallery, error) {
+	if link == nil || link.GalleryID <= 0 {
+		return nil, ErrNotFound
+	}
+	return gv.GalleryDB.ByShareLink(link)
+}
+
 func (gv *galleryValidator) Create(gallery *Gallery) error {
-	err := runGalleryValFuncs(gallery,
+	err := collectValFuncs(gallery,
 		gv.titleRequired,
-		gv.userIDRequired)
+		gv.userIDRequired,
+		gv.defaultVisibility,
+		gv.visibilityValid,
+		gv.normalizeDescription,
+		gv.normalizeTags,
+		gv.tagsValid)
 	if err != nil {
 		return err
 	}
+	if err := runGalleryValFuncs(gallery, gv.setSlug); err != nil {
+		return err
+	}
 	return gv.GalleryDB.Create(gallery)
 }
 
+func (gv *galleryValidator) Update(gallery *Gallery) error {
+	err := collectValFuncs(gallery,
+		gv.titleRequired,
+		gv.userIDRequired,
+		gv.defaultVisibility,
+		gv.visibilityValid,
+		gv.normalizeDescription,
+		gv.normalizeTags,
+		gv.tagsValid)
+	if err != nil {
+		return err
+	}
+	if err := runGalleryValFuncs(gallery, gv.setSlug); err != nil {
+		return err
+	}
+	return gv.GalleryDB.Update(gallery)
+}
+
+func (gv *galleryValidator) Delete(id uint) error {
+	var gallery Gallery
+	gallery.ID = id
+	if err := runGalleryValFuncs(&gallery, gv.idGreaterThan(0)); err != nil {
+		return err
+	}
+	return gv.GalleryDB.Delete(gallery.ID)
+}
+
+func (gv *galleryValidator) idGreaterThan(n uint) galleryValFunc {
+	return galleryValFunc(func(g *Gallery) error {
+		if g.ID <= n {
+			return ErrIDInvalid
+		}
+		return nil
+	})
+}
+
 func (gv *galleryValidator) userIDRequired(g *Gallery) error {
 	if g.UserID <= 0 {
 		return ErrUserIDRequired
@@ -54,14 +285,220 @@ func (gv *galleryValidator) titleRequired(g *Gallery) error {
 	return nil
 }
 
+// defaultVisibility makes galleries private unless told otherwise
+func (gv *galleryValidator) defaultVisibility(g *Gallery) error {
+	if g.Visibility == "" {
+		g.Visibility = VisibilityPrivate
+	}
+	return nil
+}
+
+func (gv *galleryValidator) visibilityValid(g *Gallery) error {
+	for _, v := range Visibilities {
+		if g.Visibility == v {
+			return nil
+		}
+	}
+	return ErrVisibilityInvalid
+}
+
+func (gv *galleryValidator) normalizeDescription(g *Gallery) error {
+	g.Description = strings.TrimSpace(g.Description)
+	return nil
+}
+
+func (gv *galleryValidator) normalizeTags(g *Gallery) error {
+	g.Tags = normalizeTags(g.Tags)
+	return nil
+}
+
+func (gv *galleryValidator) tagsValid(g *Gallery) error {
+	return tagsValid(g.Tags)
+}
+
+// setSlug gives unlisted galleries a random slug, kept for as long
+// as they stay unlisted so that shared links keep working. Links
+// stop working once the gallery is made private or public, and
+// making it unlisted again generates a new one.
+func (gv *galleryValidator) setSlug(g *Gallery) error {
+	if g.Visibility != VisibilityUnlisted {
+		g.Slug = ""
+		return nil
+	}
+	if g.Slug != "" {
+		return nil
+	}
+	slug, err := rand.String(gallerySlugBytes)
+	if err != nil {
+		return err
+	}
+	g.Slug = slug
+	return nil
+}
+
 var _ GalleryDB = &galleryGorm{}
 
+// ownerActiveJoin leaves out the galleries of users deleting
+// their account
+const ownerActiveJoin = "JOIN users owners ON owners.id = galleries.user_id AND owners.purge_at IS NULL"
+
 type galleryGorm struct {
 	db *gorm.DB
 }
 
+// ByID will look up a gallery by the ID provided
+// Case 1 - gallery, nil
+// Case 2 - nil, ErrNotFound
+// Case 3 - nil, otherError
+func (gg *galleryGorm) ByID(id uint) (*Gallery, error) {
+	var gallery Gallery
+	db := gg.db.Where("id = ?", id)
+	err := first(db, &gallery)
+	if err != nil {
+		return nil, err
+	}
+	if err := gg.loadDetails(&gallery); err != nil {
+		return nil, err
+	}
+	return &gallery, nil
+}
+
+// BySlug will look up an unlisted gallery by its slug
+func (gg *galleryGorm) BySlug(slug string) (*Gallery, error) {
+	var gallery Gallery
+	db := gg.db.Where("slug = ? AND visibility = ?", slug, VisibilityUnlisted)
+	err := first(db, &gallery)
+	if err != nil {
+		return nil, err
+	}
+	if err := gg.loadDetails(&gallery); err != nil {
+		return nil, err
+	}
+	gallery.bySlug = true
+	return &gallery, nil
+}
+
+// loadDetails loads the tags of a gallery looked up on its own,
+// and whether its owner is deleting their account
+func (gg *galleryGorm) loadDetails(gallery *Gallery) error {
+	var err error
+	if gallery.Tags, err = galleryTagNames(gg.db, gallery.ID); err != nil {
+		return err
+	}
+	var purging int
+	err = gg.db.Model(&User{}).Where("id = ? AND purge_at IS NOT NULL", gallery.UserID).Count(&purging).Error
+	if err != nil {
+		return err
+	}
+	gallery.ownerPurging = purging > 0
+	return nil
+}
+
+// ByShareLink will look up the gallery of the share link
+func (gg *galleryGorm) ByShareLink(link *ShareLink) (*Gallery, error) {
+	gallery, err := gg.ByID(link.GalleryID)
+	if err != nil {
+		return nil, err
+	}
+	gallery.shareLink = link
+	return gallery, nil
+}
+
+// PublicByUserID returns the public galleries of the user with
+// the provided ID, newest first
+func (gg *galleryGorm) PublicByUserID(userID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.Joins(ownerActiveJoin).
+		Where("galleries.user_id = ? AND galleries.visibility = ?", userID, VisibilityPublic).
+		Order("galleries.created_at DESC").Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+// ByMemberUserID returns the galleries the user with the provided
+// ID accepted an invite to, newest first
+func (gg *galleryGorm) ByMemberUserID(userID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.Joins("JOIN gallery_members ON gallery_members.gallery_id = galleries.id AND gallery_members.deleted_at IS NULL").
+		Joins(ownerActiveJoin).
+		Where("gallery_members.user_id = ?", userID).
+		Order("galleries.created_at DESC").Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+// ByUserID returns every gallery owned by the user
+// with the provided ID
+func (gg *galleryGorm) ByUserID(userID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.Where("user_id = ?", userID).Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
 func (gg *galleryGorm) Create(gallery *Gallery) error {
-	return gg.db.Create(gallery).Error
+	return gg.db.Transaction(func(tx *gorm.DB) error {
+		if err := translateDBError(tx.Create(gallery).Error); err != nil {
+			return err
+		}
+		return gg.saveTags(tx, gallery)
+	})
+}
+
+// Update will update the provided gallery with all of the data
+// in the provided gallery object
+func (gg *galleryGorm) Update(gallery *Gallery) error {
+	return gg.db.Transaction(func(tx *gorm.DB) error {
+		if err := translateDBError(tx.Save(gallery).Error); err != nil {
+			return err
+		}
+		return gg.saveTags(tx, gallery)
+	})
+}
+
+// saveTags replaces the tags of the gallery unless they are nil,
+// and refreshes its search vector either way
+func (gg *galleryGorm) saveTags(tx *gorm.DB, gallery *Gallery) error {
+	if gallery.Tags != nil {
+		if err := setGalleryTags(tx, gallery.ID, gallery.Tags); err != nil {
+			return err
+		}
+	}
+	return refreshGallerySearch(tx, gallery.ID)
+}
+
+// Delete will delete the gallery with the provided ID, and the
+// rows that depend on it
+func (gg *galleryGorm) Delete(id uint) error {
+	return gg.db.Transaction(func(tx *gorm.DB) error {
+		tx = tx.Unscoped()
+		for _, d := range []struct {
+			model interface{}
+			where string
+		}{
+			{&ShareLink{}, "gallery_id = ?"},
+			{&galleryTag{}, "gallery_id = ?"},
+			{&GalleryMember{}, "gallery_id = ?"},
+			{&Gallery{}, "id = ?"},
+		} {
+			if err := tx.Where(d.where, id).Delete(d.model).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (gg *galleryGorm) Count() (int, error) {
+	var n int
+	err := gg.db.Model(&Gallery{}).Count(&n).Error
+	return n, err
 }
 
 type galleryValFunc func(*Gallery) error
@@ -0,0 +1,179 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/hash"
+	"github.com/jinzhu/gorm"
+)
+
+// memberRoles gives users a role on every gallery
+type memberRoles struct {
+	GalleryMemberDB
+	roles map[uint]string
+}
+
+func (mr memberRoles) Role(galleryID, userID uint) (string, error) {
+	return mr.roles[userID], nil
+}
+
+func (mr memberRoles) Accept(member *GalleryMember, user *User, token string) error {
+	member.UserID = user.ID
+	return nil
+}
+
+func TestGalleryMemberAccept(t *testing.T) {
+	hmac := hash.NewHMAC(hmacSecretKey)
+	mv := &galleryMemberValidator{GalleryMemberDB: memberRoles{}, hmac: hmac}
+	invited := &User{Model: gorm.Model{ID: 8}, Email: "second@example.com"}
+	other := &User{Model: gorm.Model{ID: 9}, Email: "other@example.com"}
+
+	tests := []struct {
+		name     string
+		user     *User
+		token    string
+		accepted bool
+		want     error
+	}{
+		{"token", invited, "invite", false, nil},
+		{"email case", &User{Model: gorm.Model{ID: 8}, Email: "Second@Example.com"}, "invite", false, nil},
+		{"no token", invited, "", false, ErrInviteTokenInvalid},
+		{"wrong token", invited, "other", false, ErrInviteTokenInvalid},
+		{"other user", other, "invite", false, ErrNotFound},
+		{"accepted", invited, "invite", true, ErrNotFound},
+	}
+	for _, tt := range tests {
+		member := &GalleryMember{Email: "second@example.com", TokenHash: hmac.Hash("invite")}
+		if tt.accepted {
+			member.UserID = invited.ID
+		}
+		if err := mv.Accept(member, tt.user, tt.token); err != tt.want {
+			t.Errorf("%s: expected %v. Received %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestGalleryAuthorize(t *testing.T) {
+	owner := &User{Model: gorm.Model{ID: 1}}
+	other := &User{Model: gorm.Model{ID: 2}}
+	viewer := &User{Model: gorm.Model{ID: 3}}
+	contributor := &User{Model: gorm.Model{ID: 4}}
+	editor := &User{Model: gorm.Model{ID: 5}}
+	gs := NewGalleryService(nil, memberRoles{roles: map[uint]string{
+		viewer.ID:      RoleViewer,
+		contributor.ID: RoleContributor,
+		editor.ID:      RoleEditor,
+	}})
+	gallery := func(visibility string, bySlug bool) *Gallery {
+		return &Gallery{UserID: owner.ID, Visibility: visibility, Slug: "slug", bySlug: bySlug}
+	}
+	shared := func(link *ShareLink) *Gallery {
+		g := gallery(VisibilityPrivate, false)
+		g.ID = 3
+		g.shareLink = link
+		return g
+	}
+	purging := func(g *Gallery) *Gallery {
+		g.ownerPurging = true
+		return g
+	}
+	past := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name    string
+		user    *User
+		gallery *Gallery
+		action  Action
+		want    error
+	}{
+		{"owner manages private", owner, gallery(VisibilityPrivate, false), ActionManage, nil},
+		{"other views private", other, gallery(VisibilityPrivate, false), ActionView, ErrNotFound},
+		{"visitor views public", nil, gallery(VisibilityPublic, false), ActionView, nil},
+		{"visitor downloads public", nil, gallery(VisibilityPublic, false), ActionDownload, nil},
+		{"other edits public", other, gallery(VisibilityPublic, false), ActionEdit, ErrForbidden},
+		{"other views unlisted by ID", other, gallery(VisibilityUnlisted, false), ActionView, ErrNotFound},
+		{"visitor views unlisted by slug", nil, gallery(VisibilityUnlisted, true), ActionView, nil},
+		{"other manages unlisted by slug", other, gallery(VisibilityUnlisted, true), ActionManage, ErrForbidden},
+		{"visitor views shared", nil, shared(&ShareLink{GalleryID: 3}), ActionView, nil},
+		{"visitor downloads shared", nil, shared(&ShareLink{GalleryID: 3}), ActionDownload, ErrForbidden},
+		{"visitor downloads shared with download", nil, shared(&ShareLink{GalleryID: 3, AllowDownload: true}), ActionDownload, nil},
+		{"visitor views revoked", nil, shared(&ShareLink{GalleryID: 3, RevokedAt: &past}), ActionView, ErrNotFound},
+		{"visitor views expired", nil, shared(&ShareLink{GalleryID: 3, ExpiresAt: &past}), ActionView, ErrNotFound},
+		{"visitor views through another gallery", nil, shared(&ShareLink{GalleryID: 4}), ActionView, ErrNotFound},
+		{"viewer downloads private", viewer, gallery(VisibilityPrivate, false), ActionDownload, nil},
+		{"viewer uploads", viewer, gallery(VisibilityPrivate, false), ActionUpload, ErrForbidden},
+		{"contributor uploads", contributor, gallery(VisibilityPrivate, false), ActionUpload, nil},
+		{"contributor edits", contributor, gallery(VisibilityPrivate, false), ActionEdit, ErrForbidden},
+		{"editor edits", editor, gallery(VisibilityPrivate, false), ActionEdit, nil},
+		{"editor manages", editor, gallery(VisibilityPrivate, false), ActionManage, ErrForbidden},
+		{"visitor views public of owner deleting account", nil, purging(gallery(VisibilityPublic, false)), ActionView, ErrNotFound},
+		{"visitor views shared of owner deleting account", nil, purging(shared(&ShareLink{GalleryID: 3})), ActionView, ErrNotFound},
+		{"viewer views of owner deleting account", viewer, purging(gallery(VisibilityPrivate, false)), ActionView, ErrNotFound},
+		{"owner deleting account views", owner, purging(gallery(VisibilityPrivate, false)), ActionView, nil},
+	}
+	for _, tt := range tests {
+		if err := gs.Authorize(tt.user, tt.gallery, tt.action); err != tt.want {
+			t.Errorf("%s: expected %v. Received %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestGalleryBySlug(t *testing.T) {
+	gs := testingServices(t).Gallery
+	gallery := Gallery{UserID: 1, Title: "Holidays", Visibility: VisibilityUnlisted}
+	if err := gs.Create(&gallery); err != nil {
+		t.Fatal(err)
+	}
+	if gallery.Slug == "" {
+		t.Fatal("Expected unlisted galleries to get a slug")
+	}
+	found, err := gs.BySlug(gallery.Slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ID != gallery.ID {
+		t.Errorf("Expected gallery %d. Received %d", gallery.ID, found.ID)
+	}
+
+	slug := gallery.Slug
+	gallery.Visibility = VisibilityPrivate
+	if err := gs.Update(&gallery); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gs.BySlug(slug); err != ErrNotFound {
+		t.Errorf("Expected the link of a private gallery to stop working. Received %v", err)
+	}
+}
+
+func TestGalleryDelete(t *testing.T) {
+	services := testingServices(t)
+	gallery := Gallery{UserID: 1, Title: "Holidays", Tags: []string{"beach"}}
+	if err := services.Gallery.Create(&gallery); err != nil {
+		t.Fatal(err)
+	}
+	link := ShareLink{GalleryID: gallery.ID}
+	if err := services.ShareLink.Create(&link); err != nil {
+		t.Fatal(err)
+	}
+	if err := services.Gallery.Delete(gallery.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []struct {
+		model interface{}
+		where string
+	}{
+		{&Gallery{}, "id = ?"},
+		{&ShareLink{}, "gallery_id = ?"},
+		{&galleryTag{}, "gallery_id = ?"},
+	} {
+		var count int
+		err := services.db.Unscoped().Model(d.model).Where(d.where, gallery.ID).Count(&count).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Errorf("Expected the %T rows to be deleted. Received %d", d.model, count)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package models
+
+import (
+	"crypto/hmac"
+	"strings"
+
+	"github.com/apigban/lenslocked_v1/hash"
+	"github.com/apigban/lenslocked_v1/rand"
+	"github.com/jinzhu/gorm"
+)
+
+const inviteTokenBytes = 32
+
+// Roles of the members of a gallery, each one can do what the
+// previous one can
+const (
+	// RoleViewer members see and download the gallery
+	RoleViewer = "viewer"
+	// RoleContributor members also upload images
+	RoleContributor = "contributor"
+	// RoleEditor members also rename the gallery, and reorder and
+	// delete its images
+	RoleEditor = "editor"
+)
+
+// Roles lists every role, in the order they are offered to owners
+var Roles = []string{RoleViewer, RoleContributor, RoleEditor}
+
+// roleActions are the actions members with each role can take.
+// Managing the gallery is left to its owner.
+var roleActions = map[string][]Action{
+	RoleViewer:      {ActionView, ActionDownload},
+	RoleContributor: {ActionView, ActionDownload, ActionUpload},
+	RoleEditor:      {ActionView, ActionDownload, ActionUpload, ActionEdit},
+}
+
+// roleAllows reports whether members with role can take action
+func roleAllows(role string, action Action) bool {
+	for _, a := range roleActions[role] {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// GalleryMember gives a user a role on the gallery of another
+// user. Members are invited by email address, UserID is set once
+// the user with that address accepts with the token emailed to
+// them. Like for login links only the HMAC of the token is stored,
+// and it is cleared once the invite is accepted.
+type GalleryMember struct {
+	gorm.Model
+	GalleryID uint   `gorm:"not null;unique_index:uix_gallery_members_gallery_email"`
+	Email     string `gorm:"not null;index;unique_index:uix_gallery_members_gallery_email"`
+	UserID    uint   `gorm:"index"`
+	Role      string `gorm:"not null"`
+	Token     string `gorm:"-"` //not going to be stored in the database
+	TokenHash string `gorm:"not null;default:''"`
+}
+
+// Pending reports whether the invite wasn't accepted yet
+func (m *GalleryMember) Pending() bool {
+	return m.UserID == 0
+}
+
+// GalleryMemberService is a set of methods used to manipulate and
+// work with the gallery member model
+type GalleryMemberService interface {
+	GalleryMemberDB
+}
+
+// GalleryMemberDB is used to interact with the gallery_members table
+type GalleryMemberDB interface {
+	ByID(id uint) (*GalleryMember, error)
+	// ByGalleryID returns the members of the gallery, pending
+	// invites included
+	ByGalleryID(galleryID uint) ([]GalleryMember, error)
+	// PendingByEmail returns the invites sent to the email address
+	// that weren't accepted yet
+	PendingByEmail(email string) ([]GalleryMember, error)
+	// Role returns the role of the user on the gallery, or an empty
+	// string if they aren't a member
+	Role(galleryID, userID uint) (string, error)
+
+	// Create invites a new member, ErrMemberTaken is returned when
+	// the email address was already invited. The token of the
+	// invite is only available in the Token field after this call.
+	Create(member *GalleryMember) error
+	// Accept makes user the member of the invite, token is the one
+	// emailed with it. ErrInviteTokenInvalid is returned when it
+	// doesn't match.
+	Accept(member *GalleryMember, user *User, token string) error
+	// Delete removes the member with the provided ID, as long as
+	// it belongs to the gallery with the provided ID
+	Delete(id, galleryID uint) error
+}
+
+func NewGalleryMemberService(db *gorm.DB) GalleryMemberService {
+	return &galleryMemberService{
+		GalleryMemberDB: &galleryMemberValidator{
+			GalleryMemberDB: &galleryMemberGorm{db},
+			hmac:            hash.NewHMAC(hmacSecretKey),
+		},
+	}
+}
+
+type galleryMemberService struct {
+	GalleryMemberDB
+}
+
+var _ GalleryMemberDB = &galleryMemberValidator{}
+
+type galleryMemberValidator struct {
+	GalleryMemberDB
+	hmac hash.HMAC
+}
+
+func (mv *galleryMemberValidator) PendingByEmail(email string) ([]GalleryMember, error) {
+	return mv.GalleryMemberDB.PendingByEmail(strings.ToLower(strings.TrimSpace(email)))
+}
+
+func (mv *galleryMemberValidator) Create(member *GalleryMember) error {
+	err := collectValFuncs(member,
+		mv.normalizeEmail,
+		mv.emailRequired,
+		mv.emailFormat,
+		mv.roleValid)
+	if err != nil {
+		return err
+	}
+	err = runGalleryMemberValFuncs(member,
+		mv.galleryIDRequired,
+		mv.generateToken,
+		mv.hmacToken)
+	if err != nil {
+		return err
+	}
+	return mv.GalleryMemberDB.Create(member)
+}
+
+// Accept only lets the user the invite was sent to accept it,
+// with the token emailed to them. Email addresses aren't verified,
+// the token proves the user can read the mail sent to theirs.
+func (mv *galleryMemberValidator) Accept(member *GalleryMember, user *User, token string) error {
+	if !member.Pending() || !strings.EqualFold(member.Email, user.Email) {
+		return ErrNotFound
+	}
+	if token == "" || member.TokenHash == "" ||
+		!hmac.Equal([]byte(mv.hmac.Hash(token)), []byte(member.TokenHash)) {
+		return ErrInviteTokenInvalid
+	}
+	return mv.GalleryMemberDB.Accept(member, user, token)
+}
+
+func (mv *galleryMemberValidator) galleryIDRequired(m *GalleryMember) error {
+	if m.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (mv *galleryMemberValidator) generateToken(m *GalleryMember) error {
+	token, err := rand.String(inviteTokenBytes)
+	if err != nil {
+		return err
+	}
+	m.Token = token
+	return nil
+}
+
+func (mv *galleryMemberValidator) hmacToken(m *GalleryMember) error {
+	m.TokenHash = mv.hmac.Hash(m.Token)
+	return nil
+}
+
+func (mv *galleryMemberValidator) normalizeEmail(m *GalleryMember) error {
+	m.Email = strings.ToLower(strings.TrimSpace(m.Email))
+	return nil
+}
+
+func (mv *galleryMemberValidator) emailRequired(m *GalleryMember) error {
+	if m.Email == "" {
+		return ErrEmailRequired
+	}
+	return nil
+}
+
+func (mv *galleryMemberValidator) emailFormat(m *GalleryMember) error {
+	if m.Email != "" && !emailRegex.MatchString(m.Email) {
+		return ErrEmailInvalid
+	}
+	return nil
+}
+
+func (mv *galleryMemberValidator) roleValid(m *GalleryMember) error {
+	if _, ok := roleActions[m.Role]; !ok {
+		return ErrRoleInvalid
+	}
+	return nil
+}
+
+var _ GalleryMemberDB = &galleryMemberGorm{}
+
+type galleryMemberGorm struct {
+	db *gorm.DB
+}
+
+func (mg *galleryMemberGorm) ByID(id uint) (*GalleryMember, error) {
+	var member GalleryMember
+	err := first(mg.db.Where("id = ?", id), &member)
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+func (mg *galleryMemberGorm) ByGalleryID(galleryID uint) ([]GalleryMember, error) {
+	var members []GalleryMember
+	err := mg.db.Where("gallery_id = ?", galleryID).Order("created_at").Find(&members).Error
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (mg *galleryMemberGorm) PendingByEmail(email string) ([]GalleryMember, error) {
+	var members []GalleryMember
+	err := mg.db.Where("email = ? AND user_id = 0", email).Order("created_at").Find(&members).Error
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (mg *galleryMemberGorm) Role(galleryID, userID uint) (string, error) {
+	var member GalleryMember
+	err := first(mg.db.Where("gallery_id = ? AND user_id = ?", galleryID, userID), &member)
+	switch err {
+	case nil:
+		return member.Role, nil
+	case ErrNotFound:
+		return "", nil
+	}
+	return "", err
+}
+
+func (mg *galleryMemberGorm) Create(member *GalleryMember) error {
+	return translateDBError(mg.db.Create(member).Error)
+}
+
+// Accept clears the token along with setting the user, and only
+// updates pending invites, so that each token is used once
+func (mg *galleryMemberGorm) Accept(member *GalleryMember, user *User, token string) error {
+	db := mg.db.Model(member).Where("user_id = 0").UpdateColumns(map[string]interface{}{
+		"user_id":    user.ID,
+		"token_hash": "",
+	})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	member.UserID = user.ID
+	member.TokenHash = ""
+	return nil
+}
+
+func (mg *galleryMemberGorm) Delete(id, galleryID uint) error {
+	db := mg.db.Unscoped().Where("id = ? AND gallery_id = ?", id, galleryID).Delete(&GalleryMember{})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type galleryMemberValFunc func(*GalleryMember) error
+
+func runGalleryMemberValFuncs(member *GalleryMember, fns ...galleryMemberValFunc) error {
+	for _, fn := range fns {
+		if err := fn(member); err != nil {
+			return err
+		}
+	}
+	return nil
+}
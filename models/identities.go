@@ -0,0 +1,79 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Identity links a user to their account at an OpenID Connect
+// provider. The subject identifies the account at the issuer
+// and, unlike the email address, never changes.
+type Identity struct {
+	gorm.Model
+	UserID  uint   `gorm:"not null;index"`
+	Issuer  string `gorm:"not null;unique_index:uix_identities_issuer_subject"`
+	Subject string `gorm:"not null;unique_index:uix_identities_issuer_subject"`
+	// Email is the verified address the identity was linked with
+	Email string
+}
+
+// IdentityService is a set of methods used to manipulate
+// and work with the identity model
+type IdentityService interface {
+	IdentityDB
+}
+
+// IdentityDB is used to interact with the identities table
+type IdentityDB interface {
+	ByIssuerSubject(issuer, subject string) (*Identity, error)
+	Create(identity *Identity) error
+}
+
+func NewIdentityService(db *gorm.DB) IdentityService {
+	return &identityService{
+		IdentityDB: &identityValidator{
+			IdentityDB: &identityGorm{db},
+		},
+	}
+}
+
+type identityService struct {
+	IdentityDB
+}
+
+var _ IdentityDB = &identityValidator{}
+
+type identityValidator struct {
+	IdentityDB
+}
+
+func (iv *identityValidator) Create(identity *Identity) error {
+	if identity.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	if identity.Issuer == "" || identity.Subject == "" {
+		return ErrIdentityRequired
+	}
+	identity.Email = strings.ToLower(strings.TrimSpace(identity.Email))
+	return iv.IdentityDB.Create(identity)
+}
+
+var _ IdentityDB = &identityGorm{}
+
+type identityGorm struct {
+	db *gorm.DB
+}
+
+func (ig *identityGorm) ByIssuerSubject(issuer, subject string) (*Identity, error) {
+	var identity Identity
+	db := ig.db.Where("issuer = ? AND subject = ?", issuer, subject)
+	if err := first(db, &identity); err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+func (ig *identityGorm) Create(identity *Identity) error {
+	return translateDBError(ig.db.Create(identity).Error)
+}
@@ -0,0 +1,477 @@
+package models
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ImageDir is the root directory images are stored under
+const ImageDir = "images/"
+
+// imageExts are the file extensions of the supported image formats
+var imageExts = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+}
+
+// IsImageFile reports whether filename has the extension of one
+// of the supported image formats
+func IsImageFile(filename string) bool {
+	return imageExts[strings.ToLower(filepath.Ext(filename))]
+}
+
+// Image files are stored on disk under
+// ImageDir/galleries/<galleryID>/<filename>, the files are the
+// source of truth for which images a gallery has. Their position
+// and texts are stored in the images table, files uploaded before
+// it existed may not have a row yet.
+type Image struct {
+	gorm.Model
+	GalleryID uint   `gorm:"not null;unique_index:uix_images_gallery_filename"`
+	Filename  string `gorm:"not null;unique_index:uix_images_gallery_filename"`
+	// Position orders the images of a gallery, starting at 1
+	Position int `gorm:"not null;default:0"`
+	Caption  string
+	AltText  string
+	// Tags are the normalized tags of the image, see ParseTags.
+	// Updating an image with nil Tags leaves them unchanged.
+	Tags []string `gorm:"-"`
+}
+
+// Path is used to build the absolute URL path used to
+// reference this image via a web request
+func (i *Image) Path() string {
+	temp := url.URL{
+		Path: "/" + i.RelativePath(),
+	}
+	return temp.String()
+}
+
+// RelativePath is used to build the path to this image on
+// the local disk, relative to where the binary is run from
+func (i *Image) RelativePath() string {
+	galleryID := fmt.Sprintf("%v", i.GalleryID)
+	return filepath.ToSlash(filepath.Join(ImageDir, "galleries", galleryID, i.Filename))
+}
+
+// WriteZip copies the file of the image into the archive under
+// name. Images are already compressed, they are stored as is.
+func (i *Image) WriteZip(zw *zip.Writer, name string) error {
+	in, err := os.Open(i.RelativePath())
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	header := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: info.ModTime(),
+	}
+	f, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, in)
+	return err
+}
+
+type ImageService interface {
+	// Create stores the image, replacing the file of the image
+	// with the same name if there is one. Replaced images keep
+	// their position and texts, new ones are added last.
+	Create(galleryID uint, r io.Reader, filename string) error
+	// ByGalleryID returns the images of the gallery in order
+	ByGalleryID(galleryID uint) ([]Image, error)
+	// Update saves the caption, alt text and tags of the image
+	Update(i *Image) error
+	// Reorder moves the images of the gallery to the order of
+	// filenames, which must list each of them once
+	Reorder(galleryID uint, filenames []string) error
+	Delete(i *Image) error
+	// DeleteAll removes every image of the gallery
+	DeleteAll(galleryID uint) error
+	// Count returns the total number of images across all
+	// galleries. The files are counted once, Create and Delete
+	// then keep the count up to date.
+	Count() (int, error)
+	// Writable verifies that new images can be stored
+	Writable() error
+}
+
+// ImageDB is used to interact with the images table, which only
+// holds the details of the images, see Image
+type ImageDB interface {
+	// ByGalleryID returns the rows of the images of the gallery
+	ByGalleryID(galleryID uint) ([]Image, error)
+	// Create adds a row for the image after the last one of its
+	// gallery, unless it already has one. Either way image is
+	// filled in from the row.
+	Create(image *Image) error
+	// Update saves the caption, alt text and tags of the image
+	Update(image *Image) error
+	// Reorder sets the positions of the images of the gallery in
+	// a single transaction, rows of any other image are removed
+	Reorder(galleryID uint, filenames []string) error
+	Delete(image *Image) error
+	DeleteAll(galleryID uint) error
+}
+
+// NewImageService stores image files on disk, and their details
+// in db
+func NewImageService(db ImageDB) ImageService {
+	return &imageService{db: db}
+}
+
+// NewImageDB returns the ImageDB of the images table
+func NewImageDB(db *gorm.DB) ImageDB {
+	return &imageGorm{db}
+}
+
+type imageService struct {
+	db ImageDB
+
+	// mu guards count, which is only known once counted is set
+	mu      sync.Mutex
+	count   int
+	counted bool
+}
+
+func (is *imageService) Create(galleryID uint, r io.Reader, filename string) error {
+	filename = filepath.Base(filename)
+	// Hidden files would be listed with the images but could
+	// never be deleted, see Delete
+	if !IsImageFile(filename) || !validFilename(filename) {
+		return ErrImageInvalid
+	}
+	path, err := is.mkImagePath(galleryID)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(filepath.Join(path, filename))
+	replaced := err == nil
+	// Create a destination file
+	dst, err := os.Create(filepath.Join(path, filename))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if !replaced {
+		is.addCount(1)
+	}
+	// Copy reader data to the destination file
+	if _, err = io.Copy(dst, r); err != nil {
+		return err
+	}
+	return is.db.Create(&Image{GalleryID: galleryID, Filename: filename})
+}
+
+// ByGalleryID lists the files of the gallery along with their
+// rows. Files without a row yet come last, by name.
+func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
+	path := is.imagePath(galleryID)
+	files, err := filepath.Glob(filepath.Join(path, "*"))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := is.db.ByGalleryID(galleryID)
+	if err != nil {
+		return nil, err
+	}
+	byFilename := make(map[string]Image, len(rows))
+	for _, row := range rows {
+		byFilename[row.Filename] = row
+	}
+	ret := make([]Image, 0, len(files))
+	for _, imgStr := range files {
+		filename := filepath.Base(imgStr)
+		image, ok := byFilename[filename]
+		if !ok {
+			image = Image{
+				Filename:  filename,
+				GalleryID: galleryID,
+			}
+		}
+		ret = append(ret, image)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if (ret[i].ID == 0) != (ret[j].ID == 0) {
+			return ret[j].ID == 0
+		}
+		return ret[i].Position < ret[j].Position
+	})
+	return ret, nil
+}
+
+func (is *imageService) Update(i *Image) error {
+	if err := is.exists(i); err != nil {
+		return err
+	}
+	i.Caption = strings.TrimSpace(i.Caption)
+	i.AltText = strings.TrimSpace(i.AltText)
+	i.Tags = normalizeTags(i.Tags)
+	if err := tagsValid(i.Tags); err != nil {
+		return err
+	}
+	return is.db.Update(i)
+}
+
+func (is *imageService) Reorder(galleryID uint, filenames []string) error {
+	images, err := is.ByGalleryID(galleryID)
+	if err != nil {
+		return err
+	}
+	if len(filenames) != len(images) {
+		return ErrImageOrderInvalid
+	}
+	remaining := make(map[string]bool, len(images))
+	for _, image := range images {
+		remaining[image.Filename] = true
+	}
+	for _, filename := range filenames {
+		if !remaining[filename] {
+			return ErrImageOrderInvalid
+		}
+		delete(remaining, filename)
+	}
+	return is.db.Reorder(galleryID, filenames)
+}
+
+func (is *imageService) Delete(i *Image) error {
+	// Never let a crafted filename point outside of the gallery
+	if !validFilename(i.Filename) {
+		return ErrNotFound
+	}
+	err := os.Remove(i.RelativePath())
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	is.addCount(-1)
+	return is.db.Delete(i)
+}
+
+func (is *imageService) DeleteAll(galleryID uint) error {
+	if galleryID <= 0 {
+		return ErrIDInvalid
+	}
+	files, err := filepath.Glob(filepath.Join(is.imagePath(galleryID), "*"))
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(is.imagePath(galleryID)); err != nil {
+		return err
+	}
+	is.addCount(-len(files))
+	return is.db.DeleteAll(galleryID)
+}
+
+// exists returns ErrNotFound unless the file of the image is
+// stored
+func (is *imageService) exists(i *Image) error {
+	if !validFilename(i.Filename) {
+		return ErrNotFound
+	}
+	info, err := os.Stat(i.RelativePath())
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Count globs the whole tree on the first call only, metrics
+// are scraped far too often for it
+func (is *imageService) Count() (int, error) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	if !is.counted {
+		files, err := filepath.Glob(filepath.Join(ImageDir, "galleries", "*", "*"))
+		if err != nil {
+			return 0, err
+		}
+		is.count, is.counted = len(files), true
+	}
+	return is.count, nil
+}
+
+// addCount adjusts the count once Count computed it
+func (is *imageService) addCount(delta int) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	if is.counted {
+		is.count += delta
+	}
+}
+
+// Writable creates and removes a temporary file under ImageDir
+func (is *imageService) Writable() error {
+	if err := os.MkdirAll(ImageDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(ImageDir, ".writable-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	if err := f.Close(); err != nil {
+		os.Remove(name)
+		return err
+	}
+	return os.Remove(name)
+}
+
+func (is *imageService) imagePath(galleryID uint) string {
+	return filepath.Join(ImageDir, "galleries", fmt.Sprintf("%v", galleryID))
+}
+
+func (is *imageService) mkImagePath(galleryID uint) (string, error) {
+	galleryPath := is.imagePath(galleryID)
+	err := os.MkdirAll(galleryPath, 0755)
+	if err != nil {
+		return "", err
+	}
+	return galleryPath, nil
+}
+
+// validFilename reports whether filename names a file right in
+// the directory of a gallery
+func validFilename(filename string) bool {
+	return filename != "" && filepath.Base(filename) == filename && !strings.HasPrefix(filename, ".")
+}
+
+var _ ImageDB = &imageGorm{}
+
+type imageGorm struct {
+	db *gorm.DB
+}
+
+func (ig *imageGorm) ByGalleryID(galleryID uint) ([]Image, error) {
+	var images []Image
+	err := ig.db.Where("gallery_id = ?", galleryID).Order("position").Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+	tags, err := imageTagNames(ig.db, galleryID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range images {
+		images[i].Tags = tags[images[i].ID]
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) Create(image *Image) error {
+	return ig.create(ig.db, image)
+}
+
+// create looks up the row of image, and inserts it after the
+// last image of its gallery if there isn't one
+func (ig *imageGorm) create(db *gorm.DB, image *Image) error {
+	err := first(db.Where("gallery_id = ? AND filename = ?", image.GalleryID, image.Filename), image)
+	if err != ErrNotFound {
+		return err
+	}
+	var last struct{ Position int }
+	err = db.Model(&Image{}).Select("COALESCE(MAX(position), 0) AS position").
+		Where("gallery_id = ?", image.GalleryID).Scan(&last).Error
+	if err != nil {
+		return err
+	}
+	image.Position = last.Position + 1
+	return translateDBError(db.Create(image).Error)
+}
+
+func (ig *imageGorm) Update(image *Image) error {
+	caption, altText, tags := image.Caption, image.AltText, image.Tags
+	return ig.db.Transaction(func(tx *gorm.DB) error {
+		if err := ig.create(tx, image); err != nil {
+			return err
+		}
+		image.Caption, image.AltText, image.Tags = caption, altText, tags
+		err := tx.Model(image).UpdateColumns(map[string]interface{}{
+			"caption":  caption,
+			"alt_text": altText,
+		}).Error
+		if err != nil {
+			return err
+		}
+		if tags != nil {
+			if err := setImageTags(tx, image.ID, tags); err != nil {
+				return err
+			}
+		}
+		return refreshImageSearch(tx, image.ID)
+	})
+}
+
+func (ig *imageGorm) Reorder(galleryID uint, filenames []string) error {
+	tx := ig.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for i, filename := range filenames {
+		db := tx.Model(&Image{}).
+			Where("gallery_id = ? AND filename = ?", galleryID, filename).
+			UpdateColumn("position", i+1)
+		err := db.Error
+		if err == nil && db.RowsAffected == 0 {
+			err = translateDBError(tx.Create(&Image{GalleryID: galleryID, Filename: filename, Position: i + 1}).Error)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	where, args := "gallery_id = ?", []interface{}{galleryID}
+	if len(filenames) > 0 {
+		where, args = where+" AND filename NOT IN (?)", append(args, filenames)
+	}
+	if err := deleteImages(tx, where, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Delete removes the row for good, so that an image uploaded
+// later with the same name starts afresh
+func (ig *imageGorm) Delete(image *Image) error {
+	return ig.db.Transaction(func(tx *gorm.DB) error {
+		return deleteImages(tx, "gallery_id = ? AND filename = ?", image.GalleryID, image.Filename)
+	})
+}
+
+func (ig *imageGorm) DeleteAll(galleryID uint) error {
+	return ig.db.Transaction(func(tx *gorm.DB) error {
+		return deleteImages(tx, "gallery_id = ?", galleryID)
+	})
+}
+
+// deleteImages removes the rows matching where along with their
+// tags, tx should be a transaction
+func deleteImages(tx *gorm.DB, where string, args ...interface{}) error {
+	tx = tx.Unscoped()
+	err := tx.Where("image_id IN (SELECT id FROM images WHERE "+where+")", args...).
+		Delete(&imageTag{}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Where(where, args...).Delete(&Image{}).Error
+}
@@ -0,0 +1,161 @@
+package models
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestImageReorder(t *testing.T) {
+	is := testingServices(t).Image
+	// Images are stored relative to the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for _, name := range []string{"c.jpg", "a.jpg", "b.jpg"} {
+		if err := is.Create(1, strings.NewReader(name), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filenames := func() string {
+		images, err := is.ByGalleryID(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, len(images))
+		for i, image := range images {
+			names[i] = image.Filename
+		}
+		return strings.Join(names, ",")
+	}
+	if got := filenames(); got != "c.jpg,a.jpg,b.jpg" {
+		t.Errorf("Expected images in upload order. Received %s", got)
+	}
+
+	if err := is.Reorder(1, []string{"a.jpg", "b.jpg"}); err != ErrImageOrderInvalid {
+		t.Errorf("Expected partial orders to be rejected. Received %v", err)
+	}
+	if err := is.Reorder(1, []string{"a.jpg", "a.jpg", "b.jpg"}); err != ErrImageOrderInvalid {
+		t.Errorf("Expected duplicates to be rejected. Received %v", err)
+	}
+	if err := is.Reorder(1, []string{"b.jpg", "c.jpg", "a.jpg"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := filenames(); got != "b.jpg,c.jpg,a.jpg" {
+		t.Errorf("Expected the new order. Received %s", got)
+	}
+
+	// Replacing an image keeps its place and caption
+	image := Image{GalleryID: 1, Filename: "c.jpg", Caption: "First dance"}
+	if err := is.Update(&image); err != nil {
+		t.Fatal(err)
+	}
+	if err := is.Create(1, strings.NewReader("again"), "c.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	images, err := is.ByGalleryID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if images[1].Filename != "c.jpg" || images[1].Caption != "First dance" {
+		t.Errorf("Expected c.jpg to keep its place and caption. Received %+v", images[1])
+	}
+}
+
+// noImageDB fails the test if an image gets that far
+type noImageDB struct {
+	ImageDB
+	t *testing.T
+}
+
+func (db noImageDB) Create(image *Image) error {
+	db.t.Errorf("Expected %q to be rejected", image.Filename)
+	return nil
+}
+
+func TestImageCreateInvalid(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	is := NewImageService(noImageDB{t: t})
+	for _, name := range []string{"notes.txt", ".jpg", ".hidden.png", "../../.hidden.png", "/"} {
+		if err := is.Create(1, strings.NewReader(name), name); err != ErrImageInvalid {
+			t.Errorf("%q: expected %v. Received %v", name, ErrImageInvalid, err)
+		}
+	}
+	if files, _ := os.ReadDir(ImageDir + "galleries/1"); len(files) > 0 {
+		t.Errorf("Expected no file to be stored. Received %v", files)
+	}
+}
+
+// nopImageDB doesn't keep the details of images
+type nopImageDB struct {
+	ImageDB
+}
+
+func (nopImageDB) Create(image *Image) error      { return nil }
+func (nopImageDB) Delete(image *Image) error      { return nil }
+func (nopImageDB) DeleteAll(galleryID uint) error { return nil }
+
+func TestImageCount(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	is := NewImageService(nopImageDB{})
+	create := func(galleryID uint, name string) {
+		if err := is.Create(galleryID, strings.NewReader(name), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func(want int, msg string) {
+		t.Helper()
+		n, err := is.Count()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("%s: expected %d images. Received %d", msg, want, n)
+		}
+	}
+	// Files stored before the first count are found
+	create(1, "a.jpg")
+	count(1, "first count")
+
+	create(1, "b.jpg")
+	create(2, "c.jpg")
+	count(3, "created")
+	create(1, "a.jpg")
+	count(3, "replaced")
+	if err := is.Delete(&Image{GalleryID: 1, Filename: "b.jpg"}); err != nil {
+		t.Fatal(err)
+	}
+	count(2, "deleted")
+	if err := is.DeleteAll(1); err != nil {
+		t.Fatal(err)
+	}
+	count(1, "gallery deleted")
+
+	// The tree is only globbed once
+	if err := os.WriteFile(ImageDir+"galleries/2/d.jpg", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	count(1, "cached")
+}
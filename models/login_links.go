@@ -0,0 +1,148 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/hash"
+	"github.com/apigban/lenslocked_v1/rand"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// LoginLinkTTL is how long a login link can be used
+	LoginLinkTTL = 15 * time.Minute
+
+	loginLinkBytes = 32
+)
+
+// Purposes of login links, a link only works for its own
+const (
+	// LoginLinkSignIn links sign users in
+	LoginLinkSignIn = "sign_in"
+	// LoginLinkDeleteAccount links confirm the deletion of the
+	// account of users who don't have a password to type
+	LoginLinkDeleteAccount = "delete_account"
+)
+
+// LoginLink is emailed to users who'd rather not type a password,
+// clicking it signs them in once. The email address doesn't need
+// to belong to a user yet, those are signed up when clicking.
+// Links with another Purpose prove the same way that the user
+// reads the mail sent to their address.
+type LoginLink struct {
+	gorm.Model
+	Email     string `gorm:"not null;index"`
+	Purpose   string `gorm:"not null;default:'sign_in'"`
+	Token     string `gorm:"-"` //not going to be stored in the database
+	TokenHash string `gorm:"not null;unique_index"`
+	ExpiresAt time.Time
+}
+
+// LoginLinkService is a set of methods used to manipulate
+// and work with the login link model
+type LoginLinkService interface {
+	LoginLinkDB
+}
+
+// LoginLinkDB is used to interact with the login_links table
+type LoginLinkDB interface {
+	// Create generates the token, only available in the Token
+	// field after this call. Purpose defaults to LoginLinkSignIn.
+	// Older links with the same purpose to the same email address
+	// stop working.
+	Create(link *LoginLink) error
+	// Redeem looks up and deletes the link with token, so that
+	// it can only be used once. Links with another purpose are
+	// reported as missing.
+	Redeem(token, purpose string) (*LoginLink, error)
+}
+
+func NewLoginLinkService(db *gorm.DB) LoginLinkService {
+	return &loginLinkService{
+		LoginLinkDB: &loginLinkValidator{
+			LoginLinkDB: &loginLinkGorm{db},
+			hmac:        hash.NewHMAC(hmacSecretKey),
+		},
+	}
+}
+
+type loginLinkService struct {
+	LoginLinkDB
+}
+
+var _ LoginLinkDB = &loginLinkValidator{}
+
+type loginLinkValidator struct {
+	LoginLinkDB
+	hmac hash.HMAC
+}
+
+func (lv *loginLinkValidator) Create(link *LoginLink) error {
+	link.Email = strings.ToLower(strings.TrimSpace(link.Email))
+	if link.Email == "" {
+		return ErrEmailRequired
+	}
+	if !emailRegex.MatchString(link.Email) {
+		return ErrEmailInvalid
+	}
+	if link.Purpose == "" {
+		link.Purpose = LoginLinkSignIn
+	}
+	token, err := rand.String(loginLinkBytes)
+	if err != nil {
+		return err
+	}
+	link.Token = token
+	link.TokenHash = lv.hmac.Hash(token)
+	link.ExpiresAt = time.Now().Add(LoginLinkTTL)
+	return lv.LoginLinkDB.Create(link)
+}
+
+// Redeem treats expired links as missing
+func (lv *loginLinkValidator) Redeem(token, purpose string) (*LoginLink, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	link, err := lv.LoginLinkDB.Redeem(lv.hmac.Hash(token), purpose)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(link.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	return link, nil
+}
+
+var _ LoginLinkDB = &loginLinkGorm{}
+
+type loginLinkGorm struct {
+	db *gorm.DB
+}
+
+func (lg *loginLinkGorm) Create(link *LoginLink) error {
+	return lg.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Where("email = ? AND purpose = ?", link.Email, link.Purpose).Delete(&LoginLink{}).Error
+		if err != nil {
+			return err
+		}
+		return translateDBError(tx.Create(link).Error)
+	})
+}
+
+// Redeem expects the token to be hashed
+func (lg *loginLinkGorm) Redeem(tokenHash, purpose string) (*LoginLink, error) {
+	var link LoginLink
+	err := first(lg.db.Where("token_hash = ? AND purpose = ?", tokenHash, purpose), &link)
+	if err != nil {
+		return nil, err
+	}
+	db := lg.db.Unscoped().Where("id = ?", link.ID).Delete(&LoginLink{})
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	if db.RowsAffected == 0 {
+		return nil, ErrNotFound
+	}
+	return &link, nil
+}
@@ -0,0 +1,82 @@
+package models
+
+import "github.com/jinzhu/gorm"
+
+// How users signed in, see Login
+const (
+	LoginMethodPassword = "password"
+	LoginMethodSignup   = "signup"
+	LoginMethodLink     = "link"
+	LoginMethodProvider = "provider"
+)
+
+// userAgentMaxLength bounds the user agents kept with logins,
+// they are sent by the client
+const userAgentMaxLength = 512
+
+// Login records a user signing in, for their login history
+type Login struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	Method    string `gorm:"not null"`
+	IP        string
+	UserAgent string
+}
+
+// LoginService is a set of methods used to manipulate
+// and work with the login model
+type LoginService interface {
+	LoginDB
+}
+
+// LoginDB is used to interact with the logins table
+type LoginDB interface {
+	// ByUserID returns the logins of the user, latest first
+	ByUserID(userID uint) ([]Login, error)
+	Create(login *Login) error
+}
+
+func NewLoginService(db *gorm.DB) LoginService {
+	return &loginService{
+		LoginDB: &loginValidator{&loginGorm{db}},
+	}
+}
+
+type loginService struct {
+	LoginDB
+}
+
+var _ LoginDB = &loginValidator{}
+
+type loginValidator struct {
+	LoginDB
+}
+
+func (lv *loginValidator) Create(login *Login) error {
+	if login.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	if len(login.UserAgent) > userAgentMaxLength {
+		login.UserAgent = login.UserAgent[:userAgentMaxLength]
+	}
+	return lv.LoginDB.Create(login)
+}
+
+var _ LoginDB = &loginGorm{}
+
+type loginGorm struct {
+	db *gorm.DB
+}
+
+func (lg *loginGorm) ByUserID(userID uint) ([]Login, error) {
+	var logins []Login
+	err := lg.db.Where("user_id = ?", userID).Order("created_at desc").Find(&logins).Error
+	if err != nil {
+		return nil, err
+	}
+	return logins, nil
+}
+
+func (lg *loginGorm) Create(login *Login) error {
+	return translateDBError(lg.db.Create(login).Error)
+}
@@ -0,0 +1,533 @@
+package models
+
+import (
+	"crypto/hmac"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/hash"
+	"github.com/apigban/lenslocked_v1/rand"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// OAuthAccessPrefix and OAuthRefreshPrefix tell OAuth tokens
+	// apart from API tokens, see APITokenPrefix
+	OAuthAccessPrefix  = "llo_"
+	OAuthRefreshPrefix = "llr_"
+
+	// OAuthCodeTTL is how long an authorization code can be
+	// exchanged for tokens
+	OAuthCodeTTL = 10 * time.Minute
+	// OAuthAccessTTL is how long an access token is valid, apps
+	// get a new one with their refresh token
+	OAuthAccessTTL = time.Hour
+	// OAuthRefreshTTL is how long a refresh token can be used.
+	// Every refresh starts it over, apps left unused for longer
+	// have to be authorized again.
+	OAuthRefreshTTL = 30 * 24 * time.Hour
+
+	oauthClientIDBytes = 16
+	oauthSecretBytes   = 32
+	oauthTokenBytes    = 32
+)
+
+// OAuthClient is a third-party app registered by a user. Public
+// clients, eg. mobile apps, can't keep a secret and rely on PKCE
+// alone, confidential clients also authenticate with a secret.
+type OAuthClient struct {
+	gorm.Model
+	UserID       uint   `gorm:"not null;index"`
+	Name         string `gorm:"not null"`
+	ClientID     string `gorm:"not null;unique_index"`
+	Confidential bool   `gorm:"not null"`
+	Secret       string `gorm:"-"` //not going to be stored in the database
+	SecretHash   string
+	RedirectURIs string `gorm:"not null"` // space separated
+}
+
+// RedirectURIList returns the URIs the client may redirect to
+func (c *OAuthClient) RedirectURIList() []string {
+	return strings.Fields(c.RedirectURIs)
+}
+
+// HasRedirectURI reports whether uri was registered by the
+// client. URIs are compared as is, never by prefix.
+func (c *OAuthClient) HasRedirectURI(uri string) bool {
+	for _, u := range c.RedirectURIList() {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// OAuthCode is the authorization code handed to a client once the
+// user consented, it is exchanged for an OAuthToken
+type OAuthCode struct {
+	gorm.Model
+	Code          string `gorm:"-"` //not going to be stored in the database
+	CodeHash      string `gorm:"not null;unique_index"`
+	ClientID      uint   `gorm:"not null"` // OAuthClient.ID
+	UserID        uint   `gorm:"not null"`
+	RedirectURI   string `gorm:"not null"`
+	Scopes        string `gorm:"not null"`
+	CodeChallenge string `gorm:"not null"` // PKCE, S256 only
+	ExpiresAt     time.Time
+}
+
+// OAuthToken is the grant of a user to a client: a short lived
+// access token and the refresh token used to renew it. Both are
+// stored as HMACs only.
+type OAuthToken struct {
+	gorm.Model
+	ClientID         uint   `gorm:"not null;index"` // OAuthClient.ID
+	UserID           uint   `gorm:"not null;index"`
+	Scopes           string `gorm:"not null"`
+	AccessToken      string `gorm:"-"`
+	AccessHash       string `gorm:"not null;unique_index"`
+	AccessExpiresAt  time.Time
+	RefreshToken     string `gorm:"-"`
+	RefreshHash      string `gorm:"not null;unique_index"`
+	RefreshExpiresAt time.Time
+}
+
+// HasScope reports whether the user granted scope to the client
+func (t *OAuthToken) HasScope(scope string) bool {
+	return hasScope(t.Scopes, scope)
+}
+
+// OAuthService is a set of methods used to manipulate
+// and work with the OAuth models
+type OAuthService interface {
+	// AuthenticateClient checks the secret of a confidential
+	// client. ErrPasswordIncorrect is returned if it is wrong.
+	AuthenticateClient(clientID, secret string) (*OAuthClient, error)
+
+	// RefreshToken replaces both tokens of the grant matching
+	// refresh, as long as it was issued to the client with the
+	// provided ID and didn't expire. The old refresh token can't
+	// be used again.
+	RefreshToken(clientID uint, refresh string) (*OAuthToken, error)
+
+	OAuthDB
+}
+
+// OAuthDB is used to interact with the OAuth tables
+type OAuthDB interface {
+	ClientByClientID(clientID string) (*OAuthClient, error)
+	ClientsByUserID(userID uint) ([]OAuthClient, error)
+	// CreateClient generates the client ID and, for confidential
+	// clients, a secret only available in the Secret field after
+	// this call
+	CreateClient(client *OAuthClient) error
+	// DeleteClient removes the client with the provided ID, as
+	// long as it belongs to the user with the provided ID, and
+	// revokes every token issued to it
+	DeleteClient(id, userID uint) error
+	// AuthorizedClients returns the clients the user with the
+	// provided ID granted access to, whoever registered them
+	AuthorizedClients(userID uint) ([]OAuthClient, error)
+	// RevokeClient deletes the tokens and codes the client with
+	// the provided ID was issued by the user with the provided ID
+	RevokeClient(id, userID uint) error
+
+	CreateCode(code *OAuthCode) error
+	// RedeemCode looks up and deletes code, so that it can only
+	// be exchanged once
+	RedeemCode(code string) (*OAuthCode, error)
+
+	CreateToken(token *OAuthToken) error
+	ByAccessToken(token string) (*OAuthToken, error)
+	ByRefreshToken(refresh string) (*OAuthToken, error)
+	// RotateToken saves the new hashes of token, as long as its
+	// refresh hash still is refreshHash
+	RotateToken(token *OAuthToken, refreshHash string) error
+}
+
+func NewOAuthService(db *gorm.DB) OAuthService {
+	return &oauthService{
+		oauthValidator: &oauthValidator{
+			OAuthDB: &oauthGorm{db},
+			hmac:    hash.NewHMAC(hmacSecretKey),
+		},
+	}
+}
+
+// oauthService embeds the validator itself, rather than the
+// OAuthDB interface, to share its HMAC
+type oauthService struct {
+	*oauthValidator
+}
+
+// AuthenticateClient compares the HMAC of secret with the one
+// stored for the client, in constant time
+func (s *oauthService) AuthenticateClient(clientID, secret string) (*OAuthClient, error) {
+	client, err := s.ClientByClientID(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if !client.Confidential {
+		return client, nil
+	}
+	hashed := s.hmac.Hash(secret)
+	if secret == "" || !hmac.Equal([]byte(hashed), []byte(client.SecretHash)) {
+		return nil, ErrPasswordIncorrect
+	}
+	return client, nil
+}
+
+// RefreshToken is defined on oauthService rather than the
+// validator because it goes through the DB layer twice
+func (s *oauthService) RefreshToken(clientID uint, refresh string) (*OAuthToken, error) {
+	token, err := s.ByRefreshToken(refresh)
+	if err != nil {
+		return nil, err
+	}
+	if token.ClientID != clientID || time.Now().After(token.RefreshExpiresAt) {
+		return nil, ErrNotFound
+	}
+	refreshHash := token.RefreshHash
+	if err := s.newTokens(token); err != nil {
+		return nil, err
+	}
+	if err := s.RotateToken(token, refreshHash); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+var _ OAuthDB = &oauthValidator{}
+
+type oauthValidator struct {
+	OAuthDB
+	hmac hash.HMAC
+}
+
+func (ov *oauthValidator) CreateClient(client *OAuthClient) error {
+	err := collectValFuncs(client,
+		ov.clientNameRequired,
+		ov.redirectURIsValid)
+	if err != nil {
+		return err
+	}
+	err = runOAuthClientValFuncs(client,
+		ov.clientUserIDRequired,
+		ov.generateClientID,
+		ov.generateSecret)
+	if err != nil {
+		return err
+	}
+	return ov.OAuthDB.CreateClient(client)
+}
+
+func (ov *oauthValidator) clientUserIDRequired(c *OAuthClient) error {
+	if c.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (ov *oauthValidator) clientNameRequired(c *OAuthClient) error {
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" {
+		return ErrNameRequired
+	}
+	return nil
+}
+
+// redirectURIsValid requires absolute https URIs without a
+// fragment. Plain http is only allowed for apps running on the
+// user's machine.
+func (ov *oauthValidator) redirectURIsValid(c *OAuthClient) error {
+	uris := c.RedirectURIList()
+	if len(uris) == 0 {
+		return ErrRedirectURIRequired
+	}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil || u.Host == "" || u.Fragment != "" {
+			return ErrRedirectURIInvalid
+		}
+		switch {
+		case u.Scheme == "https":
+		case u.Scheme == "http" && (u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1"):
+		default:
+			return ErrRedirectURIInvalid
+		}
+	}
+	c.RedirectURIs = strings.Join(uris, " ")
+	return nil
+}
+
+func (ov *oauthValidator) generateClientID(c *OAuthClient) error {
+	id, err := rand.String(oauthClientIDBytes)
+	if err != nil {
+		return err
+	}
+	c.ClientID = id
+	return nil
+}
+
+func (ov *oauthValidator) generateSecret(c *OAuthClient) error {
+	if !c.Confidential {
+		c.Secret = ""
+		c.SecretHash = ""
+		return nil
+	}
+	secret, err := rand.String(oauthSecretBytes)
+	if err != nil {
+		return err
+	}
+	c.Secret = secret
+	c.SecretHash = ov.hmac.Hash(secret)
+	return nil
+}
+
+func (ov *oauthValidator) CreateCode(code *OAuthCode) error {
+	scopes, err := normalizeScopes(code.Scopes)
+	if err != nil {
+		return err
+	}
+	code.Scopes = scopes
+	if code.ClientID <= 0 || code.UserID <= 0 || code.CodeChallenge == "" {
+		return ErrIDInvalid
+	}
+	raw, err := rand.String(oauthTokenBytes)
+	if err != nil {
+		return err
+	}
+	code.Code = raw
+	code.CodeHash = ov.hmac.Hash(raw)
+	code.ExpiresAt = time.Now().Add(OAuthCodeTTL)
+	return ov.OAuthDB.CreateCode(code)
+}
+
+// RedeemCode treats expired codes as missing
+func (ov *oauthValidator) RedeemCode(code string) (*OAuthCode, error) {
+	if code == "" {
+		return nil, ErrNotFound
+	}
+	ret, err := ov.OAuthDB.RedeemCode(ov.hmac.Hash(code))
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(ret.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	return ret, nil
+}
+
+func (ov *oauthValidator) CreateToken(token *OAuthToken) error {
+	scopes, err := normalizeScopes(token.Scopes)
+	if err != nil {
+		return err
+	}
+	token.Scopes = scopes
+	if token.ClientID <= 0 || token.UserID <= 0 {
+		return ErrIDInvalid
+	}
+	if err := ov.newTokens(token); err != nil {
+		return err
+	}
+	return ov.OAuthDB.CreateToken(token)
+}
+
+// newTokens generates the access and refresh tokens of token
+func (ov *oauthValidator) newTokens(token *OAuthToken) error {
+	access, err := rand.String(oauthTokenBytes)
+	if err != nil {
+		return err
+	}
+	refresh, err := rand.String(oauthTokenBytes)
+	if err != nil {
+		return err
+	}
+	token.AccessToken = OAuthAccessPrefix + access
+	token.AccessHash = ov.hmac.Hash(token.AccessToken)
+	token.AccessExpiresAt = time.Now().Add(OAuthAccessTTL)
+	token.RefreshToken = OAuthRefreshPrefix + refresh
+	token.RefreshHash = ov.hmac.Hash(token.RefreshToken)
+	token.RefreshExpiresAt = time.Now().Add(OAuthRefreshTTL)
+	return nil
+}
+
+// ByAccessToken treats expired access tokens as missing
+func (ov *oauthValidator) ByAccessToken(token string) (*OAuthToken, error) {
+	if !strings.HasPrefix(token, OAuthAccessPrefix) {
+		return nil, ErrNotFound
+	}
+	ret, err := ov.OAuthDB.ByAccessToken(ov.hmac.Hash(token))
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(ret.AccessExpiresAt) {
+		return nil, ErrNotFound
+	}
+	return ret, nil
+}
+
+func (ov *oauthValidator) ByRefreshToken(refresh string) (*OAuthToken, error) {
+	if !strings.HasPrefix(refresh, OAuthRefreshPrefix) {
+		return nil, ErrNotFound
+	}
+	return ov.OAuthDB.ByRefreshToken(ov.hmac.Hash(refresh))
+}
+
+var _ OAuthDB = &oauthGorm{}
+
+type oauthGorm struct {
+	db *gorm.DB
+}
+
+func (og *oauthGorm) ClientByClientID(clientID string) (*OAuthClient, error) {
+	var client OAuthClient
+	err := first(og.db.Where("client_id = ?", clientID), &client)
+	if err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+func (og *oauthGorm) ClientsByUserID(userID uint) ([]OAuthClient, error) {
+	var clients []OAuthClient
+	err := og.db.Where("user_id = ?", userID).Order("created_at desc").Find(&clients).Error
+	if err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func (og *oauthGorm) CreateClient(client *OAuthClient) error {
+	return translateDBError(og.db.Create(client).Error)
+}
+
+func (og *oauthGorm) DeleteClient(id, userID uint) error {
+	return og.db.Transaction(func(tx *gorm.DB) error {
+		db := tx.Where("id = ? AND user_id = ?", id, userID).Delete(&OAuthClient{})
+		if db.Error != nil {
+			return db.Error
+		}
+		if db.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		if err := tx.Where("client_id = ?", id).Delete(&OAuthCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("client_id = ?", id).Delete(&OAuthToken{}).Error
+	})
+}
+
+// AuthorizedClients lists the clients by name
+func (og *oauthGorm) AuthorizedClients(userID uint) ([]OAuthClient, error) {
+	var clients []OAuthClient
+	err := og.db.Where("id IN (SELECT client_id FROM oauth_tokens WHERE user_id = ? AND deleted_at IS NULL)", userID).
+		Order("name").Find(&clients).Error
+	if err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func (og *oauthGorm) RevokeClient(id, userID uint) error {
+	return og.db.Transaction(func(tx *gorm.DB) error {
+		codes := tx.Where("client_id = ? AND user_id = ?", id, userID).Delete(&OAuthCode{})
+		if codes.Error != nil {
+			return codes.Error
+		}
+		tokens := tx.Where("client_id = ? AND user_id = ?", id, userID).Delete(&OAuthToken{})
+		if tokens.Error != nil {
+			return tokens.Error
+		}
+		if codes.RowsAffected+tokens.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (og *oauthGorm) CreateCode(code *OAuthCode) error {
+	return translateDBError(og.db.Create(code).Error)
+}
+
+// RedeemCode expects the code to be hashed. Only the request
+// that manages to delete the code gets it back.
+func (og *oauthGorm) RedeemCode(codeHash string) (*OAuthCode, error) {
+	var code OAuthCode
+	err := first(og.db.Where("code_hash = ?", codeHash), &code)
+	if err != nil {
+		return nil, err
+	}
+	db := og.db.Where("id = ?", code.ID).Delete(&OAuthCode{})
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	if db.RowsAffected == 0 {
+		return nil, ErrNotFound
+	}
+	return &code, nil
+}
+
+func (og *oauthGorm) CreateToken(token *OAuthToken) error {
+	return translateDBError(og.db.Create(token).Error)
+}
+
+// ByAccessToken expects the token to be hashed
+func (og *oauthGorm) ByAccessToken(accessHash string) (*OAuthToken, error) {
+	var token OAuthToken
+	err := first(og.db.Where("access_hash = ?", accessHash), &token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// ByRefreshToken expects the token to be hashed
+func (og *oauthGorm) ByRefreshToken(refreshHash string) (*OAuthToken, error) {
+	var token OAuthToken
+	err := first(og.db.Where("refresh_hash = ?", refreshHash), &token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// RotateToken only updates the row if nobody else rotated it
+// since it was read, so a refresh token can't be used twice
+func (og *oauthGorm) RotateToken(token *OAuthToken, refreshHash string) error {
+	db := og.db.Model(&OAuthToken{}).
+		Where("id = ? AND refresh_hash = ?", token.ID, refreshHash).
+		Updates(map[string]interface{}{
+			"access_hash":        token.AccessHash,
+			"access_expires_at":  token.AccessExpiresAt,
+			"refresh_hash":       token.RefreshHash,
+			"refresh_expires_at": token.RefreshExpiresAt,
+		})
+	if db.Error != nil {
+		return translateDBError(db.Error)
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// migrateOAuthRefreshExpiry gives the refresh tokens issued
+// before they expired a full OAuthRefreshTTL from now
+func migrateOAuthRefreshExpiry(db *gorm.DB) error {
+	return db.Model(&OAuthToken{}).Unscoped().
+		Where("refresh_expires_at IS NULL").
+		UpdateColumn("refresh_expires_at", time.Now().Add(OAuthRefreshTTL)).Error
+}
+
+type oauthClientValFunc func(*OAuthClient) error
+
+func runOAuthClientValFuncs(client *OAuthClient, fns ...oauthClientValFunc) error {
+	for _, fn := range fns {
+		if err := fn(client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
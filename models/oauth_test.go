@@ -0,0 +1,60 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/hash"
+)
+
+// grantsByRefresh is an OAuthDB knowing grants by the hash of
+// their refresh token
+type grantsByRefresh struct {
+	OAuthDB
+	tokens map[string]*OAuthToken
+}
+
+func (gr grantsByRefresh) ByRefreshToken(refreshHash string) (*OAuthToken, error) {
+	if token, ok := gr.tokens[refreshHash]; ok {
+		ret := *token
+		return &ret, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (gr grantsByRefresh) RotateToken(token *OAuthToken, refreshHash string) error {
+	return nil
+}
+
+func TestOAuthRefreshToken(t *testing.T) {
+	hmac := hash.NewHMAC(hmacSecretKey)
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	s := &oauthService{&oauthValidator{
+		OAuthDB: grantsByRefresh{tokens: map[string]*OAuthToken{
+			hmac.Hash("llr_valid"):   {ClientID: 1, RefreshExpiresAt: future},
+			hmac.Hash("llr_expired"): {ClientID: 1, RefreshExpiresAt: past},
+		}},
+		hmac: hmac,
+	}}
+	tests := []struct {
+		name     string
+		clientID uint
+		refresh  string
+		want     error
+	}{
+		{"valid", 1, "llr_valid", nil},
+		{"expired", 1, "llr_expired", ErrNotFound},
+		{"other client", 2, "llr_valid", ErrNotFound},
+		{"unknown", 1, "llr_unknown", ErrNotFound},
+	}
+	for _, tt := range tests {
+		token, err := s.RefreshToken(tt.clientID, tt.refresh)
+		if err != tt.want {
+			t.Errorf("%s: expected %v. Received %v", tt.name, tt.want, err)
+			continue
+		}
+		if err == nil && token.RefreshExpiresAt.Before(time.Now().Add(OAuthRefreshTTL-time.Minute)) {
+			t.Errorf("%s: expected the refresh token to last another %v. Expires at %v", tt.name, OAuthRefreshTTL, token.RefreshExpiresAt)
+		}
+	}
+}
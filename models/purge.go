@@ -0,0 +1,136 @@
+package models
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// PurgeUsers deletes for good the users whose PurgeAt passed, as
+// well as users soft deleted with UserDB.Delete, along with their
+// galleries, images, sessions, tokens, login history and data
+// exports. It returns how many users were purged. A user that
+// can't be purged doesn't hold up the others, the error lists
+// every failure and they are tried again on the next call.
+func (s *Services) PurgeUsers() (int, error) {
+	var users []User
+	err := s.db.Unscoped().
+		Where("purge_at <= ? OR deleted_at IS NOT NULL", time.Now()).
+		Find(&users).Error
+	if err != nil {
+		return 0, err
+	}
+	var errs purgeErrors
+	for _, user := range users {
+		if err := s.purgeUser(&user); err != nil {
+			errs = append(errs, fmt.Errorf("user %d: %w", user.ID, err))
+		}
+	}
+	if len(errs) > 0 {
+		return len(users) - len(errs), errs
+	}
+	return len(users), nil
+}
+
+// purgeErrors are the failures of PurgeUsers
+type purgeErrors []error
+
+func (e purgeErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// purgeUser deletes the images of user first: if that fails the
+// rows are still there for the next attempt. Sessions go with
+// the user row, which holds the remember token.
+func (s *Services) purgeUser(user *User) error {
+	var galleries []Gallery
+	err := s.db.Unscoped().Where("user_id = ?", user.ID).Find(&galleries).Error
+	if err != nil {
+		return err
+	}
+	for _, gallery := range galleries {
+		if err := s.Image.DeleteAll(gallery.ID); err != nil {
+			return err
+		}
+	}
+	var exports []Export
+	err = s.db.Unscoped().Where("user_id = ?", user.ID).Find(&exports).Error
+	if err != nil {
+		return err
+	}
+	for _, export := range exports {
+		if err := removeExport(&export); err != nil {
+			return err
+		}
+	}
+
+	// Tokens issued by the apps of the user to other users go
+	// with the apps
+	const byUserOrApp = "user_id = ? OR client_id IN (SELECT id FROM oauth_clients WHERE user_id = ?)"
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		tx = tx.Unscoped()
+		for _, d := range []struct {
+			model interface{}
+			where string
+			args  []interface{}
+		}{
+			{&ShareLink{}, "gallery_id IN (SELECT id FROM galleries WHERE user_id = ?)", []interface{}{user.ID}},
+			{&galleryTag{}, "gallery_id IN (SELECT id FROM galleries WHERE user_id = ?)", []interface{}{user.ID}},
+			{&GalleryMember{}, "user_id = ? OR email = ? OR gallery_id IN (SELECT id FROM galleries WHERE user_id = ?)", []interface{}{user.ID, user.Email, user.ID}},
+			{&Gallery{}, "user_id = ?", []interface{}{user.ID}},
+			{&APIToken{}, "user_id = ?", []interface{}{user.ID}},
+			{&OAuthToken{}, byUserOrApp, []interface{}{user.ID, user.ID}},
+			{&OAuthCode{}, byUserOrApp, []interface{}{user.ID, user.ID}},
+			{&OAuthClient{}, "user_id = ?", []interface{}{user.ID}},
+			{&Identity{}, "user_id = ?", []interface{}{user.ID}},
+			{&Login{}, "user_id = ?", []interface{}{user.ID}},
+			{&Export{}, "user_id = ?", []interface{}{user.ID}},
+			{&User{}, "id = ?", []interface{}{user.ID}},
+		} {
+			if err := tx.Where(d.where, d.args...).Delete(d.model).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PurgeExports deletes the archives that expired, and failed
+// exports once they would have. It returns how many exports were
+// purged.
+func (s *Services) PurgeExports() (int, error) {
+	var exports []Export
+	now := time.Now()
+	err := s.db.Unscoped().
+		Where("(status = ? AND expires_at <= ?) OR (status = ? AND created_at <= ?)",
+			ExportReady, now, ExportFailed, now.Add(-ExportTTL)).
+		Find(&exports).Error
+	if err != nil {
+		return 0, err
+	}
+	for i, export := range exports {
+		if err := removeExport(&export); err != nil {
+			return i, err
+		}
+		if err := s.db.Unscoped().Delete(&export).Error; err != nil {
+			return i, err
+		}
+	}
+	return len(exports), nil
+}
+
+// removeExport deletes the archive of export, if it was built
+func removeExport(export *Export) error {
+	err := os.Remove(export.Path())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
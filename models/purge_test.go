@@ -0,0 +1,75 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPurgeUsers(t *testing.T) {
+	services := testingServices(t)
+	user := User{
+		Name:     "Toby Flenderson",
+		Email:    "toby@dundermifflin.com",
+		Password: "password",
+	}
+	if err := services.User.Create(&user); err != nil {
+		t.Fatal(err)
+	}
+	gallery := Gallery{UserID: user.ID, Title: "Costa Rica"}
+	if err := services.Gallery.Create(&gallery); err != nil {
+		t.Fatal(err)
+	}
+	token := APIToken{UserID: user.ID, Name: "backup", Scopes: ScopeGalleriesRead}
+	if err := services.APIToken.Create(&token); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing to purge during the grace period
+	purgeAt := time.Now().Add(time.Hour)
+	user.PurgeAt = &purgeAt
+	if err := services.User.Update(&user); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := services.PurgeUsers(); n != 0 || err != nil {
+		t.Fatalf("Expected no user to be purged. Received %d, %v", n, err)
+	}
+
+	purgeAt = time.Now().Add(-time.Minute)
+	if err := services.User.Update(&user); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := services.PurgeUsers(); n != 1 || err != nil {
+		t.Fatalf("Expected the user to be purged. Received %d, %v", n, err)
+	}
+	var count int
+	services.db.Unscoped().Model(&User{}).Where("id = ?", user.ID).Count(&count)
+	if count != 0 {
+		t.Error("Expected the user row to be deleted")
+	}
+	services.db.Unscoped().Model(&Gallery{}).Where("user_id = ?", user.ID).Count(&count)
+	if count != 0 {
+		t.Error("Expected the galleries to be deleted")
+	}
+	if _, err := services.APIToken.ByToken(token.Token); err != ErrNotFound {
+		t.Errorf("Expected the API token to be deleted. Received %v", err)
+	}
+}
+
+// TestCreateUserEmailDeleted signs up again with the email address
+// of a deleted user that wasn't purged yet
+func TestCreateUserEmailDeleted(t *testing.T) {
+	us := testingServices(t).User
+	for i := 0; i < 2; i++ {
+		user := User{
+			Name:     "Ryan Howard",
+			Email:    "ryan@dundermifflin.com",
+			Password: "password",
+		}
+		if err := us.Create(&user); err != nil {
+			t.Fatal(err)
+		}
+		if err := us.Delete(user.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// SearchPerPage is the number of search results on each page
+const SearchPerPage = 20
+
+// Galleries and images are searched through a tsvector column,
+// kept up to date by the code saving them since tags live in other
+// tables. The 'simple' configuration doesn't stem words, titles
+// and captions are written in any language.
+const (
+	gallerySearchVector = `setweight(to_tsvector('simple', coalesce(galleries.title, '')), 'A') ||
+		setweight(to_tsvector('simple', coalesce((SELECT string_agg(tags.name, ' ') FROM gallery_tags JOIN tags ON tags.id = gallery_tags.tag_id WHERE gallery_tags.gallery_id = galleries.id), '')), 'A') ||
+		setweight(to_tsvector('simple', coalesce(galleries.description, '')), 'B')`
+
+	imageSearchVector = `setweight(to_tsvector('simple', coalesce((SELECT string_agg(tags.name, ' ') FROM image_tags JOIN tags ON tags.id = image_tags.tag_id WHERE image_tags.image_id = images.id), '')), 'A') ||
+		setweight(to_tsvector('simple', coalesce(images.caption, '')), 'B') ||
+		setweight(to_tsvector('simple', coalesce(images.alt_text, '')), 'C')`
+)
+
+// SearchHit is a gallery, or one of its images, matching a search
+type SearchHit struct {
+	Gallery *Gallery
+	// Image is nil when the gallery itself matched
+	Image *Image
+}
+
+// SearchResults is a page of hits, best matches first
+type SearchResults struct {
+	Hits []SearchHit
+	// Total is the number of hits across every page
+	Total int
+}
+
+// SearchService finds galleries and images by their title,
+// description, caption, alt text and tags
+type SearchService interface {
+	// Search returns the given page, starting at 1, of the hits
+	// for query among the galleries user may view, see
+	// GalleryService.Authorize. user is nil for visitors who aren't
+	// signed in, they only find public galleries. Unlisted ones
+	// are only found by their owner and members.
+	Search(user *User, query string, page int) (*SearchResults, error)
+}
+
+func NewSearchService(db *gorm.DB) SearchService {
+	return &searchService{db}
+}
+
+type searchService struct {
+	db *gorm.DB
+}
+
+// searchHitRow is a row of the search query, ImageID is 0 for
+// galleries
+type searchHitRow struct {
+	GalleryID uint
+	ImageID   uint
+}
+
+func (ss *searchService) Search(user *User, query string, page int) (*SearchResults, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return &SearchResults{}, nil
+	}
+	if page < 1 {
+		page = 1
+	}
+	hits, args := searchHitsQuery(user, query)
+
+	var ret SearchResults
+	err := ss.db.Raw("SELECT COUNT(*) FROM ("+hits+") hits", args...).Row().Scan(&ret.Total)
+	if err != nil {
+		return nil, err
+	}
+	var rows []searchHitRow
+	err = ss.db.Raw("SELECT gallery_id, image_id FROM ("+hits+") hits ORDER BY rank DESC, gallery_id DESC, image_id LIMIT ? OFFSET ?",
+		append(args, SearchPerPage, (page-1)*SearchPerPage)...).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return &ret, nil
+	}
+
+	var galleryIDs, imageIDs []uint
+	for _, row := range rows {
+		galleryIDs = append(galleryIDs, row.GalleryID)
+		if row.ImageID != 0 {
+			imageIDs = append(imageIDs, row.ImageID)
+		}
+	}
+	var galleries []Gallery
+	if err := ss.db.Where("id IN (?)", galleryIDs).Find(&galleries).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]*Gallery, len(galleries))
+	for i := range galleries {
+		byID[galleries[i].ID] = &galleries[i]
+	}
+	images := make(map[uint]*Image, len(imageIDs))
+	if len(imageIDs) > 0 {
+		var found []Image
+		if err := ss.db.Where("id IN (?)", imageIDs).Find(&found).Error; err != nil {
+			return nil, err
+		}
+		for i := range found {
+			images[found[i].ID] = &found[i]
+		}
+	}
+	for _, row := range rows {
+		hit := SearchHit{Gallery: byID[row.GalleryID]}
+		if row.ImageID != 0 {
+			hit.Image = images[row.ImageID]
+		}
+		// Deleted between the queries
+		if hit.Gallery == nil || (row.ImageID != 0 && hit.Image == nil) {
+			continue
+		}
+		ret.Hits = append(ret.Hits, hit)
+	}
+	return &ret, nil
+}
+
+// searchHitsQuery returns the query listing the galleries and
+// images matching query that user may view, with their rank
+func searchHitsQuery(user *User, query string) (string, []interface{}) {
+	scope := "g.visibility = ?"
+	scopeArgs := []interface{}{VisibilityPublic}
+	if user != nil {
+		// Pending invites have a user_id of 0, which is never the
+		// ID of a user
+		scope = "(g.visibility = ? OR g.user_id = ? OR g.id IN (SELECT gallery_id FROM gallery_members WHERE user_id = ? AND deleted_at IS NULL))"
+		scopeArgs = append(scopeArgs, user.ID, user.ID)
+	}
+	// Galleries of users deleting their account are left out
+	sql := fmt.Sprintf(`SELECT g.id AS gallery_id, 0 AS image_id, ts_rank(g.search_vector, q) AS rank
+		FROM galleries g
+		JOIN users u ON u.id = g.user_id AND u.purge_at IS NULL
+		CROSS JOIN websearch_to_tsquery('simple', ?) q
+		WHERE g.deleted_at IS NULL AND g.search_vector @@ q AND %[1]s
+		UNION ALL
+		SELECT g.id, i.id, ts_rank(i.search_vector, q)
+		FROM images i
+		JOIN galleries g ON g.id = i.gallery_id AND g.deleted_at IS NULL
+		JOIN users u ON u.id = g.user_id AND u.purge_at IS NULL
+		CROSS JOIN websearch_to_tsquery('simple', ?) q
+		WHERE i.deleted_at IS NULL AND i.search_vector @@ q AND %[1]s`, scope)
+	args := []interface{}{query}
+	args = append(args, scopeArgs...)
+	args = append(args, query)
+	args = append(args, scopeArgs...)
+	return sql, args
+}
+
+// refreshGallerySearch recomputes the search vector of the gallery
+func refreshGallerySearch(db *gorm.DB, galleryID uint) error {
+	return db.Exec("UPDATE galleries SET search_vector = "+gallerySearchVector+" WHERE id = ?", galleryID).Error
+}
+
+// refreshImageSearch recomputes the search vector of the image row
+func refreshImageSearch(db *gorm.DB, imageID uint) error {
+	return db.Exec("UPDATE images SET search_vector = "+imageSearchVector+" WHERE id = ?", imageID).Error
+}
+
+// migrateSearch adds the search vectors and their GIN indexes,
+// which gorm can't create, and fills in the vectors of the rows
+// saved before they existed
+func migrateSearch(db *gorm.DB) error {
+	for _, stmt := range []string{
+		"ALTER TABLE galleries ADD COLUMN IF NOT EXISTS search_vector tsvector",
+		"ALTER TABLE images ADD COLUMN IF NOT EXISTS search_vector tsvector",
+		"CREATE INDEX IF NOT EXISTS idx_galleries_search_vector ON galleries USING GIN (search_vector)",
+		"CREATE INDEX IF NOT EXISTS idx_images_search_vector ON images USING GIN (search_vector)",
+		"UPDATE galleries SET search_vector = " + gallerySearchVector + " WHERE search_vector IS NULL",
+		"UPDATE images SET search_vector = " + imageSearchVector + " WHERE search_vector IS NULL",
+	} {
+		if err := db.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
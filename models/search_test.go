@@ -0,0 +1,122 @@
+package models
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	got := normalizeTags(ParseTags(" Beach, #sunset,,beach , Golden  Hour"))
+	want := []string{"beach", "sunset", "golden hour"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %q. Received %q", want, got)
+	}
+	if normalizeTags(nil) != nil {
+		t.Error("Expected nil tags to stay nil, leaving tags unchanged")
+	}
+	if got := ParseTags(""); got == nil || len(got) != 0 {
+		t.Errorf("Expected an empty list, removing every tag. Received %#v", got)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	s := testingServices(t)
+	// Images are stored relative to the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	owner := &User{Model: gorm.Model{ID: 1}}
+	member := &User{Model: gorm.Model{ID: 2}, Email: "member@example.com"}
+	other := &User{Model: gorm.Model{ID: 3}}
+	galleries := map[string]*Gallery{
+		"public":   {UserID: owner.ID, Title: "Beach trip", Visibility: VisibilityPublic, Tags: []string{"summer"}},
+		"unlisted": {UserID: owner.ID, Title: "Wedding", Visibility: VisibilityUnlisted, Description: "At the beach"},
+		"private":  {UserID: owner.ID, Title: "Family", Tags: []string{"Beach"}},
+		"shared":   {UserID: owner.ID, Title: "Hiking", Description: "Mountains and beaches"},
+	}
+	for _, name := range []string{"public", "unlisted", "private", "shared"} {
+		if err := s.Gallery.Create(galleries[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	invite := GalleryMember{GalleryID: galleries["shared"].ID, Email: member.Email, Role: RoleViewer}
+	if err := s.Member.Create(&invite); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Member.Accept(&invite, member, invite.Token); err != nil {
+		t.Fatal(err)
+	}
+	gallery := galleries["shared"]
+	if err := s.Image.Create(gallery.ID, strings.NewReader("img"), "cove.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	image := Image{GalleryID: gallery.ID, Filename: "cove.jpg", Caption: "A quiet cove", Tags: []string{"beach"}}
+	if err := s.Image.Update(&image); err != nil {
+		t.Fatal(err)
+	}
+
+	// hits lists the titles of the galleries found, followed by
+	// the filename of the image for image hits
+	hits := func(user *User, query string) []string {
+		results, err := s.Search.Search(user, query, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ret []string
+		for _, hit := range results.Hits {
+			name := hit.Gallery.Title
+			if hit.Image != nil {
+				name += "/" + hit.Image.Filename
+			}
+			ret = append(ret, name)
+		}
+		if len(ret) != results.Total {
+			t.Errorf("%q: expected a total of %d. Received %d", query, len(ret), results.Total)
+		}
+		return ret
+	}
+	tests := []struct {
+		name  string
+		user  *User
+		query string
+		want  []string
+	}{
+		{"visitor", nil, "beach", []string{"Beach trip"}},
+		{"other", other, "beach", []string{"Beach trip"}},
+		{"member", member, "beach", []string{"Beach trip", "Hiking/cove.jpg"}},
+		{"owner", owner, "beach", []string{"Beach trip", "Family", "Hiking/cove.jpg", "Wedding"}},
+		{"tag", nil, "summer", []string{"Beach trip"}},
+		{"caption", owner, "cove", []string{"Hiking/cove.jpg"}},
+		{"excluded", owner, "beach -summer", []string{"Family", "Hiking/cove.jpg", "Wedding"}},
+	}
+	for _, tt := range tests {
+		got := hits(tt.user, tt.query)
+		// Ranks are left to Postgres, only the hits are checked
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected %q. Received %q", tt.name, tt.want, got)
+		}
+	}
+
+	// Saving a gallery without its tags leaves them in place
+	public := galleries["public"]
+	public.Tags = nil
+	public.Title = "Seaside"
+	if err := s.Gallery.Update(public); err != nil {
+		t.Fatal(err)
+	}
+	if got := hits(nil, "summer"); !reflect.DeepEqual(got, []string{"Seaside"}) {
+		t.Errorf("Expected the tags to be kept. Received %q", got)
+	}
+}
@@ -1,6 +1,11 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jinzhu/gorm"
+)
 
 func NewServices(connectionInfo string) (*Services, error) {
 	db, err := gorm.Open("postgres", connectionInfo)
@@ -8,17 +13,49 @@ func NewServices(connectionInfo string) (*Services, error) {
 		return nil, err
 	}
 	db.LogMode(true) // TODO - remove when env == production
+	members := NewGalleryMemberService(db)
 	return &Services{
-		User:    NewUserService(db),
-		Gallery: NewGalleryService(db),
-		db:      db,
+		User:      NewUserService(db),
+		Gallery:   NewGalleryService(db, members),
+		Member:    members,
+		Image:     NewImageService(NewImageDB(db)),
+		APIToken:  NewAPITokenService(db),
+		OAuth:     NewOAuthService(db),
+		Identity:  NewIdentityService(db),
+		LoginLink: NewLoginLinkService(db),
+		Login:     NewLoginService(db),
+		Export:    NewExportService(db),
+		ShareLink: NewShareLinkService(db),
+		Search:    NewSearchService(db),
+		db:        db,
 	}, nil
 }
 
 type Services struct {
-	Gallery GalleryService
-	User    UserService
-	db      *gorm.DB
+	Gallery   GalleryService
+	Image     ImageService
+	User      UserService
+	APIToken  APITokenService
+	OAuth     OAuthService
+	Identity  IdentityService
+	LoginLink LoginLinkService
+	Login     LoginService
+	Export    ExportService
+	ShareLink ShareLinkService
+	Member    GalleryMemberService
+	Search    SearchService
+	db        *gorm.DB
+}
+
+// DBStats returns the connection pool statistics of the
+// underlying database handle
+func (s *Services) DBStats() sql.DBStats {
+	return s.db.DB().Stats()
+}
+
+// Ping verifies the database connection is still alive
+func (s *Services) Ping(ctx context.Context) error {
+	return s.db.DB().PingContext(ctx)
 }
 
 //Close closes the db connection
@@ -28,7 +65,7 @@ func (s *Services) Close() error {
 
 //DestructiveReset drops and rebuilds all tables
 func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}, &Gallery{}).Error
+	err := s.db.DropTableIfExists(&User{}, &Gallery{}, &APIToken{}, &OAuthClient{}, &OAuthCode{}, &OAuthToken{}, &Identity{}, &LoginLink{}, &Login{}, &Export{}, &ShareLink{}, &GalleryMember{}, &Image{}, &Tag{}, &galleryTag{}, &imageTag{}).Error
 	if err != nil {
 		return err
 	}
@@ -37,6 +74,26 @@ func (s *Services) DestructiveReset() error {
 
 // AutoMigrate will attempt to automatically migrate database tables
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Gallery{}).Error
-
+	err := s.db.AutoMigrate(&User{}, &Gallery{}, &APIToken{}, &OAuthClient{}, &OAuthCode{}, &OAuthToken{}, &Identity{}, &LoginLink{}, &Login{}, &Export{}, &ShareLink{}, &GalleryMember{}, &Image{}, &Tag{}, &galleryTag{}, &imageTag{}).Error
+	if err != nil {
+		return err
+	}
+	if err := migrateSearch(s.db); err != nil {
+		return err
+	}
+	if err := migrateShareLinkKeys(s.db); err != nil {
+		return err
+	}
+	if err := migrateOAuthRefreshExpiry(s.db); err != nil {
+		return err
+	}
+	// Deleted users keep their row until purged, their email
+	// address can be signed up with again right away. gorm can't
+	// create partial indexes, uix_users_email is the full index
+	// older versions created.
+	err = s.db.Exec("DROP INDEX IF EXISTS uix_users_email").Error
+	if err != nil {
+		return err
+	}
+	return s.db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS uix_users_email_active ON users (email) WHERE deleted_at IS NULL").Error
 }
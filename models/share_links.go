@@ -0,0 +1,316 @@
+package models
+
+import (
+	"time"
+
+	"github.com/apigban/lenslocked_v1/hash"
+	"github.com/apigban/lenslocked_v1/rand"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// shareLinkTokenBytes is the number of random bytes in share link
+// tokens. A multiple of 3 keeps the base64 encoded token free of
+// padding.
+const shareLinkTokenBytes = 24
+
+// ShareLink lets anyone with the link view a gallery, whatever its
+// visibility, eg. clients reviewing proofs without an account.
+// Only the HMAC of the token is stored, the link is shown once
+// when it is created.
+type ShareLink struct {
+	gorm.Model
+	GalleryID uint   `gorm:"not null;index"`
+	Token     string `gorm:"-"` //not going to be stored in the database
+	TokenHash string `gorm:"not null;unique_index"`
+	// Password is optional, viewers have to enter it when set
+	Password     string `gorm:"-"` //not going to be stored in the database
+	PasswordHash string
+	ExpiresAt    *time.Time
+	// MaxViews limits how many times the link can be opened,
+	// 0 means there is no limit
+	MaxViews      int `gorm:"not null;default:0"`
+	Views         int `gorm:"not null;default:0"`
+	LastViewedAt  *time.Time
+	AllowDownload bool `gorm:"not null;default:false"`
+	RevokedAt     *time.Time
+	// SessionKey signs the sessions of the viewers of the link. It
+	// is random and never leaves the server, so sessions can't be
+	// made up without opening the link.
+	SessionKey string `gorm:"not null;default:''"`
+}
+
+// HasPassword reports whether viewers have to enter a password
+func (l *ShareLink) HasPassword() bool {
+	return l.PasswordHash != ""
+}
+
+// Active reports whether the link still grants access, it stops
+// when it is revoked or expires
+func (l *ShareLink) Active() bool {
+	if l.RevokedAt != nil {
+		return false
+	}
+	return l.ExpiresAt == nil || time.Now().Before(*l.ExpiresAt)
+}
+
+// Exhausted reports whether the link was opened MaxViews times.
+// Viewers who already opened it can keep browsing the gallery.
+func (l *ShareLink) Exhausted() bool {
+	return l.MaxViews > 0 && l.Views >= l.MaxViews
+}
+
+// ShareLinkService is a set of methods used to manipulate and
+// work with the share link model
+type ShareLinkService interface {
+	// Authenticate checks password against the one of the link,
+	// ErrPasswordIncorrect is returned when it doesn't match
+	Authenticate(link *ShareLink, password string) error
+	ShareLinkDB
+}
+
+// ShareLinkDB is used to interact with the share_links table
+type ShareLinkDB interface {
+	// ByToken looks up an active link from the raw token found in
+	// the link, which is kept in the Token field
+	ByToken(token string) (*ShareLink, error)
+	// ByGalleryID returns every link of the gallery, revoked ones
+	// included, newest first
+	ByGalleryID(galleryID uint) ([]ShareLink, error)
+
+	// Create generates the token of the link, the raw value is
+	// only available in the Token field after this call
+	Create(link *ShareLink) error
+	// RecordView counts a new viewer of the link. ErrNotFound is
+	// returned when the link was already opened MaxViews times.
+	RecordView(link *ShareLink) error
+	// Revoke stops the link with the provided ID from granting
+	// access, as long as it belongs to the gallery with the
+	// provided ID
+	Revoke(id, galleryID uint) error
+}
+
+func NewShareLinkService(db *gorm.DB) ShareLinkService {
+	return &shareLinkService{
+		ShareLinkDB: &shareLinkValidator{
+			ShareLinkDB: &shareLinkGorm{db},
+			hmac:        hash.NewHMAC(hmacSecretKey),
+		},
+	}
+}
+
+type shareLinkService struct {
+	ShareLinkDB
+}
+
+func (ss *shareLinkService) Authenticate(link *ShareLink, password string) error {
+	if !link.HasPassword() {
+		return nil
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password+userPwPepper))
+	switch err {
+	case nil:
+		return nil
+	case bcrypt.ErrMismatchedHashAndPassword:
+		return ErrPasswordIncorrect
+	default:
+		return err
+	}
+}
+
+var _ ShareLinkDB = &shareLinkValidator{}
+
+type shareLinkValidator struct {
+	ShareLinkDB
+	hmac hash.HMAC
+}
+
+// ByToken hashes the token before looking it up and treats
+// inactive links as missing
+func (sv *shareLinkValidator) ByToken(token string) (*ShareLink, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	link, err := sv.ShareLinkDB.ByToken(sv.hmac.Hash(token))
+	if err != nil {
+		return nil, err
+	}
+	if !link.Active() {
+		return nil, ErrNotFound
+	}
+	link.Token = token
+	return link, nil
+}
+
+func (sv *shareLinkValidator) Create(link *ShareLink) error {
+	err := collectValFuncs(link,
+		sv.maxViewsValid)
+	if err != nil {
+		return err
+	}
+	err = runShareLinkValFuncs(link,
+		sv.galleryIDRequired,
+		sv.generateToken,
+		sv.hmacToken,
+		sv.generateSessionKey,
+		sv.bcryptPassword)
+	if err != nil {
+		return err
+	}
+	return sv.ShareLinkDB.Create(link)
+}
+
+// RecordView doesn't bother the database once the link is known
+// to be exhausted
+func (sv *shareLinkValidator) RecordView(link *ShareLink) error {
+	if link.Exhausted() {
+		return ErrNotFound
+	}
+	return sv.ShareLinkDB.RecordView(link)
+}
+
+func (sv *shareLinkValidator) galleryIDRequired(l *ShareLink) error {
+	if l.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (sv *shareLinkValidator) maxViewsValid(l *ShareLink) error {
+	if l.MaxViews < 0 {
+		return ErrMaxViewsInvalid
+	}
+	return nil
+}
+
+func (sv *shareLinkValidator) generateToken(l *ShareLink) error {
+	token, err := rand.String(shareLinkTokenBytes)
+	if err != nil {
+		return err
+	}
+	l.Token = token
+	return nil
+}
+
+func (sv *shareLinkValidator) hmacToken(l *ShareLink) error {
+	l.TokenHash = sv.hmac.Hash(l.Token)
+	return nil
+}
+
+func (sv *shareLinkValidator) generateSessionKey(l *ShareLink) error {
+	key, err := rand.String(shareLinkTokenBytes)
+	if err != nil {
+		return err
+	}
+	l.SessionKey = key
+	return nil
+}
+
+// bcryptPassword hashes the password of the link like the ones
+// of users, see userValidator.bcryptPassword
+func (sv *shareLinkValidator) bcryptPassword(l *ShareLink) error {
+	if l.Password == "" {
+		return nil
+	}
+	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(l.Password+userPwPepper), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	l.PasswordHash = string(hashedBytes)
+	l.Password = ""
+	return nil
+}
+
+var _ ShareLinkDB = &shareLinkGorm{}
+
+type shareLinkGorm struct {
+	db *gorm.DB
+}
+
+// ByToken expects the token to be hashed
+func (sg *shareLinkGorm) ByToken(tokenHash string) (*ShareLink, error) {
+	var link ShareLink
+	err := first(sg.db.Where("token_hash = ?", tokenHash), &link)
+	if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+func (sg *shareLinkGorm) ByGalleryID(galleryID uint) ([]ShareLink, error) {
+	var links []ShareLink
+	err := sg.db.Where("gallery_id = ?", galleryID).Order("created_at desc").Find(&links).Error
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (sg *shareLinkGorm) Create(link *ShareLink) error {
+	return translateDBError(sg.db.Create(link).Error)
+}
+
+// RecordView increments the views in a single statement, so that
+// concurrent viewers can't open the link more than MaxViews times
+func (sg *shareLinkGorm) RecordView(link *ShareLink) error {
+	now := time.Now()
+	db := sg.db.Model(&ShareLink{}).
+		Where("id = ? AND (max_views = 0 OR views < max_views)", link.ID).
+		UpdateColumns(map[string]interface{}{
+			"views":          gorm.Expr("views + 1"),
+			"last_viewed_at": now,
+		})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	link.Views++
+	link.LastViewedAt = &now
+	return nil
+}
+
+func (sg *shareLinkGorm) Revoke(id, galleryID uint) error {
+	db := sg.db.Model(&ShareLink{}).
+		Where("id = ? AND gallery_id = ? AND revoked_at IS NULL", id, galleryID).
+		UpdateColumn("revoked_at", time.Now())
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// migrateShareLinkKeys gives a session key to the links created
+// before they had one
+func migrateShareLinkKeys(db *gorm.DB) error {
+	var links []ShareLink
+	if err := db.Unscoped().Where("session_key = ''").Find(&links).Error; err != nil {
+		return err
+	}
+	for _, link := range links {
+		key, err := rand.String(shareLinkTokenBytes)
+		if err != nil {
+			return err
+		}
+		err = db.Unscoped().Model(&link).UpdateColumn("session_key", key).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type shareLinkValFunc func(*ShareLink) error
+
+func runShareLinkValFuncs(link *ShareLink, fns ...shareLinkValFunc) error {
+	for _, fn := range fns {
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
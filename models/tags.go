@@ -0,0 +1,179 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// maxTagLength is the number of characters a tag may have
+const maxTagLength = 50
+
+// Tag labels galleries and images, eg. "beach" or "wedding". Tags
+// are shared: each name is stored once, galleries and images link
+// to it through the gallery_tags and image_tags tables.
+type Tag struct {
+	ID   uint   `gorm:"primary_key"`
+	Name string `gorm:"not null;unique_index"`
+}
+
+// galleryTag links a gallery to one of its tags
+type galleryTag struct {
+	GalleryID uint `gorm:"primary_key;auto_increment:false"`
+	TagID     uint `gorm:"primary_key;auto_increment:false;index"`
+}
+
+func (galleryTag) TableName() string {
+	return "gallery_tags"
+}
+
+// imageTag links the row of an image to one of its tags
+type imageTag struct {
+	ImageID uint `gorm:"primary_key;auto_increment:false"`
+	TagID   uint `gorm:"primary_key;auto_increment:false;index"`
+}
+
+func (imageTag) TableName() string {
+	return "image_tags"
+}
+
+// ParseTags splits a comma separated list of tags, as typed in
+// forms. The result is never nil, so that saving it removes tags
+// that were left out.
+func ParseTags(s string) []string {
+	ret := []string{}
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			ret = append(ret, tag)
+		}
+	}
+	return ret
+}
+
+// normalizeTags lowercases tags, drops a leading "#" and folds
+// runs of spaces, then removes empty and duplicate tags. nil is
+// kept as is, see Gallery.Tags.
+func normalizeTags(tags []string) []string {
+	if tags == nil {
+		return nil
+	}
+	ret := []string{}
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "#")
+		tag = strings.ToLower(strings.Join(strings.Fields(tag), " "))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		ret = append(ret, tag)
+	}
+	return ret
+}
+
+// tagsValid returns ErrTagInvalid if one of tags is too long
+func tagsValid(tags []string) error {
+	for _, tag := range tags {
+		if len([]rune(tag)) > maxTagLength {
+			return ErrTagInvalid
+		}
+	}
+	return nil
+}
+
+// tagIDs returns the IDs of the tags named names, creating the
+// ones that don't exist yet. Concurrent saves may create the same
+// tag, the conflict leaves the first one in place.
+func tagIDs(tx *gorm.DB, names []string) ([]uint, error) {
+	ids := make([]uint, 0, len(names))
+	for _, name := range names {
+		err := tx.Exec("INSERT INTO tags (name) VALUES (?) ON CONFLICT (name) DO NOTHING", name).Error
+		if err != nil {
+			return nil, err
+		}
+		var tag Tag
+		if err := first(tx.Where("name = ?", name), &tag); err != nil {
+			return nil, err
+		}
+		ids = append(ids, tag.ID)
+	}
+	return ids, nil
+}
+
+// setGalleryTags replaces the tags of the gallery with names
+func setGalleryTags(tx *gorm.DB, galleryID uint, names []string) error {
+	ids, err := tagIDs(tx, names)
+	if err != nil {
+		return err
+	}
+	if err := tx.Where("gallery_id = ?", galleryID).Delete(&galleryTag{}).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err := tx.Exec("INSERT INTO gallery_tags (gallery_id, tag_id) VALUES (?, ?)", galleryID, id).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setImageTags replaces the tags of the image row with names
+func setImageTags(tx *gorm.DB, imageID uint, names []string) error {
+	ids, err := tagIDs(tx, names)
+	if err != nil {
+		return err
+	}
+	if err := tx.Where("image_id = ?", imageID).Delete(&imageTag{}).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err := tx.Exec("INSERT INTO image_tags (image_id, tag_id) VALUES (?, ?)", imageID, id).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// galleryTagNames returns the names of the tags of the gallery,
+// in alphabetical order
+func galleryTagNames(db *gorm.DB, galleryID uint) ([]string, error) {
+	var names []string
+	err := db.Table("tags").
+		Joins("JOIN gallery_tags ON gallery_tags.tag_id = tags.id").
+		Where("gallery_tags.gallery_id = ?", galleryID).
+		Order("tags.name").Pluck("tags.name", &names).Error
+	if err != nil {
+		return nil, err
+	}
+	if names == nil {
+		names = []string{}
+	}
+	return names, nil
+}
+
+// imageTagNames returns the names of the tags of every image of
+// the gallery by the ID of their row, in alphabetical order
+func imageTagNames(db *gorm.DB, galleryID uint) (map[uint][]string, error) {
+	rows, err := db.Table("tags").
+		Select("image_tags.image_id, tags.name").
+		Joins("JOIN image_tags ON image_tags.tag_id = tags.id").
+		Joins("JOIN images ON images.id = image_tags.image_id").
+		Where("images.gallery_id = ?", galleryID).
+		Order("tags.name").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make(map[uint][]string)
+	for rows.Next() {
+		var imageID uint
+		var name string
+		if err := rows.Scan(&imageID, &name); err != nil {
+			return nil, err
+		}
+		ret[imageID] = append(ret[imageID], name)
+	}
+	return ret, rows.Err()
+}
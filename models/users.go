@@ -3,6 +3,7 @@ package models
 import (
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/apigban/lenslocked_v1/hash"
 	"github.com/apigban/lenslocked_v1/rand"
@@ -14,15 +15,30 @@ import (
 const userPwPepper = "peppa"
 const hmacSecretKey = "secret-hmac-key"
 
+var emailRegex = regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`)
+
 // User represents the user model in the database
 type User struct {
 	gorm.Model
 	Name         string
-	Email        string `gorm:"not null;unique_index"`
+	Email        string `gorm:"not null"`
 	Password     string `gorm:"-"` //not going to be stored in the database
 	PasswordHash string `gorm:"not null"`
 	Remember     string `gorm:"-"` //not going to be stored in the database
 	RememberHash string `gorm:"not null;unique_index"`
+	// Locale is the preferred language of the user, eg. "de".
+	// Empty means it is negotiated from the browser.
+	Locale string
+	// PurgeAt is when the user and everything they own are deleted
+	// for good, nil unless they asked to delete their account.
+	// Until then they can sign in and change their mind.
+	PurgeAt *time.Time
+}
+
+// HasPassword reports whether the user can sign in with a
+// password, see UserService.CreatePasswordless
+func (u *User) HasPassword() bool {
+	return u.PasswordHash != ""
 }
 
 // UserDB is used to interact with the users database.
@@ -43,7 +59,7 @@ func NewUserService(db *gorm.DB) UserService {
 	hmac := hash.NewHMAC(hmacSecretKey)
 	uv := newUserValidator(ug, hmac)
 	return &userService{
-		UserDB: uv,
+		userValidator: uv,
 	}
 }
 
@@ -57,18 +73,27 @@ type UserService interface {
 	// Can also return error:
 	// ErrNotFound, ErrPasswordIncorrect, or catchall error
 	Authenticate(email, password string) (*User, error)
+
+	// CreatePasswordless creates the provided user without a
+	// password, for users proving who they are some other way,
+	// eg. with a login link. They can't use Authenticate.
+	CreatePasswordless(user *User) error
 	UserDB
 }
 
 var _ UserService = &userService{}
 
-// Implementation of the userService
+// Implementation of the userService, it embeds the validator
+// itself, rather than the UserDB interface, for
+// CreatePasswordless
 type userService struct {
-	UserDB
+	*userValidator
 }
 
 type userValFunc func(*User) error
 
+// runUserValFuncs runs every validation function in order
+// and stops at the first failure
 func runUserValFuncs(user *User, fns ...userValFunc) error {
 	for _, fn := range fns {
 		if err := fn(user); err != nil {
@@ -78,14 +103,23 @@ func runUserValFuncs(user *User, fns ...userValFunc) error {
 	return nil
 }
 
+// userValChain combines validation functions that depend on each
+// other, eg. normalizing an email before checking its format, into
+// one that stops at the first failure. Used with collectValFuncs
+// so that a field only reports a single problem.
+func userValChain(fns ...userValFunc) userValFunc {
+	return func(user *User) error {
+		return runUserValFuncs(user, fns...)
+	}
+}
+
 var _ UserDB = &userValidator{}
 
 func newUserValidator(udb UserDB, hmac hash.HMAC) *userValidator {
 	return &userValidator{
-		UserDB: udb,
-		hmac:   hmac,
-		emailRegex: regexp.MustCompile(
-			`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
+		UserDB:     udb,
+		hmac:       hmac,
+		emailRegex: emailRegex,
 	}
 }
 
@@ -136,19 +170,52 @@ func (uv *userValidator) Create(user *User) error {
 		user.Remember = token
 	}
 
-	err := runUserValFuncs(user,
-		uv.passwordRequired,
-		uv.passwordMinLength,
+	// Validate user input first, reporting every problem at once
+	err := collectValFuncs(user,
+		userValChain(
+			uv.passwordRequired,
+			uv.passwordMinLength),
+		userValChain(
+			uv.normalizeEmail,
+			uv.requireEmail,
+			uv.emailFormat,
+			uv.emailIsAvail))
+	if err != nil {
+		return err
+	}
+	// bcryptPassword clears the password, so the steps
+	// below only run once the input is known to be valid
+	err = runUserValFuncs(user,
 		uv.bcryptPassword,
 		uv.passwordHashRequired,
 		uv.setRememberIfUnset, // Order of validators matter, setRememberIfUnset needs to happen first
 		uv.rememberMinBytes,
 		uv.hmacRemember, // as no hashing of an empty remember token will happen
-		uv.rememberHashRequired,
-		uv.normalizeEmail,
-		uv.requireEmail,
-		uv.emailFormat,
-		uv.emailIsAvail)
+		uv.rememberHashRequired)
+	if err != nil {
+		return err
+	}
+	return uv.UserDB.Create(user)
+}
+
+// createPasswordless is Create without the password checks
+func (uv *userValidator) createPasswordless(user *User) error {
+	user.Password = ""
+	user.PasswordHash = ""
+	err := collectValFuncs(user,
+		userValChain(
+			uv.normalizeEmail,
+			uv.requireEmail,
+			uv.emailFormat,
+			uv.emailIsAvail))
+	if err != nil {
+		return err
+	}
+	err = runUserValFuncs(user,
+		uv.setRememberIfUnset,
+		uv.rememberMinBytes,
+		uv.hmacRemember,
+		uv.rememberHashRequired)
 	if err != nil {
 		return err
 	}
@@ -158,17 +225,23 @@ func (uv *userValidator) Create(user *User) error {
 // Update will hash a remember hash if token is provided
 // in the user object
 func (uv *userValidator) Update(user *User) error {
-	err := runUserValFuncs(user,
+	err := collectValFuncs(user,
 		uv.passwordMinLength,
+		userValChain(
+			uv.normalizeEmail,
+			uv.requireEmail,
+			uv.emailFormat,
+			uv.emailIsAvail))
+	if err != nil {
+		return err
+	}
+	// No passwordHashRequired, passwordless users stay so until
+	// they set a password
+	err = runUserValFuncs(user,
 		uv.bcryptPassword,
-		uv.passwordHashRequired,
 		uv.rememberMinBytes,
 		uv.hmacRemember,
-		uv.rememberHashRequired,
-		uv.normalizeEmail,
-		uv.requireEmail,
-		uv.emailFormat,
-		uv.emailIsAvail)
+		uv.rememberHashRequired)
 	if err != nil {
 		return err
 	}
@@ -396,6 +469,10 @@ func (us *userService) Authenticate(email, password string) (*User, error) {
 	if err != nil {
 		return nil, err
 	}
+	if foundUser.PasswordHash == "" {
+		// Passwordless users sign in with a login link instead
+		return nil, ErrPasswordIncorrect
+	}
 	err = bcrypt.CompareHashAndPassword([]byte(foundUser.PasswordHash), []byte(password+userPwPepper))
 	if err != nil { // if error IS nil, fallthrough
 		switch err {
@@ -408,6 +485,11 @@ func (us *userService) Authenticate(email, password string) (*User, error) {
 	return foundUser, nil
 }
 
+// CreatePasswordless creates the user without a password
+func (us *userService) CreatePasswordless(user *User) error {
+	return us.userValidator.createPasswordless(user)
+}
+
 // first will query the provided gorm.DB and it will
 // get the first item returned and place it to dst. If
 // nothing is found the query, it will return ErrNotFound
@@ -422,8 +504,7 @@ func first(db *gorm.DB, dst interface{}) error {
 // Create will create the provided user and backfill the data
 // like ID, CreatedAt and UpdatedAt
 func (ug *userGorm) Create(user *User) error {
-	return ug.db.Create(user).Error
-	//TODO - create specific errors, like if it is invalid, or user already exists
+	return translateDBError(ug.db.Create(user).Error)
 }
 
 // Delete will delete the user with the provided ID
@@ -436,5 +517,5 @@ func (ug *userGorm) Delete(id uint) error {
 // Update will update the provided user with all of the data
 // in the provided user object
 func (ug *userGorm) Update(user *User) error {
-	return ug.db.Save(user).Error
+	return translateDBError(ug.db.Save(user).Error)
 }
@@ -2,11 +2,14 @@ package models
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 )
 
-func testingUserService() (*UserService, error) {
+// testingServices connects to the test database and resets every
+// table. Tests are skipped when the database isn't reachable.
+func testingServices(t *testing.T) *Services {
 	const (
 		host     = "localhost"
 		port     = 5432
@@ -18,27 +21,29 @@ func testingUserService() (*UserService, error) {
 	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
 		host, port, user, password, dbname)
 
-	us, err := NewUserService(psqlInfo)
+	services, err := NewServices(psqlInfo)
 	if err != nil {
-		return nil, err
+		t.Skipf("test database unavailable: %v", err)
 	}
-	us.db.LogMode(false)
+	services.db.LogMode(false)
+	t.Cleanup(func() { services.Close() })
 
 	//Clear the users table between tests
-	us.DestructiveReset()
-	return us, nil
-}
-func TestCreateUser(t *testing.T) {
-	us, err := testingUserService()
-	if err != nil {
+	if err := services.DestructiveReset(); err != nil {
 		t.Fatal(err)
 	}
+	return services
+}
+
+func TestCreateUser(t *testing.T) {
+	us := testingServices(t).User
 	user := User{
-		Name:  "Michael Scott",
-		Email: "michael@dundermifflin.com",
+		Name:     "Michael Scott",
+		Email:    "michael@dundermifflin.com",
+		Password: "password",
 	}
 
-	err = us.Create(&user)
+	err := us.Create(&user)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -53,3 +58,78 @@ func TestCreateUser(t *testing.T) {
 	}
 
 }
+
+// TestCreateUserEmailTaken skips the validator so that only the
+// unique index on email stands between the two users
+func TestCreateUserEmailTaken(t *testing.T) {
+	services := testingServices(t)
+	ug := &userGorm{services.db}
+
+	for i, remember := range []string{"remember-hash-1", "remember-hash-2"} {
+		user := User{
+			Name:         "Dwight Schrute",
+			Email:        "dwight@dundermifflin.com",
+			PasswordHash: "hash",
+			RememberHash: remember,
+		}
+		err := ug.Create(&user)
+		if i == 0 && err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && err != ErrEmailTaken {
+			t.Errorf("Expected %v. Received %v", ErrEmailTaken, err)
+		}
+	}
+}
+
+func TestCreateUserNotNull(t *testing.T) {
+	services := testingServices(t)
+	// Insert NULL rather than an empty string
+	err := services.db.Exec(
+		"INSERT INTO users (email, password_hash, remember_hash) VALUES (NULL, 'hash', 'remember')").Error
+	if got := translateDBError(err); got != ErrEmailRequired {
+		t.Errorf("Expected %v. Received %v", ErrEmailRequired, got)
+	}
+}
+
+// TestCreateUserRace signs up the same email address concurrently.
+// Both requests may pass emailIsAvail, but exactly one must be
+// created and the other must get ErrEmailTaken.
+func TestCreateUserRace(t *testing.T) {
+	us := testingServices(t).User
+
+	const n = 2
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := User{
+				Name:     "Jim Halpert",
+				Email:    "jim@dundermifflin.com",
+				Password: "password",
+			}
+			<-start
+			errs[i] = us.Create(&user)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	var created, taken int
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case Kind(err) == KindConflict:
+			taken++
+		default:
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}
+	if created != 1 || taken != n-1 {
+		t.Errorf("Expected 1 user created and %d email taken errors. Received %d and %d", n-1, created, taken)
+	}
+}
@@ -0,0 +1,405 @@
+// Package oidc implements the relying party side of OpenID
+// Connect: discovery, the authorization code flow with PKCE and
+// the verification of RS256 signed ID tokens against the JWKS of
+// the provider.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// clockSkew is tolerated between us and the provider when
+	// checking the expiry of ID tokens
+	clockSkew = time.Minute
+
+	// jwksMinRefresh limits how often the JWKS is fetched again
+	// for an unknown key ID, so that forged tokens can't make us
+	// hammer the provider
+	jwksMinRefresh = time.Minute
+
+	// maxResponseSize bounds what we read from the provider
+	maxResponseSize = 1 << 20 // 1 megabyte
+)
+
+var (
+	// ErrInvalidToken is returned by Verify for ID tokens that
+	// are malformed, badly signed or not meant for us
+	ErrInvalidToken = errors.New("oidc: invalid ID token")
+
+	// ErrExpiredToken is returned by Verify for ID tokens whose
+	// expiry is in the past
+	ErrExpiredToken = errors.New("oidc: ID token is expired")
+
+	// ErrNonceMismatch is returned by Verify when the nonce of the
+	// ID token isn't the one sent with the authorization request
+	ErrNonceMismatch = errors.New("oidc: nonce mismatch")
+)
+
+// Config of a provider, registered with it beforehand
+type Config struct {
+	// Issuer identifies the provider, eg. "https://accounts.example.com".
+	// Its discovery document is fetched from
+	// Issuer + "/.well-known/openid-configuration".
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the callback the provider sends users back to
+	RedirectURL string
+	// Scopes requested along with "openid", defaults to
+	// "email" and "profile"
+	Scopes []string
+	// HTTPClient defaults to a client with a 10 seconds timeout
+	HTTPClient *http.Client
+}
+
+// metadata is the part of the discovery document we use
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider is an OpenID Connect provider users sign in with.
+// It is safe for concurrent use.
+type Provider struct {
+	cfg  Config
+	meta metadata
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// Discover fetches the discovery document of the issuer and
+// returns the Provider it describes
+func Discover(ctx context.Context, cfg Config) (*Provider, error) {
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"email", "profile"}
+	}
+	issuer := strings.TrimSuffix(cfg.Issuer, "/")
+	p := &Provider{cfg: cfg}
+	if err := p.getJSON(ctx, issuer+"/.well-known/openid-configuration", &p.meta); err != nil {
+		return nil, err
+	}
+	// The issuer in the document must be the one we asked for,
+	// see OpenID Connect Discovery 1.0 section 4.3
+	if p.meta.Issuer != cfg.Issuer {
+		return nil, fmt.Errorf("oidc: issuer %q doesn't match %q", p.meta.Issuer, cfg.Issuer)
+	}
+	if p.meta.AuthorizationEndpoint == "" || p.meta.TokenEndpoint == "" || p.meta.JWKSURI == "" {
+		return nil, errors.New("oidc: incomplete discovery document")
+	}
+	return p, nil
+}
+
+// Issuer returns the issuer identifier of the provider
+func (p *Provider) Issuer() string {
+	return p.meta.Issuer
+}
+
+// AuthCodeURL returns the URL of the provider's consent page.
+// challenge is the S256 PKCE challenge of a code verifier, see
+// Challenge.
+func (p *Provider) AuthCodeURL(state, nonce, challenge string) string {
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, p.cfg.Scopes...), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.meta.AuthorizationEndpoint + sep + q.Encode()
+}
+
+// Challenge returns the S256 PKCE challenge of verifier
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Exchange trades an authorization code for tokens and returns
+// the raw ID token. It must be checked with Verify.
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", p.meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	resp, err := p.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("oidc: token request: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&body); err != nil {
+		return "", fmt.Errorf("oidc: token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || body.Error != "" {
+		return "", fmt.Errorf("oidc: token request: %d %s %s", resp.StatusCode, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("oidc: token response without an id_token")
+	}
+	return body.IDToken, nil
+}
+
+// Claims of an ID token
+type Claims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	Expiry          int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce"`
+	Email           string   `json:"email"`
+	EmailVerified   bool     `json:"email_verified"`
+	Name            string   `json:"name"`
+}
+
+// UnmarshalJSON accepts email_verified as a string, as some
+// providers send "true" rather than true
+func (c *Claims) UnmarshalJSON(b []byte) error {
+	type alias Claims
+	aux := struct {
+		*alias
+		EmailVerified boolish `json:"email_verified"`
+	}{alias: (*alias)(c)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	c.EmailVerified = bool(aux.EmailVerified)
+	return nil
+}
+
+// Verify checks the signature of the ID token against the keys
+// of the provider, that it was issued by the provider for us and
+// is still valid, and that it carries nonce
+func (p *Provider) Verify(ctx context.Context, rawIDToken, nonce string) (*Claims, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	// Only RS256, never "none" or an HMAC keyed with public data
+	if header.Alg != "RS256" {
+		return nil, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.Issuer != p.meta.Issuer || claims.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+	if !claims.Audience.contains(p.cfg.ClientID) {
+		return nil, ErrInvalidToken
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.cfg.ClientID {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().Add(-clockSkew).After(time.Unix(claims.Expiry, 0)) {
+		return nil, ErrExpiredToken
+	}
+	if nonce == "" || claims.Nonce != nonce {
+		return nil, ErrNonceMismatch
+	}
+	return &claims, nil
+}
+
+// key returns the public key with the ID kid, fetching the JWKS
+// again if it isn't known yet, eg. after the provider rotated
+// its keys
+func (p *Provider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key := p.lookup(kid); key != nil {
+		return key, nil
+	}
+	if time.Since(p.fetchedAt) < jwksMinRefresh {
+		return nil, ErrInvalidToken
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.meta.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.fetchedAt = time.Now()
+	p.keys = make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if pub, err := k.rsaKey(); err == nil {
+			p.keys[k.Kid] = pub
+		}
+	}
+	if key := p.lookup(kid); key != nil {
+		return key, nil
+	}
+	return nil, ErrInvalidToken
+}
+
+// lookup expects p.mu to be held. A token without a key ID can
+// only be checked if the provider has a single key.
+func (p *Provider) lookup(kid string) *rsa.PublicKey {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+	return p.keys[kid]
+}
+
+func (p *Provider) getJSON(ctx context.Context, u string, dst interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("oidc: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s: %s", u, resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(dst); err != nil {
+		return fmt.Errorf("oidc: GET %s: %w", u, err)
+	}
+	return nil
+}
+
+// jwk is an RSA JSON Web Key, see RFC 7517 and RFC 7518 section 6.3
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (k jwk) rsaKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+		return nil, errors.New("oidc: not an RSA signing key")
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	exp := new(big.Int).SetBytes(e)
+	if !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+		return nil, errors.New("oidc: invalid RSA exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+}
+
+func decodeSegment(seg string, dst interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
+
+// audience is either a single string or an array of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, aud := range a {
+		if aud == s {
+			return true
+		}
+	}
+	return false
+}
+
+// boolish is a bool that may be sent as a string
+type boolish bool
+
+func (b *boolish) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case `true`, `"true"`:
+		*b = true
+	case `false`, `"false"`, `null`:
+		*b = false
+	default:
+		return fmt.Errorf("oidc: invalid boolean %s", data)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/oidc/oidctest"
+)
+
+func testProvider(t *testing.T) (*Provider, *oidctest.Issuer) {
+	iss := oidctest.NewIssuer()
+	t.Cleanup(iss.Close)
+	p, err := Discover(context.Background(), Config{
+		Issuer:       iss.URL,
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  "http://localhost:3000/auth/oidc/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, iss
+}
+
+func TestFlow(t *testing.T) {
+	p, iss := testProvider(t)
+	iss.User = oidctest.User{Subject: "42", Email: "kevin@dundermifflin.com", EmailVerified: true}
+
+	verifier := "a-code-verifier-that-is-long-enough-to-be-accepted"
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(p.AuthCodeURL("state", "nonce", Challenge(verifier)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Query().Get("state") != "state" {
+		t.Errorf("Expected the state to be sent back. Received %q", location.Query().Get("state"))
+	}
+
+	ctx := context.Background()
+	if _, err := p.Exchange(ctx, location.Query().Get("code"), "wrong-verifier"); err == nil {
+		t.Error("Expected the exchange to fail with the wrong verifier")
+	}
+	resp, _ = client.Get(p.AuthCodeURL("state", "nonce", Challenge(verifier)))
+	resp.Body.Close()
+	location, _ = url.Parse(resp.Header.Get("Location"))
+	raw, err := p.Exchange(ctx, location.Query().Get("code"), verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := p.Verify(ctx, raw, "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "42" || claims.Email != "kevin@dundermifflin.com" || !claims.EmailVerified {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	p, iss := testProvider(t)
+	user := oidctest.User{Subject: "42", Email: "kevin@dundermifflin.com"}
+	ctx := context.Background()
+
+	valid := iss.Sign(iss.Claims(user, "nonce"))
+	if _, err := p.Verify(ctx, valid, "nonce"); err != nil {
+		t.Fatalf("Expected a valid token. Received %v", err)
+	}
+
+	with := func(key string, value interface{}) string {
+		claims := iss.Claims(user, "nonce")
+		claims[key] = value
+		return iss.Sign(claims)
+	}
+	parts := strings.Split(valid, ".")
+	tampered := parts[0] + "." + strings.Split(with("sub", "1"), ".")[1] + "." + parts[2]
+	unsigned := "eyJhbGciOiJub25lIn0." + parts[1] + "."
+
+	tests := []struct {
+		name  string
+		token string
+		nonce string
+		want  error
+	}{
+		{"wrong nonce", valid, "other", ErrNonceMismatch},
+		{"wrong audience", with("aud", "someone-else"), "nonce", ErrInvalidToken},
+		{"wrong issuer", with("iss", "https://evil.example.com"), "nonce", ErrInvalidToken},
+		{"expired", with("exp", time.Now().Add(-time.Hour).Unix()), "nonce", ErrExpiredToken},
+		{"tampered", tampered, "nonce", ErrInvalidToken},
+		{"alg none", unsigned, "nonce", ErrInvalidToken},
+		{"malformed", "not.a.jwt", "nonce", ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		if _, err := p.Verify(ctx, tt.token, tt.nonce); err != tt.want {
+			t.Errorf("%s: expected %v. Received %v", tt.name, tt.want, err)
+		}
+	}
+}
@@ -1,5 +1,19 @@
 package views
 
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/apigban/lenslocked_v1/hash"
+	"github.com/apigban/lenslocked_v1/i18n"
+	"github.com/apigban/lenslocked_v1/models"
+)
+
 const (
 	AlertLvlError   = "danger"
 	AlertLvlWarning = "warning"
@@ -10,7 +24,9 @@ const (
 	AlertMsgGeneric = "Something went wrong. Please try again. Contact us if the problem persists."
 )
 
-// Alert is used to rendned Bootstrap Alert messages in templates
+// Alert is used to rendned Bootstrap Alert messages in templates.
+// Message can be an i18n catalog key, eg. "alert.welcome", which
+// is translated when the alert is rendered.
 type Alert struct {
 	Level   string
 	Message string
@@ -20,34 +36,233 @@ type Alert struct {
 // to come in
 type Data struct {
 	Alert *Alert
-	Yield interface{}
+	User  *models.User
+	// Locale the page is rendered in, pass it to the t template
+	// function: {{t .Locale "nav.home"}}
+	Locale string
+	// Form holds the submitted values, used to re-populate inputs
+	Form url.Values
+	// Errors maps a form field name to the problem with its value
+	Errors map[string]string
+	Yield  interface{}
+
+	// err is the error passed to SetAlert. It decides the
+	// response status code and is logged if it isn't public.
+	err error
+	// alertErr and fieldErrs are the errors the alert and field
+	// messages come from, kept to translate them on render
+	alertErr  error
+	fieldErrs map[string]error
+}
+
+// KeepForm stores the submitted form values so templates can
+// re-populate the inputs. Password fields are never kept.
+func (d *Data) KeepForm(r *http.Request) {
+	d.Form = url.Values{}
+	for key, values := range r.PostForm {
+		if strings.Contains(strings.ToLower(key), "password") {
+			continue
+		}
+		d.Form[key] = values
+	}
 }
 
+// SetFieldError records a problem with the value of the named
+// form field. msg can be an i18n catalog key.
+func (d *Data) SetFieldError(field, msg string) {
+	if d.Errors == nil {
+		d.Errors = make(map[string]string)
+	}
+	d.Errors[field] = msg
+}
+
+// SetAlert displays err to the user. Errors about a specific
+// form field are also recorded in Errors. The view is rendered
+// with the status code matching err, see StatusCode.
 func (d *Data) SetAlert(err error) {
-	if pubErr, ok := err.(PublicError); ok { // Type assertion
-		d.Alert = &Alert{
-			Level:   AlertLvlError,
-			Message: pubErr.Public(), // if an error has implements the PublicError interface, display the error to end user
+	d.err = err
+	d.alertErr = err
+	if multiErr, ok := err.(MultiError); ok {
+		for _, e := range multiErr.Errors() {
+			d.setFieldErrorFrom(e)
 		}
 	} else {
-		d.Alert = &Alert{
-			Level:   AlertLvlError,
-			Message: AlertMsgGeneric, // show generic error error to enduser
-		}
+		d.setFieldErrorFrom(err)
+	}
+	d.Alert = &Alert{
+		Level: AlertLvlError,
+		// if an error implements the PublicError interface, display the error
+		// to end user, otherwise show a generic error
+		Message: ErrorMessage(i18n.DefaultLocale, err),
+	}
+}
+
+// status returns the status code the data should be rendered
+// with, based on the error passed to SetAlert
+func (d *Data) status() int {
+	if d.err == nil {
+		return http.StatusOK
 	}
-	// TODO - handle errors that are presented to the user as generic ones
-	// TODO - log alerts that are privateErrors
+	return StatusCode(d.err)
+}
 
+func (d *Data) setFieldErrorFrom(err error) {
+	if fieldErr, ok := err.(FieldError); ok && fieldErr.Field() != "" {
+		if d.fieldErrs == nil {
+			d.fieldErrs = make(map[string]error)
+		}
+		d.fieldErrs[fieldErr.Field()] = err
+		d.SetFieldError(fieldErr.Field(), ErrorMessage(i18n.DefaultLocale, err))
+	}
 }
 
+// AlertError displays msg as an error alert.
+// msg can be an i18n catalog key.
 func (d *Data) AlertError(msg string) {
+	d.alertErr = nil
 	d.Alert = &Alert{
 		Level:   AlertLvlError,
-		Message: AlertMsgGeneric, // show generic error error to enduser
+		Message: msg,
+	}
+}
+
+// translate sets the alert and field error messages in locale
+func (d *Data) translate(locale string) {
+	d.Locale = locale
+	if d.Alert != nil {
+		if d.alertErr != nil {
+			d.Alert.Message = ErrorMessage(locale, d.alertErr)
+		} else {
+			d.Alert.Message = i18n.T(locale, d.Alert.Message)
+		}
+	}
+	for field, msg := range d.Errors {
+		d.Errors[field] = i18n.T(locale, msg)
+	}
+	for field, err := range d.fieldErrs {
+		d.Errors[field] = ErrorMessage(locale, err)
 	}
 }
 
+// ErrorMessage returns the message shown to the end user for err,
+// in locale. Errors that aren't public get a generic message.
+func ErrorMessage(locale string, err error) string {
+	if multiErr, ok := err.(MultiError); ok {
+		errs := multiErr.Errors()
+		msgs := make([]string, len(errs))
+		for i, e := range errs {
+			msgs[i] = ErrorMessage(locale, e)
+		}
+		return strings.Join(msgs, "; ")
+	}
+	pubErr, ok := err.(PublicError)
+	if !ok {
+		return i18n.T(locale, "error.generic")
+	}
+	if coded, ok := err.(interface{ Code() string }); ok {
+		if msg, ok := i18n.Lookup(locale, "error."+coded.Code()); ok {
+			return msg
+		}
+	}
+	return pubErr.Public()
+}
+
 type PublicError interface {
 	error
 	Public() string
 }
+
+// MultiError is an error made of several failures, like
+// every validation problem found in a form
+type MultiError interface {
+	error
+	Errors() []error
+}
+
+// FieldError is a PublicError caused by the value of a
+// single form field, eg. "email"
+type FieldError interface {
+	PublicError
+	Field() string
+}
+
+const (
+	alertCookie = "alert"
+
+	// TODO - move to config before prod
+	alertSecretKey = "secret-alert-key"
+
+	// alertMaxAge limits how long an alert waits to be displayed
+	alertMaxAge = 5 * time.Minute
+)
+
+// RedirectAlert accepts all the normal params for an
+// http.Redirect and persists the provided alert in a signed
+// cookie, so that it is displayed by the next View.Render
+func RedirectAlert(w http.ResponseWriter, r *http.Request, urlStr string, code int, alert Alert) {
+	persistAlert(w, alert)
+	http.Redirect(w, r, urlStr, code)
+}
+
+// persistAlert stores the alert as base64(json) + "." + signature
+func persistAlert(w http.ResponseWriter, alert Alert) {
+	b, err := json.Marshal(alert)
+	if err != nil {
+		return
+	}
+	payload := base64.URLEncoding.EncodeToString(b)
+	cookie := http.Cookie{
+		Name:     alertCookie,
+		Value:    payload + "." + signAlert(payload),
+		Path:     "/",
+		Expires:  time.Now().Add(alertMaxAge),
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+}
+
+// persistedAlert returns the alert stored by persistAlert, or nil
+// if there is none or its signature doesn't match
+func persistedAlert(r *http.Request) *Alert {
+	if r == nil {
+		return nil
+	}
+	cookie, err := r.Cookie(alertCookie)
+	if err != nil {
+		return nil
+	}
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	if !hmac.Equal([]byte(signAlert(parts[0])), []byte(parts[1])) {
+		return nil
+	}
+	b, err := base64.URLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil
+	}
+	var alert Alert
+	if err := json.Unmarshal(b, &alert); err != nil {
+		return nil
+	}
+	return &alert
+}
+
+func clearAlert(w http.ResponseWriter) {
+	cookie := http.Cookie{
+		Name:     alertCookie,
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+}
+
+var alertHMAC = hash.NewHMAC(alertSecretKey)
+
+func signAlert(payload string) string {
+	return alertHMAC.Hash(payload)
+}
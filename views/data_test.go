@@ -0,0 +1,81 @@
+package views
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// redirectedWith returns a request carrying the alert cookie
+// RedirectAlert set
+func redirectedWith(t *testing.T, alert Alert) *http.Request {
+	rec := httptest.NewRecorder()
+	RedirectAlert(rec, httptest.NewRequest("POST", "/", nil), "/next", http.StatusFound, alert)
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != alertCookie {
+		t.Fatalf("Expected the %s cookie to be set. Received %v", alertCookie, cookies)
+	}
+	req := httptest.NewRequest("GET", "/next", nil)
+	req.AddCookie(cookies[0])
+	return req
+}
+
+func TestPersistedAlert(t *testing.T) {
+	alert := Alert{Level: AlertLvlSuccess, Message: "galleries.created"}
+	signed := redirectedWith(t, alert)
+	cookie, _ := signed.Cookie(alertCookie)
+	forged := base64.URLEncoding.EncodeToString([]byte(`{"Level":"danger","Message":"error.forbidden"}`))
+
+	tests := []struct {
+		name  string
+		value string
+		want  *Alert
+	}{
+		{"signed", cookie.Value, &alert},
+		{"forged signature", forged + "." + signAlert("something else"), nil},
+		{"unsigned", forged, nil},
+		{"malformed payload", "%%%." + signAlert("%%%"), nil},
+		{"not json", "bm90IGpzb24=." + signAlert("bm90IGpzb24="), nil},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: alertCookie, Value: tt.value})
+		got := persistedAlert(req)
+		if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+			t.Errorf("%s: expected %+v. Received %+v", tt.name, tt.want, got)
+		}
+	}
+	if got := persistedAlert(httptest.NewRequest("GET", "/", nil)); got != nil {
+		t.Errorf("Expected no alert without the cookie. Received %+v", got)
+	}
+}
+
+func TestRenderClearsAlert(t *testing.T) {
+	v := NewView("bootstrap", "static/home")
+	persisted := Alert{Level: AlertLvlSuccess, Message: "galleries.created"}
+	tests := []struct {
+		name string
+		data Data
+	}{
+		{"shown", Data{}},
+		// The persisted alert was left for this page, it mustn't
+		// show up on the next one
+		{"replaced", Data{Alert: &Alert{Level: AlertLvlInfo, Message: "galleries.image_deleted"}}},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		v.Render(rec, redirectedWith(t, persisted), tt.data)
+		var cleared bool
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == alertCookie && c.MaxAge < 0 && c.Expires.Before(time.Now()) {
+				cleared = true
+			}
+		}
+		if !cleared {
+			t.Errorf("%s: expected the %s cookie to be cleared. Received %v", tt.name, alertCookie, rec.Result().Cookies())
+		}
+	}
+}
@@ -0,0 +1,9 @@
+package views
+
+import "embed"
+
+// Embedded holds every template under views/ so the binary
+// doesn't depend on the directory it is run from
+//
+//go:embed */*.gohtml
+var Embedded embed.FS
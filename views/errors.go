@@ -0,0 +1,47 @@
+package views
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/models"
+)
+
+// StatusCode maps an error to the HTTP status code it should
+// be reported with. Errors can pick their own status code by
+// implementing StatusCode() int.
+func StatusCode(err error) int {
+	if sc, ok := err.(interface{ StatusCode() int }); ok {
+		return sc.StatusCode()
+	}
+	switch models.Kind(err) {
+	case models.KindInvalid:
+		return http.StatusUnprocessableEntity
+	case models.KindNotFound:
+		return http.StatusNotFound
+	case models.KindConflict:
+		return http.StatusConflict
+	case models.KindForbidden:
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// LogError logs errors that are not shown to the end user,
+// along with the request they occurred in. Public errors are
+// expected (eg. validation failures) and are not logged.
+func LogError(r *http.Request, err error) {
+	if err == nil {
+		return
+	}
+	if _, ok := err.(PublicError); ok {
+		return
+	}
+	if r == nil {
+		log.Printf("error: %v", err)
+		return
+	}
+	log.Printf("error: %v request_id=%s method=%s path=%s",
+		err, context.RequestID(r.Context()), r.Method, r.URL.Path)
+}
@@ -0,0 +1,37 @@
+package views
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/apigban/lenslocked_v1/models"
+)
+
+// teapot picks its own status code
+type teapot struct{}
+
+func (teapot) Error() string   { return "teapot" }
+func (teapot) StatusCode() int { return http.StatusTeapot }
+
+func TestStatusCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{models.ErrTitleRequired, http.StatusUnprocessableEntity},
+		{models.ValidationError{models.ErrTitleRequired, models.ErrTagInvalid}, http.StatusUnprocessableEntity},
+		{models.ErrNotFound, http.StatusNotFound},
+		{models.ErrEmailTaken, http.StatusConflict},
+		{models.ValidationError{models.ErrEmailTaken}, http.StatusConflict},
+		{models.ErrForbidden, http.StatusForbidden},
+		{models.ErrIDInvalid, http.StatusInternalServerError},
+		{errors.New("connection refused"), http.StatusInternalServerError},
+		{teapot{}, http.StatusTeapot},
+	}
+	for _, tt := range tests {
+		if got := StatusCode(tt.err); got != tt.want {
+			t.Errorf("%v: expected %d. Received %d", tt.err, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package views
+
+import (
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+// reload re-parses the view if any of its files, or the set of
+// layout files, changed since the last parse. It returns the
+// template to render, other requests may replace v.Template as
+// soon as the lock is released.
+func (v *View) reload() (*template.Template, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	files := append(append([]string{}, v.files...), layoutFiles()...)
+	if filesStamp(files) != v.stamp {
+		v.err = v.parse()
+	}
+	return v.Template, v.err
+}
+
+// filesStamp summarizes the name, size and modification time of
+// every file so that a change in any of them changes the stamp
+func filesStamp(files []string) string {
+	var sb strings.Builder
+	for _, f := range files {
+		fi, err := fs.Stat(FS, f)
+		if err != nil {
+			fmt.Fprintf(&sb, "%s:%v;", f, err)
+			continue
+		}
+		fmt.Fprintf(&sb, "%s:%d:%d;", f, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return sb.String()
+}
+
+// renderDevError shows a template error, which includes the file
+// and line it occurred on, in the browser. Never used in production.
+func renderDevError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html lang="en">
+<head><title>Template error</title></head>
+<body style="font-family: sans-serif; margin: 2em;">
+  <h1>Template error</h1>
+  <pre style="background: #fdd; padding: 1em; white-space: pre-wrap;">%s</pre>
+  <p>Fix the template and reload the page.</p>
+</body>
+</html>
+`, template.HTMLEscapeString(err.Error()))
+}
@@ -2,38 +2,116 @@ package views
 
 import (
 	"bytes"
+	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"net/http"
-	"path/filepath"
+	"os"
+	"sync"
+
+	"github.com/apigban/lenslocked_v1/context"
+	"github.com/apigban/lenslocked_v1/i18n"
+	"github.com/apigban/lenslocked_v1/models"
 )
 
 var (
-	TemplateDir string = "views/"
-	LayoutDir   string = "views/layouts/"
+	// FS is the filesystem templates are parsed from. It defaults
+	// to the templates embedded in the binary, see UseDir for
+	// reading them from disk during development.
+	FS fs.FS = Embedded
+
+	// TemplateDir and LayoutDir are relative to FS
+	TemplateDir string = ""
+	LayoutDir   string = "layouts/"
 	TemplateExt string = ".gohtml"
+
+	// AssetPath resolves the name of a static asset to the URL it
+	// is served from. Templates call it with {{asset "css/app.css"}}.
+	AssetPath = func(name string) string {
+		return "/assets/" + name
+	}
+
+	// Reload makes views re-parse their templates whenever one of
+	// the files changes and show parse errors in the browser
+	// instead of panicking. Only meant for development.
+	Reload bool
 )
 
+// UseDir makes NewView parse templates from dir on disk rather
+// than the embedded copies, so edits don't require a rebuild.
+// It needs to be called before any views are created.
+func UseDir(dir string) {
+	FS = os.DirFS(dir)
+}
+
 type View struct {
 	Template *template.Template
 	Layout   string
+
+	// Used to re-parse the templates when Reload is enabled
+	mu    sync.Mutex
+	files []string // template files, layouts are looked up on every parse
+	stamp string   // see filesStamp
+	err   error    // last parse error
 }
 
-func (v View) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	v.Render(w, nil)
+func (v *View) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.Render(w, r, nil)
 }
 
-// Render is used to render the view with predefined layout
-func (v *View) Render(w http.ResponseWriter, data interface{}) {
+// Render is used to render the view with predefined layout.
+// An alert left by RedirectAlert is shown unless data already
+// carries an alert of its own, and cleared either way once the
+// page rendered. The status code
+// follows the error passed to Data.SetAlert, if any.
+func (v *View) Render(w http.ResponseWriter, r *http.Request, data interface{}) {
+	status := http.StatusOK
+	if vd, ok := data.(Data); ok {
+		status = vd.status()
+	}
+	v.RenderStatus(w, r, status, data)
+}
+
+// RenderStatus renders the view like Render, responding
+// with the provided HTTP status code
+func (v *View) RenderStatus(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
 	w.Header().Set("Content-Type", "text/html")
-	switch data.(type) {
+	var tpl *template.Template
+	if Reload {
+		var err error
+		if tpl, err = v.reload(); err != nil {
+			renderDevError(w, err)
+			return
+		}
+	} else {
+		// Only reloads replace the template once the view is created
+		tpl = v.Template
+	}
+	var vd Data
+	switch d := data.(type) {
 	case Data:
-		// do nothing
+		vd = d
 	default:
-		data = Data{
+		vd = Data{
 			Yield: data,
 		}
 	}
+	LogError(r, vd.err)
+	locale := i18n.DefaultLocale
+	if r != nil {
+		if vd.User == nil {
+			vd.User = context.User(r.Context())
+		}
+		if l := context.Locale(r.Context()); l != "" {
+			locale = l
+		}
+	}
+	persisted := persistedAlert(r)
+	if vd.Alert == nil {
+		vd.Alert = persisted
+	}
+	vd.translate(locale)
 	// Write data to buffer before writing to response writer
 	// this avoids the scenario where during template execution,
 	// an error occurs, and part of the template is written
@@ -41,36 +119,110 @@ func (v *View) Render(w http.ResponseWriter, data interface{}) {
 
 	var buf bytes.Buffer
 
-	if err := v.Template.ExecuteTemplate(&buf, v.Layout, data); err != nil {
+	if err := tpl.ExecuteTemplate(&buf, v.Layout, vd); err != nil {
+		if Reload {
+			renderDevError(w, err)
+			return
+		}
 		http.Error(w, "Something went wrong. If the problem persists, please email us.", http.StatusInternalServerError)
 		return
 	}
 
+	if persisted != nil {
+		clearAlert(w)
+	}
+	w.WriteHeader(status)
 	io.Copy(w, &buf)
 }
 
 // NewView function parses all templates and returns a View type
-// Panics when a template cannot be used.
+// Panics when a template cannot be used, unless Reload is enabled
+// in which case the error is shown when the view is rendered.
 func NewView(layout string, files ...string) *View {
 	addTemplatePath(files)
 	addTemplateExt(files)
 
-	files = append(files, layoutFiles()...)
+	v := &View{
+		Layout: layout,
+		files:  files,
+	}
+	if err := v.parse(); err != nil {
+		if !Reload { // Parse a view that is not present, will kill the app (panic)
+			panic(err)
+		}
+		v.err = err
+	}
+	registerView(v)
+	return v
+}
 
-	t, err := template.ParseFiles(files...)
-	if err != nil { // Parse a view that is not present, will kill the app (panic)
-		panic(err)
+// parse parses the view's template files along with every layout
+func (v *View) parse() error {
+	files := append(append([]string{}, v.files...), layoutFiles()...)
+	v.stamp = filesStamp(files)
+
+	t, err := template.New("").Funcs(funcMap()).ParseFS(FS, files...)
+	if err != nil {
+		return err
 	}
+	v.Template = t
+	return nil
+}
+
+var (
+	parsedMu sync.Mutex
+	parsed   []*View
+)
+
+// registerView keeps track of every view created with NewView
+// so that Check can verify them later on
+func registerView(v *View) {
+	parsedMu.Lock()
+	defer parsedMu.Unlock()
+	parsed = append(parsed, v)
+}
+
+// Check verifies that views were parsed and that each one
+// defines the layout it is rendered with
+func Check() error {
+	parsedMu.Lock()
+	defer parsedMu.Unlock()
+	if len(parsed) == 0 {
+		return fmt.Errorf("views: no templates parsed")
+	}
+	for _, v := range parsed {
+		v.mu.Lock()
+		t, err := v.Template, v.err
+		v.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if t == nil || t.Lookup(v.Layout) == nil {
+			return fmt.Errorf("views: layout %q is not defined", v.Layout)
+		}
+	}
+	return nil
+}
 
-	return &View{
-		Template: t,
-		Layout:   layout,
+// funcMap returns the functions available to every template
+func funcMap() template.FuncMap {
+	return template.FuncMap{
+		"asset": func(name string) string {
+			return AssetPath(name)
+		},
+		"t": func(locale, key string, args ...interface{}) string {
+			return i18n.T(locale, key, args...)
+		},
+		"locales": i18n.Supported,
+		"visibilities": func() []string {
+			return models.Visibilities
+		},
 	}
 }
 
 // layoutFiles returns a slice of strings representing the layout files used by templates
 func layoutFiles() []string {
-	files, err := filepath.Glob(LayoutDir + "*" + TemplateExt)
+	files, err := fs.Glob(FS, LayoutDir+"*"+TemplateExt)
 	if err != nil {
 		panic(err)
 	}
@@ -81,7 +233,7 @@ func layoutFiles() []string {
 // representing file paths for temaplates, prepends the
 // TemplateDir to each string in the slice
 //
-// Eg. the input {"home"} yield {"views/home"}
+// Eg. the input {"home"} yield {"<TemplateDir>home"}
 func addTemplatePath(files []string) {
 	for i, f := range files {
 		files[i] = TemplateDir + f